@@ -0,0 +1,263 @@
+// Command dub runs the dubbing pipeline on a local video and writes the result to a chosen path,
+// without the HTTP server, the job queue or a callback receiver.
+//
+//	dub [flags] input.mp4
+//
+// The settings are loaded like the server's, from the YAML file given with -config or CONFIG_FILE and
+// the environment, which may be set in a .env file: the Whisper API key and the Acapela account of the
+// default tenant, the retry policies, and the voice, job timeout and temp dir the flags leave out.
+// Progress is printed to stderr, and the exit status is non-zero when the video could not be processed.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/config"
+	"videoUploadAndProcessing/pkg/events"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/logging"
+	"videoUploadAndProcessing/pkg/upload"
+	"videoUploadAndProcessing/pkg/whisper_api"
+
+	"github.com/joho/godotenv"
+)
+
+// Only every this many percent of an ffmpeg command is printed
+const ffmpegProgressStep = 10
+
+// Exit statuses
+const (
+	exitFailed = 1 // the video could not be processed
+	exitUsage  = 2 // the flags or the input are invalid
+)
+
+type options struct {
+	input      string
+	output     string
+	overwrite  bool
+	keepTemp   bool
+	timeout    time.Duration
+	tempDir    string
+	logLevel   string
+	envFile    string
+	configFile string
+	upload.ProcessingOptions
+}
+
+func main() {
+	opts, err := parseFlags(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dub: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	// Ctrl-C stops the ffmpeg commands and requests in flight
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, opts, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "dub: %v\n", err)
+		os.Exit(exitFailed)
+	}
+}
+
+func parseFlags(name string, args []string) (options, error) {
+	var opts options
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] input.mp4\n\nDubs the video with a synthesized voice and writes it to -o.\n\nFlags:\n", name)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.output, "o", "", "output video, <input>_dubbed.mp4 by default")
+	flags.BoolVar(&opts.overwrite, "overwrite", false, "replace the output video if it exists")
+	flags.StringVar(&opts.Voice, "voice", "", "Acapela voice the segments are dubbed with, processing.voice by default")
+	flags.StringVar(&opts.Language, "language", whisper_api.DefaultLanguage, "ISO 639-1 code of the language spoken in the video")
+	flags.StringVar(&opts.Subtitles, "subtitles", upload.SubtitlesBurn, fmt.Sprintf("%s to render them into the video, %s to write them next to it, %s or %s",
+		upload.SubtitlesBurn, upload.SubtitlesFile, upload.SubtitlesBoth, upload.SubtitlesNone))
+	flags.DurationVar(&opts.timeout, "timeout", 0, "give up after this long, processing.job_timeout by default")
+	flags.StringVar(&opts.tempDir, "temp-dir", "", "directory of the intermediate files, temp_dir by default")
+	flags.BoolVar(&opts.keepTemp, "keep-temp", false, "keep the intermediate files when the video could not be processed")
+	flags.StringVar(&opts.logLevel, "log-level", "error", "level of the JSON log records written to stderr: debug, info, warn or error")
+	flags.StringVar(&opts.envFile, "env", ".env", "file to load environment variables such as WHISPER_API_KEY, ACAPELA_EMAIL and ACAPELA_PASSWORD from, if it exists")
+	flags.StringVar(&opts.configFile, "config", "", "YAML configuration file, CONFIG_FILE by default")
+	if err := flags.Parse(args); err != nil {
+		return options{}, err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return options{}, errors.New("exactly one input video is required")
+	}
+	opts.input = flags.Arg(0)
+	if opts.output == "" {
+		opts.output = strings.TrimSuffix(opts.input, filepath.Ext(opts.input)) + "_dubbed.mp4"
+	}
+	if !strings.EqualFold(filepath.Ext(opts.output), ".mp4") {
+		return options{}, fmt.Errorf("output %s must be an .mp4 file", opts.output)
+	}
+	if opts.timeout < 0 {
+		return options{}, errors.New("-timeout must not be negative")
+	}
+	if err := opts.ProcessingOptions.Validate(); err != nil {
+		return options{}, err
+	}
+	return opts, nil
+}
+
+// run processes opts.input and moves the result to opts.output, printing the progress to out
+func run(ctx context.Context, opts options, out io.Writer) error {
+	logLevel, err := logging.ParseLevel(opts.logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logging.New(os.Stderr, logLevel))
+
+	if err := godotenv.Load(opts.envFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to load %s: %v", opts.envFile, err)
+	}
+	var configArgs []string
+	if opts.configFile != "" {
+		configArgs = []string{"-config", opts.configFile}
+	}
+	cfg, err := config.LoadPipeline("dub", configArgs, io.Discard)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%v", err)
+	}
+	// The flags override the configuration
+	if opts.Voice == "" {
+		opts.Voice = cfg.Processing.Voice
+	}
+	if opts.timeout == 0 {
+		opts.timeout = cfg.Processing.JobTimeout
+	}
+	if opts.tempDir == "" {
+		opts.tempDir = cfg.TempDir
+	}
+	tenant := localTenant(cfg.Tenants.Default, filepath.Dir(opts.output))
+
+	info, err := os.Stat(opts.input)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", opts.input)
+	}
+	if _, err := os.Stat(opts.output); err == nil && !opts.overwrite {
+		return fmt.Errorf("%s already exists, use -overwrite to replace it", opts.output)
+	}
+
+	// The same registry and progress events as the server, without persistence or callbacks
+	registry := jobs.NewRegistry()
+	progressEvents := events.NewHub()
+	progressEvents.Watch(registry)
+
+	status, err := registry.Create(jobs.Status{
+		FileName:            filepath.Base(opts.input),
+		UnprocessedFilePath: opts.input,
+		TenantID:            tenant.ID,
+	})
+	if err != nil {
+		return err
+	}
+	job := upload.Job{
+		ID:                  status.ID,
+		FileName:            status.FileName,
+		UnprocessedFilePath: status.UnprocessedFilePath,
+		Tenant:              tenant,
+	}
+
+	_, live, cancel, _ := progressEvents.Subscribe(job.ID, 0)
+	defer cancel()
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		printProgress(out, live, time.Now())
+	}()
+
+	ctx, cancelTimeout := context.WithTimeout(ctx, opts.timeout)
+	defer cancelTimeout()
+	err = upload.ProcessJob(ctx, job, 1, opts.tempDir, registry, nil, nil, cfg.RetryPolicies(), opts.ProcessingOptions, progressEvents.Reporter(job.ID))
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w: %v", context.Cause(ctx), err)
+		}
+		registry.Fail(job.ID, err)
+		<-printed
+		if !opts.keepTemp {
+			os.RemoveAll(upload.JobTempDir(opts.tempDir, job.ID))
+		}
+		if status, ok := registry.Get(job.ID); ok && status.Failure != nil {
+			return fmt.Errorf("failed while %s: %w", status.Failure.Stage, err)
+		}
+		return err
+	}
+	<-printed
+
+	status, _ = registry.Get(job.ID)
+	if err := moveOutput(status.ProcessedFilePath, opts.output, opts.ProcessingOptions); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Dubbed video written to %s\n", opts.output)
+	return nil
+}
+
+// localTenant is the tenant the video is processed as, with the credentials of the default tenant
+// of the configuration. The pipeline writes its output under outputRoot.
+func localTenant(defaultTenant config.Tenant, outputRoot string) auth.Tenant {
+	return auth.Tenant{
+		ID:              auth.DefaultTenantID,
+		OutputRoot:      outputRoot,
+		WhisperAPIKey:   defaultTenant.WhisperAPIKey,
+		AcapelaEmail:    defaultTenant.AcapelaEmail,
+		AcapelaPassword: defaultTenant.AcapelaPassword,
+	}
+}
+
+// moveOutput renames the video written by the pipeline, and its SRT file if any, to output
+func moveOutput(processed string, output string, options upload.ProcessingOptions) error {
+	if err := os.Rename(processed, output); err != nil {
+		return fmt.Errorf("failed to move the dubbed video to %s: %v", output, err)
+	}
+	if options.Subtitles == upload.SubtitlesFile || options.Subtitles == upload.SubtitlesBoth {
+		srt := upload.SubtitleFilePath(output)
+		if err := os.Rename(upload.SubtitleFilePath(processed), srt); err != nil {
+			return fmt.Errorf("failed to move the subtitles to %s: %v", srt, err)
+		}
+	}
+	return nil
+}
+
+// printProgress prints the events of the job until it finishes
+func printProgress(out io.Writer, live <-chan events.Event, started time.Time) {
+	lastPercent := make(map[string]int)
+	for event := range live {
+		elapsed := event.Time.Sub(started).Truncate(time.Second)
+		switch event.Type {
+		case events.TypeState:
+			fmt.Fprintf(out, "[%s] %s\n", elapsed, event.State)
+		case events.TypeSegment:
+			fmt.Fprintf(out, "[%s] dubbed segment %d/%d\n", elapsed, event.SegmentsDone, event.SegmentsTotal)
+		case events.TypeFFmpegProgress:
+			percent := int(event.Percent) / ffmpegProgressStep * ffmpegProgressStep
+			if last, ok := lastPercent[event.Stage]; ok && percent <= last {
+				continue
+			}
+			lastPercent[event.Stage] = percent
+			fmt.Fprintf(out, "[%s] %s %d%%\n", elapsed, event.Stage, percent)
+		}
+	}
+}
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/config"
+	"videoUploadAndProcessing/pkg/events"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/logging"
+	"videoUploadAndProcessing/pkg/metrics"
+	"videoUploadAndProcessing/pkg/tracing"
 	"videoUploadAndProcessing/pkg/upload"
+	"videoUploadAndProcessing/pkg/webhook"
 
 	"github.com/joho/godotenv"
 )
@@ -17,54 +32,179 @@ func main() {
 		envPath = ".env" // Default to the local .env file
 	}
 
-	// load .env file
+	// load .env file, the settings may come from the environment, the configuration file or the flags instead
 	err := godotenv.Load(envPath)
-	if err != nil {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Fatalf("Error loading .env file from path %s: %v", envPath, err)
 	}
 
-	logfilepath := os.Getenv("VIDEO_PROCESSING_LOG_PATH")
-
-	// Extract the directory path from the log file path
-	logDir, _ := filepath.Split(logfilepath)
-
-	// Create the directory (including any necessary parent directories) if it doesn't exist
-	err = os.MkdirAll(logDir, 0755)
+	// Read the settings from the configuration file, the environment and the flags, and check them all.
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatalf("Failed to create log directory: %v\n", err)
+		log.Fatalf("Invalid configuration:\n%v\n", err)
 	}
 
-	// Create the log file with necessary permissions
-	logFile, err := os.OpenFile(logfilepath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	// Create the directory of the log file (including any necessary parent directories) if it doesn't exist
+	if logDir := filepath.Dir(cfg.Log.Path); logDir != "." {
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			log.Fatalf("Failed to create log directory: %v\n", err)
+		}
+	}
+
+	// The log file is rotated once it reaches log.max_size_mb, keeping log.max_backups old files
+	logFile, err := logging.OpenRotatingFile(cfg.Log.Path, int64(cfg.Log.MaxSizeMB)<<20, cfg.Log.MaxBackups)
 	if err != nil {
 		log.Fatalf("Failed to open or create log file: %v\n", err)
 	}
 	defer logFile.Close()
 
-	// Redirect log output to file
-	log.SetOutput(logFile)
-	log.Printf("Writing log in %s", logfilepath)
-	// Create a tmp directory
-	tmpDir := "tmp"
-	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+	// Write JSON records to the log file; the log package is redirected there as well
+	logLevel, _ := cfg.LogLevel()
+	slog.SetDefault(logging.New(logFile, logLevel))
+	slog.Info("Writing log", "path", cfg.Log.Path, "level", logLevel.String())
+	// Create a tmp directory, the jobs keep their intermediate files and checkpoints there
+	if err := os.MkdirAll(cfg.TempDir, 0755); err != nil {
 		log.Fatalf("Failed to create tmp directory: %v\n", err)
 	}
 
-	// Create a new job queue with 100 slots.
-	jobQueue := make(chan upload.Job, 100)
+	// Export trace spans to an OpenTelemetry collector over OTLP/HTTP and/or to a local file.
+	var traceExporters []tracing.Exporter
+	if endpoint := cfg.TracesEndpoint(); endpoint != "" {
+		headers, _ := tracing.ParseHeaders(cfg.Tracing.OTLPHeaders)
+		traceExporters = append(traceExporters, tracing.NewOTLPExporter(endpoint, headers))
+	}
+	if cfg.Tracing.File != "" {
+		fileExporter, err := tracing.NewFileExporter(cfg.Tracing.File)
+		if err != nil {
+			log.Fatalf("Failed to open traces file: %v\n", err)
+		}
+		defer fileExporter.Close()
+		traceExporters = append(traceExporters, fileExporter)
+	}
+	var tracerProvider *tracing.Provider
+	if len(traceExporters) > 0 {
+		tracerProvider = tracing.Init(cfg.Tracing.ServiceName, traceExporters...)
+	}
+
+	// Load the tenants allowed to use the API, or the single tenant of the configuration.
+	tenants, err := cfg.LoadTenants()
+	if err != nil {
+		log.Fatalf("Invalid tenant configuration: %v\n", err)
+	}
+
+	// Create a new job queue.
+	jobQueue := make(chan upload.Job, cfg.Processing.QueueCapacity)
+
+	// Open the job store so queued and running jobs survive a restart.
+	jobStore, err := jobs.OpenStore(cfg.Storage.JobStorePath)
+	if err != nil {
+		log.Fatalf("Failed to open job store: %v\n", err)
+	}
+	defer jobStore.Close()
+
+	// Create the registry that tracks the state of every submitted job, restoring it from the store.
+	registry, err := jobs.NewPersistentRegistry(jobStore)
+	if err != nil {
+		log.Fatalf("Failed to restore jobs from %s: %v\n", cfg.Storage.JobStorePath, err)
+	}
+
+	// Open the webhook delivery log and create the dispatcher that signs and retries callbacks.
+	webhookStore, err := webhook.OpenStore(cfg.Webhooks.LogPath)
+	if err != nil {
+		log.Fatalf("Failed to open webhook delivery log: %v\n", err)
+	}
+	defer webhookStore.Close()
+
+	if cfg.Webhooks.Secret == "" {
+		slog.Warn("WEBHOOK_SECRET is not set, callbacks will not be signed")
+	}
+
+	// Only send callbacks to allowed hosts, never to loopback or private addresses unless allowed for development.
+	callbackGuard, err := cfg.CallbackGuard()
+	if err != nil {
+		log.Fatalf("Invalid callback URL allowlist: %v\n", err)
+	}
+	if cfg.Webhooks.AllowPrivateNetworks {
+		slog.Warn("Callbacks to private networks are allowed, callbacks may reach loopback and private addresses")
+	}
+
+	webhooks, err := webhook.NewDispatcher(cfg.Webhooks.Secret, cfg.Webhooks.Retry.Policy(), callbackGuard, webhookStore)
+	if err != nil {
+		log.Fatalf("Failed to restore webhook deliveries from %s: %v\n", cfg.Webhooks.LogPath, err)
+	}
+	webhooks.ResumePending()
+
+	// Notify the callback URL of every job that is done, failed or cancelled.
+	registry.OnFinished(func(status jobs.Status) {
+		upload.SendCallback(webhooks, status)
+		upload.SendBatchCallback(webhooks, registry, status)
+	})
+
+	// Record the duration and outcome of every finished job for /metrics.
+	registry.OnFinished(upload.ObserveFinished)
+
+	// Publish the progress of every job for the /jobs/{id}/events streams.
+	progressEvents := events.NewHub()
+	progressEvents.Watch(registry)
+
+	// Enforce the quotas of the tenants at submission and in the worker pool.
+	quotas := upload.NewQuotas(registry)
+
+	// Reject submissions instead of blocking when the queue is full or a client has too many unfinished jobs.
+	admission := upload.NewAdmissionController(jobQueue, registry, quotas, cfg.Processing.Workers, cfg.Processing.MaxJobsPerClient)
+
+	// Stop admitting and starting jobs on shutdown, running jobs get the grace period to finish.
+	drainer := upload.NewDrainer(registry, admission)
+
+	// Read s3:// inputs from the input buckets and keep the outputs in the output bucket, if configured.
+	objectStorage, err := cfg.ObjectStorage()
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %v\n", err)
+	}
+	slog.Info("Output storage configured", "location", objectStorage.Description())
 
-	// Initialize a slice of workers based on the defined number of workers in the upload package.
-	workers := make([]upload.Worker, upload.NumWorkers)
+	// Initialize a slice of workers based on the configured number of workers.
+	retryPolicies := cfg.RetryPolicies()
+	workers := make([]upload.Worker, cfg.Processing.Workers)
 
 	// Initialize and start all the workers.
-	for i := 0; i < upload.NumWorkers; i++ {
+	for i := range workers {
 		workers[i] = upload.Worker{
-			ID:       i + 1,    // Assign a unique ID to each worker starting from 1.
-			JobQueue: jobQueue, // All workers share the same job queue.
+			ID:            i + 1,                      // Assign a unique ID to each worker starting from 1.
+			JobQueue:      jobQueue,                   // All workers share the same job queue.
+			Registry:      registry,                   // All workers report progress to the same registry.
+			JobTimeout:    cfg.Processing.JobTimeout,  // Jobs running longer than this are stopped.
+			RetryPolicies: retryPolicies,              // Failed stages, segments and jobs are retried with these policies.
+			Admission:     admission,                  // Decides whether new jobs may enter the queue.
+			Drainer:       drainer,                    // Stops the worker from picking up new jobs on shutdown.
+			Webhooks:      webhooks,                   // Sends and records the callbacks.
+			Events:        progressEvents,             // Publishes the progress of the jobs.
+			Deduplicate:   cfg.Processing.Deduplicate, // Returns the existing job for videos that were already submitted.
+			Tenants:       tenants,                    // Provides the credentials and output root of requeued jobs.
+			Quotas:        quotas,                     // Limits the jobs and TTS characters of each tenant.
+			Storage:       objectStorage,              // Downloads s3:// inputs and stores the outputs.
+			Voice:         cfg.Processing.Voice,       // Dubs the segments with this Acapela voice.
+			MaxUploadSize: cfg.Uploads.MaxSize,        // Rejects uploaded videos larger than this.
+			TempDir:       cfg.TempDir,                // Keeps the intermediate files and checkpoints of the jobs here.
 		}
 		workers[i].Start() // Start the worker.
 	}
 
+	// Expose the queue depth and the size of the worker pool on /metrics.
+	upload.RegisterQueueMetrics(admission, jobQueue, cfg.Processing.Workers)
+
+	// Put the jobs that were interrupted by the last shutdown back in the queue.
+	go upload.RequeuePending(workers[0])
+
+	// Submit the videos dropped into the watched folder, moving them to processing/, done/ and failed/.
+	if cfg.Watch.Enabled {
+		watchTenant, _ := tenants.Get(cfg.Watch.Tenant)
+		upload.NewFolderWatcher(workers[0], watchTenant, cfg.Watch.Pattern, cfg.Watch.PollInterval, cfg.Watch.StableFor).Start()
+	}
+
 	// Create a new HTTP ServeMux.
 	mux := http.NewServeMux()
 
@@ -75,13 +215,98 @@ func main() {
 		upload.HandleUpload(w, r, workers[0])
 	})
 
+	// Register a route that accepts the video itself in the request body.
+	mux.HandleFunc("/video-upload", func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleStreamUpload(w, r, workers[0])
+	})
+
+	// Register routes for resumable (tus-style) uploads sent in several chunks.
+	resumableUploads := upload.NewResumableUploads(tenants, cfg.Uploads.ResumableExpiry)
+	resumableUploads.StartCleanup()
+	resumableHandler := func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleResumableUpload(w, r, workers[0], resumableUploads)
+	}
+	mux.HandleFunc("/uploads", resumableHandler)
+	mux.HandleFunc("/uploads/", resumableHandler)
+
+	// Register routes that submit a batch of videos and report its progress.
+	batchesHandler := func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleBatches(w, r, workers[0])
+	}
+	mux.HandleFunc("/batches", batchesHandler)
+	mux.HandleFunc("/batches/", batchesHandler)
+
+	// Register routes that report job status.
+	jobsHandler := func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleJobs(w, r, workers[0])
+	}
+	mux.HandleFunc("/jobs", jobsHandler)
+	mux.HandleFunc("/jobs/", jobsHandler)
+
+	// Register routes that report the callback delivery log of every tenant, for admins only.
+	webhooksHandler := auth.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleWebhookDeliveries(w, r, webhooks)
+	}))
+	mux.Handle("/webhooks/deliveries", webhooksHandler)
+	mux.Handle("/webhooks/deliveries/", webhooksHandler)
+
+	// Register a route that reports or starts the drain before a shutdown, for admins only.
+	mux.Handle("/admin/drain", auth.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleDrain(w, r, drainer, cfg.Processing.ShutdownGracePeriod)
+	})))
+
+	// Register the Prometheus metrics of every tenant's jobs, for admins only.
+	mux.Handle("/metrics", auth.RequireAdmin(metrics.Handler()))
+
+	// Report not ready when the intermediate files of the jobs may not fit on the disk.
+	readiness := upload.NewReadinessChecker(tenants, drainer, cfg.TempDir, cfg.Health.MinFreeDiskMB<<20, objectStorage)
+
+	// Register a route that reports the outcome of every readiness check, for admins only.
+	mux.Handle("/admin/readiness", auth.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleReadiness(w, r, readiness)
+	})))
+
+	// Every request must carry the API key of a tenant, except the probes of the orchestrator.
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", upload.HandleHealthz)
+	root.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		upload.HandleReadyz(w, r, readiness)
+	})
+	root.Handle("/", auth.Middleware(tenants, mux))
+
 	// Define the port for the server.
-	port := os.Getenv("VIDEO_PROCESSING_PORT")
-	log.Printf("Starting server on port %s\n", port)
+	port := cfg.Port
+	slog.Info("Starting server", "port", port)
 
 	// Start the HTTP server.
-	err = http.ListenAndServe(":"+port, mux)
-	if err != nil {
+	server := &http.Server{Addr: ":" + port, Handler: root}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Wait for SIGTERM or SIGINT, then drain before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Error starting server: %v\n", err)
+	case <-ctx.Done():
+		stop()
+		slog.Info("Shutdown requested, draining", "grace_period", cfg.Processing.ShutdownGracePeriod.String())
+	}
+
+	// Keep serving status requests while the running jobs finish.
+	drainer.Drain(cfg.Processing.ShutdownGracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error shutting down server", "error", err)
+	}
+	// Export the spans of the last jobs.
+	if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error exporting the last spans", "error", err)
 	}
+	slog.Info("Server stopped")
 }
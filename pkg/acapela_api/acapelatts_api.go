@@ -2,13 +2,18 @@ package acapela_api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
+	"time"
+	"unicode/utf8"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/tracing"
 )
 
 type LoginResponse struct {
@@ -19,18 +24,23 @@ type AcapelaResponse struct {
 	Content []byte
 }
 
-func CallAcapelaAPI(text string, voice string) (AcapelaResponse, error) {
+// Credentials are the Acapela account used to synthesize speech
+type Credentials struct {
+	Email    string
+	Password string
+}
+
+// CallAcapelaAPI logs in with creds and synthesizes the text; both requests are aborted if ctx is cancelled
+func CallAcapelaAPI(ctx context.Context, creds Credentials, text string, voice string) (AcapelaResponse, error) {
 	// Define the login URL and the API endpoint
 	loginURL := "https://www.acapela-cloud.com/api/login/"
 	apiEndpoint := "https://www.acapela-cloud.com/api/command/"
 
-	// 讀取環境變數
-	email := os.Getenv("ACAPELA_EMAIL")
-	password := os.Getenv("ACAPELA_PASSWORD")
+	email, password := creds.Email, creds.Password
 
-	// 如果環境變數未設置，返回錯誤
+	// 如果帳號未設置，返回錯誤
 	if email == "" || password == "" {
-		return AcapelaResponse{}, fmt.Errorf("error: Missing email or password environment variable")
+		return AcapelaResponse{}, retry.Permanent(fmt.Errorf("error: Missing Acapela email or password"))
 	}
 
 	// Define the login credentials
@@ -46,28 +56,38 @@ func CallAcapelaAPI(text string, voice string) (AcapelaResponse, error) {
 	}
 
 	// Send a POST request to the login URL
-	resp, err := http.Post(loginURL, "application/json", bytes.NewBuffer(credentialsJSON))
+	loginReq, err := http.NewRequestWithContext(ctx, "POST", loginURL, bytes.NewBuffer(credentialsJSON))
+	if err != nil {
+		return AcapelaResponse{}, err
+	}
+	loginReq.Header.Set("Content-Type", "application/json")
+
+	started := time.Now()
+	span := tracing.StartRequest(loginReq, "Acapela login")
+	resp, err := http.DefaultClient.Do(loginReq)
+	span.EndRequest(resp, err)
+	observeRequest("login", started, resp, err)
 	if err != nil {
-		log.Printf("Error posting to Acapela login API: %v", err)
+		slog.ErrorContext(ctx, "Error posting to Acapela login API", "error", err)
 		return AcapelaResponse{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Received status code %d from Acapela login API", resp.StatusCode)
-		return AcapelaResponse{}, fmt.Errorf("error: Unable to login. Status code: %d", resp.StatusCode)
+		slog.ErrorContext(ctx, "Unexpected status code from Acapela login API", "status_code", resp.StatusCode)
+		return AcapelaResponse{}, fmt.Errorf("error: Unable to login: %w", retry.NewStatusError("Acapela login API", resp))
 	}
 
 	// 解析登入回應，檢查 Token 是否成功取得
 	loginResponse := LoginResponse{}
 	err = json.NewDecoder(resp.Body).Decode(&loginResponse)
 	if err != nil {
-		log.Printf("Error decoding login response: %v", err)
+		slog.ErrorContext(ctx, "Error decoding login response", "error", err)
 		return AcapelaResponse{}, err
 	}
 
 	if loginResponse.Token == "" {
-		log.Println("Received empty token from Acapela login API")
+		slog.ErrorContext(ctx, "Received empty token from Acapela login API")
 		return AcapelaResponse{}, fmt.Errorf("error: Received empty token")
 	}
 
@@ -85,7 +105,7 @@ func CallAcapelaAPI(text string, voice string) (AcapelaResponse, error) {
 	}
 
 	// Create a new HTTP request
-	req, err := http.NewRequest("POST", apiEndpoint, bytes.NewBuffer(ttsDataJSON))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiEndpoint, bytes.NewBuffer(ttsDataJSON))
 	if err != nil {
 		return AcapelaResponse{}, err
 	}
@@ -95,16 +115,21 @@ func CallAcapelaAPI(text string, voice string) (AcapelaResponse, error) {
 	req.Header.Set("Authorization", "Token "+loginResponse.Token)
 
 	// Send the request
+	started = time.Now()
+	span = tracing.StartRequest(req, "Acapela command")
+	span.SetAttributes(tracing.Int("tts.characters", utf8.RuneCountInString(text)), tracing.String("tts.voice", voice))
 	resp, err = http.DefaultClient.Do(req)
+	span.EndRequest(resp, err)
+	observeRequest("command", started, resp, err)
 	if err != nil {
-		log.Printf("Error posting to Acapela command API: %v", err)
+		slog.ErrorContext(ctx, "Error posting to Acapela command API", "error", err)
 		return AcapelaResponse{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Received status code %d from Acapela command API", resp.StatusCode)
-		return AcapelaResponse{}, fmt.Errorf("error: Unable to generate audio. Status code: %d", resp.StatusCode)
+		slog.ErrorContext(ctx, "Unexpected status code from Acapela command API", "status_code", resp.StatusCode)
+		return AcapelaResponse{}, fmt.Errorf("error: Unable to generate audio: %w", retry.NewStatusError("Acapela command API", resp))
 	}
 
 	// Read the response content
@@ -113,21 +138,22 @@ func CallAcapelaAPI(text string, voice string) (AcapelaResponse, error) {
 		return AcapelaResponse{}, err
 	}
 
+	charactersSynthesized.Add(float64(utf8.RuneCountInString(text)))
 	return AcapelaResponse{Content: content}, nil
 }
 
-func ConvertTextToSpeechUsingAcapela(text string, voice string, segmentIndex int, tempDirPrefix string) (string, error) {
-	// 使用提供的文字和語音調用Acapela API
-	acapelaResp, err := CallAcapelaAPI(text, voice)
+func ConvertTextToSpeechUsingAcapela(ctx context.Context, creds Credentials, text string, voice string, segmentIndex int, tempDirPrefix string) (string, error) {
+	// 使用提供的帳號、文字和語音調用Acapela API
+	acapelaResp, err := CallAcapelaAPI(ctx, creds, text, voice)
 	if err != nil {
-		log.Printf("Failed to convert text to speech using Acapela API: %v", err)
+		slog.ErrorContext(ctx, "Failed to convert text to speech using Acapela API", "error", err)
 		return "", err
 	}
 
 	// 檢查返回的內容是否為mp3格式
 	contentType := http.DetectContentType(acapelaResp.Content)
 	if contentType != "audio/mpeg" {
-		log.Println("The content is not in MP3 format")
+		slog.ErrorContext(ctx, "The content is not in MP3 format", "content_type", contentType)
 		return "", fmt.Errorf("error: the content is not in MP3 format")
 	}
 
@@ -139,14 +165,14 @@ func ConvertTextToSpeechUsingAcapela(text string, voice string, segmentIndex int
 
 	// 確保 audio 子目錄存在
 	if err := os.MkdirAll(audioDir, 0755); err != nil {
-		log.Printf("Failed to create audio directory: %v", err)
+		slog.ErrorContext(ctx, "Failed to create audio directory", "error", err)
 		return "", err
 	}
 
 	// 儲存音頻到文件
-	err = saveAudioToFile(acapelaResp.Content, tempAudioFilePath) // 這裡應該傳入完整路徑
+	err = saveAudioToFile(ctx, acapelaResp.Content, tempAudioFilePath) // 這裡應該傳入完整路徑
 	if err != nil {
-		log.Printf("Failed to save audio to file: %v", err)
+		slog.ErrorContext(ctx, "Failed to save audio to file", "error", err)
 		return "", err
 	}
 
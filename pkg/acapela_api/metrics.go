@@ -0,0 +1,24 @@
+package acapela_api
+
+import (
+	"net/http"
+	"time"
+	"videoUploadAndProcessing/pkg/metrics"
+)
+
+var (
+	requestDuration = metrics.NewHistogram("acapela_request_duration_seconds",
+		`Latency of Acapela API requests by endpoint (login or command) and response status ("error" when no response was received), the _count series give the error rate.`,
+		metrics.DefaultBuckets, "endpoint", "status")
+	charactersSynthesized = metrics.NewCounter("acapela_tts_characters_total",
+		"Characters of text synthesized by Acapela.")
+)
+
+// observeRequest records a request to the endpoint sent at started, resp is nil if it failed
+func observeRequest(endpoint string, started time.Time, resp *http.Response, err error) {
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	requestDuration.Observe(time.Since(started).Seconds(), endpoint, metrics.StatusLabel(statusCode, err))
+}
@@ -1,20 +1,21 @@
 package acapela_api
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 )
 
-func saveAudioToFile(content []byte, tempAudioFilePath string) error {
+func saveAudioToFile(ctx context.Context, content []byte, tempAudioFilePath string) error {
 
 	// 確認路徑存在，如果不存在則建立資料夾
 	dirPath := path.Dir(tempAudioFilePath)
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
 		err = os.MkdirAll(dirPath, 0755)
 		if err != nil {
-			log.Printf("error creating directory: %v", err)
+			slog.ErrorContext(ctx, "Error creating directory", "path", dirPath, "error", err)
 			return fmt.Errorf("error creating directory: %v", err)
 		}
 	}
@@ -22,7 +23,7 @@ func saveAudioToFile(content []byte, tempAudioFilePath string) error {
 	// 建立檔案
 	file, err := os.Create(tempAudioFilePath)
 	if err != nil {
-		log.Printf("error creating file: %v", err)
+		slog.ErrorContext(ctx, "Error creating file", "path", tempAudioFilePath, "error", err)
 		return fmt.Errorf("error creating file: %v", err)
 	}
 	defer file.Close()
@@ -30,7 +31,7 @@ func saveAudioToFile(content []byte, tempAudioFilePath string) error {
 	// 寫入音檔內容
 	_, err = file.Write(content)
 	if err != nil {
-		log.Printf("error writing to file: %v", err)
+		slog.ErrorContext(ctx, "Error writing to file", "path", tempAudioFilePath, "error", err)
 		return fmt.Errorf("error writing to file: %v", err)
 	}
 
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type contextKey struct{}
+
+// WithTenant returns a copy of ctx carrying the authenticated tenant
+func WithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, tenant)
+}
+
+// FromContext returns the tenant authenticated by Middleware
+func FromContext(ctx context.Context) (Tenant, bool) {
+	tenant, ok := ctx.Value(contextKey{}).(Tenant)
+	return tenant, ok
+}
+
+// Middleware rejects requests without a valid API key with 401, and passes the tenant owning the key
+// to next in the request context. The key is sent as "Authorization: Bearer <key>" or "X-API-Key: <key>".
+func Middleware(tenants *Tenants, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, ok := tenants.Authenticate(apiKey(r))
+		if !ok {
+			slog.WarnContext(r.Context(), "Rejected unauthenticated request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="video-processing"`)
+			http.Error(w, "Missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), tenant)))
+	})
+}
+
+// RequireAdmin only lets admin tenants through, the others get 403. It must run behind Middleware.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, ok := FromContext(r.Context())
+		if !ok || !tenant.Admin {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// KeyID identifies the API key the request was sent with without revealing it: the first 8 bytes of
+// its SHA-256, in hex. It is empty when the request carries no key.
+func KeyID(r *http.Request) string {
+	key := apiKey(r)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func apiKey(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
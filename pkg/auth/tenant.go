@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultTenantID is the single tenant of a deployment configured without a tenants file.
+// Jobs recorded before tenants existed belong to it.
+const DefaultTenantID = "default"
+
+// API keys shorter than this are refused, they would be too easy to guess
+const minAPIKeyLength = 16
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Tenant is a customer of the service with its own credentials, storage roots and jobs
+type Tenant struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name,omitempty"`
+	APIKeys         []string `json:"api_keys"`                    // keys accepted as "Authorization: Bearer <key>" or X-API-Key
+	Admin           bool     `json:"admin,omitempty"`             // may use the /admin and /webhooks routes
+	InputRoot       string   `json:"input_root"`                  // videos submitted by path must be under this directory
+	OutputRoot      string   `json:"output_root"`                 // processed videos are written here
+	UploadRoot      string   `json:"upload_root,omitempty"`       // uploaded videos are stored here, <input_root>/uploads by default
+	S3InputPrefixes []string `json:"s3_input_prefixes,omitempty"` // s3://bucket/prefix locations the videos submitted as s3:// objects must be under
+	WhisperAPIKey   string   `json:"whisper_api_key"`
+	AcapelaEmail    string   `json:"acapela_email"`
+	AcapelaPassword string   `json:"acapela_password"`
+	Limits          Limits   `json:"limits"`
+}
+
+// Limits are the quotas of a tenant, 0 means unlimited
+type Limits struct {
+	ConcurrentJobs        int     `json:"concurrent_jobs"`          // jobs processed at the same time by the worker pool
+	JobsPerHour           int     `json:"jobs_per_hour"`            // jobs submitted in any 60 minute window
+	VideoMinutesPerDay    float64 `json:"video_minutes_per_day"`    // minutes of video submitted per UTC day
+	TTSCharactersPerMonth int     `json:"tts_characters_per_month"` // characters sent to Acapela per UTC month
+}
+
+// UploadDir returns where the videos uploaded by the tenant are stored
+func (t Tenant) UploadDir() string {
+	if t.UploadRoot != "" {
+		return t.UploadRoot
+	}
+	return filepath.Join(t.InputRoot, "uploads")
+}
+
+// Owns reports whether a job recorded with the tenant id belongs to the tenant
+func (t Tenant) Owns(tenantID string) bool {
+	if tenantID == "" {
+		return t.ID == DefaultTenantID
+	}
+	return tenantID == t.ID
+}
+
+// Tenants is the set of tenants allowed to use the service
+type Tenants struct {
+	byID  map[string]Tenant
+	byKey map[[sha256.Size]byte]string // SHA-256 of every API key -> tenant id
+}
+
+type tenantsFile struct {
+	Tenants []Tenant `json:"tenants"`
+}
+
+// LoadTenants reads the tenants from a JSON file of the form {"tenants": [...]}.
+// The file holds credentials and should only be readable by the service.
+func LoadTenants(path string) (*Tenants, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %v", err)
+	}
+	var file tenantsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file %s: %v", path, err)
+	}
+	return NewTenants(file.Tenants)
+}
+
+// NewTenants validates the tenants and indexes them by id and API key
+func NewTenants(list []Tenant) (*Tenants, error) {
+	if len(list) == 0 {
+		return nil, fmt.Errorf("at least one tenant must be configured")
+	}
+
+	t := &Tenants{
+		byID:  make(map[string]Tenant),
+		byKey: make(map[[sha256.Size]byte]string),
+	}
+	for _, tenant := range list {
+		if !tenantIDPattern.MatchString(tenant.ID) {
+			return nil, fmt.Errorf("invalid tenant id %q: use lowercase letters, digits, - and _", tenant.ID)
+		}
+		if _, ok := t.byID[tenant.ID]; ok {
+			return nil, fmt.Errorf("tenant %s is defined twice", tenant.ID)
+		}
+		if tenant.InputRoot == "" || tenant.OutputRoot == "" {
+			return nil, fmt.Errorf("tenant %s: input_root and output_root are required", tenant.ID)
+		}
+		if len(tenant.APIKeys) == 0 {
+			return nil, fmt.Errorf("tenant %s has no API key", tenant.ID)
+		}
+		for _, key := range tenant.APIKeys {
+			if len(key) < minAPIKeyLength {
+				return nil, fmt.Errorf("tenant %s: API keys must be at least %d characters long", tenant.ID, minAPIKeyLength)
+			}
+			hash := sha256.Sum256([]byte(key))
+			if owner, ok := t.byKey[hash]; ok {
+				return nil, fmt.Errorf("tenant %s: API key already used by tenant %s", tenant.ID, owner)
+			}
+			t.byKey[hash] = tenant.ID
+		}
+		for _, prefix := range tenant.S3InputPrefixes {
+			bucket, _, _ := strings.Cut(strings.TrimPrefix(prefix, "s3://"), "/")
+			if !strings.HasPrefix(prefix, "s3://") || bucket == "" {
+				return nil, fmt.Errorf("tenant %s: S3 input prefix %q must be s3://bucket or s3://bucket/prefix", tenant.ID, prefix)
+			}
+		}
+		if tenant.Limits.ConcurrentJobs < 0 || tenant.Limits.JobsPerHour < 0 ||
+			tenant.Limits.VideoMinutesPerDay < 0 || tenant.Limits.TTSCharactersPerMonth < 0 {
+			return nil, fmt.Errorf("tenant %s: limits must not be negative", tenant.ID)
+		}
+		tenant.InputRoot = filepath.Clean(tenant.InputRoot)
+		tenant.OutputRoot = filepath.Clean(tenant.OutputRoot)
+		t.byID[tenant.ID] = tenant
+	}
+	return t, nil
+}
+
+// Get returns the tenant with the given id. Jobs recorded without a tenant id belong to the default tenant.
+func (t *Tenants) Get(id string) (Tenant, bool) {
+	if id == "" {
+		id = DefaultTenantID
+	}
+	tenant, ok := t.byID[id]
+	return tenant, ok
+}
+
+// Authenticate returns the tenant owning the API key
+func (t *Tenants) Authenticate(apiKey string) (Tenant, bool) {
+	if apiKey == "" {
+		return Tenant{}, false
+	}
+	id, ok := t.byKey[sha256.Sum256([]byte(apiKey))]
+	if !ok {
+		return Tenant{}, false
+	}
+	return t.byID[id], true
+}
+
+// List returns every tenant, ordered by id
+func (t *Tenants) List() []Tenant {
+	list := make([]Tenant, 0, len(t.byID))
+	for _, tenant := range t.byID {
+		list = append(list, tenant)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -0,0 +1,464 @@
+// Package config holds the settings of the service. They are loaded once at startup from a YAML file,
+// the environment and command line flags, each overriding the previous one, validated, and then
+// handed to the packages that need them; nothing else reads the environment.
+//
+// Every setting has a key in the YAML file and most have an environment variable and a flag, given
+// by the yaml, env and flag tags of its field. The env and flag tags of a nested section are
+// prefixes of the ones of its fields, e.g. RETRY_TTS + MAX_ATTEMPTS and -retry.tts.max-attempts.
+// Secrets have no flag, so they do not show up in the process list.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/logging"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/storage"
+	"videoUploadAndProcessing/pkg/tracing"
+	"videoUploadAndProcessing/pkg/upload"
+	"videoUploadAndProcessing/pkg/webhook"
+)
+
+// Config is the whole configuration of the service
+type Config struct {
+	Port    string `yaml:"port" env:"VIDEO_PROCESSING_PORT" flag:"port" help:"port the HTTP server listens on"`
+	TempDir string `yaml:"temp_dir" env:"TEMP_DIR" flag:"temp-dir" help:"directory of the intermediate files of the jobs"`
+
+	Log        Log        `yaml:"log" flag:"log"`
+	Tracing    Tracing    `yaml:"tracing" flag:"tracing"`
+	Tenants    Tenants    `yaml:"tenants" flag:"tenants"`
+	Processing Processing `yaml:"processing" flag:"processing"`
+	Uploads    Uploads    `yaml:"uploads" flag:"uploads"`
+	Storage    Storage    `yaml:"storage" flag:"storage"`
+	Webhooks   Webhooks   `yaml:"webhooks" flag:"webhooks"`
+	Retry      Retry      `yaml:"retry" env:"RETRY" flag:"retry"`
+	Health     Health     `yaml:"health" flag:"health"`
+	Watch      Watch      `yaml:"watch" env:"WATCH" flag:"watch"`
+}
+
+type Log struct {
+	Path       string `yaml:"path" env:"VIDEO_PROCESSING_LOG_PATH" flag:"path" help:"file the JSON log records are written to"`
+	Level      string `yaml:"level" env:"LOG_LEVEL" flag:"level" help:"debug, info, warn or error"`
+	MaxSizeMB  int    `yaml:"max_size_mb" env:"LOG_MAX_SIZE_MB" flag:"max-size-mb" help:"size at which the log file is rotated"`
+	MaxBackups int    `yaml:"max_backups" env:"LOG_MAX_BACKUPS" flag:"max-backups" help:"number of rotated log files kept"`
+}
+
+type Tracing struct {
+	OTLPEndpoint       string `yaml:"otlp_endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" flag:"otlp-endpoint" help:"OpenTelemetry collector, /v1/traces is appended"`
+	OTLPTracesEndpoint string `yaml:"otlp_traces_endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" flag:"otlp-traces-endpoint" help:"full URL of the collector's traces receiver"`
+	OTLPHeaders        string `yaml:"otlp_headers" env:"OTEL_EXPORTER_OTLP_HEADERS"` // name1=value1,name2=value2, may hold credentials
+	File               string `yaml:"file" env:"TRACES_FILE" flag:"file" help:"file the spans are appended to"`
+	ServiceName        string `yaml:"service_name" env:"OTEL_SERVICE_NAME" flag:"service-name" help:"service name of the spans"`
+}
+
+// Tenants are read from a tenants file, or else the single tenant of the deployment is built from Default
+type Tenants struct {
+	File    string `yaml:"file" env:"TENANTS_FILE" flag:"file" help:"JSON file listing the tenants"`
+	Default Tenant `yaml:"default"`
+}
+
+// Tenant is the single tenant of a deployment without a tenants file. It is an admin.
+type Tenant struct {
+	APIKeys         []string `yaml:"api_keys" env:"API_KEYS"`
+	InputRoot       string   `yaml:"input_root" env:"UNPROCESSED_VIDEO_PATH" flag:"input-root" help:"directory the submitted videos must be under"`
+	OutputRoot      string   `yaml:"output_root" env:"PROCESSED_VIDEO_PATH" flag:"output-root" help:"directory the processed videos are written to"`
+	UploadRoot      string   `yaml:"upload_root" env:"UPLOADED_VIDEO_PATH" flag:"upload-root" help:"directory the uploaded videos are stored in"`
+	S3InputPrefixes []string `yaml:"s3_input_prefixes" env:"S3_INPUT_PREFIXES" flag:"s3-input-prefixes" help:"comma separated s3://bucket/prefix locations the s3:// inputs must be under, the whole input buckets when empty"`
+	WhisperAPIKey   string   `yaml:"whisper_api_key" env:"WHISPER_API_KEY"`
+	AcapelaEmail    string   `yaml:"acapela_email" env:"ACAPELA_EMAIL" flag:"acapela-email" help:"Acapela account"`
+	AcapelaPassword string   `yaml:"acapela_password" env:"ACAPELA_PASSWORD"`
+	Limits          Limits   `yaml:"limits" env:"QUOTA" flag:"quota"`
+}
+
+// Limits are the quotas of the single tenant, 0 means unlimited
+type Limits struct {
+	ConcurrentJobs        int     `yaml:"concurrent_jobs" env:"CONCURRENT_JOBS" flag:"concurrent-jobs" help:"jobs processed at the same time"`
+	JobsPerHour           int     `yaml:"jobs_per_hour" env:"JOBS_PER_HOUR" flag:"jobs-per-hour" help:"jobs submitted in any 60 minute window"`
+	VideoMinutesPerDay    float64 `yaml:"video_minutes_per_day" env:"VIDEO_MINUTES_PER_DAY" flag:"video-minutes-per-day" help:"minutes of video submitted per UTC day"`
+	TTSCharactersPerMonth int     `yaml:"tts_characters_per_month" env:"TTS_CHARACTERS_PER_MONTH" flag:"tts-characters-per-month" help:"characters sent to Acapela per UTC month"`
+}
+
+type Processing struct {
+	Workers             int           `yaml:"workers" env:"NUM_WORKERS" flag:"workers" help:"jobs processed at the same time"`
+	Voice               string        `yaml:"voice" env:"ACAPELA_VOICE" flag:"voice" help:"Acapela voice the segments are dubbed with"`
+	JobTimeout          time.Duration `yaml:"job_timeout" env:"JOB_TIMEOUT" flag:"job-timeout" help:"deadline of a single job"`
+	QueueCapacity       int           `yaml:"queue_capacity" env:"JOB_QUEUE_CAPACITY" flag:"queue-capacity" help:"jobs waiting for a worker before submissions are rejected"`
+	MaxJobsPerClient    int           `yaml:"max_jobs_per_client" env:"MAX_JOBS_PER_CLIENT" flag:"max-jobs-per-client" help:"unfinished jobs of a client, 0 for no limit"`
+	Deduplicate         bool          `yaml:"deduplicate" env:"DEDUPLICATE_UPLOADS" flag:"deduplicate" help:"return the existing job for videos submitted again"`
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period" env:"SHUTDOWN_GRACE_PERIOD" flag:"shutdown-grace-period" help:"time running jobs have to finish on shutdown"`
+}
+
+type Uploads struct {
+	MaxSize         int64         `yaml:"max_size" env:"MAX_UPLOAD_SIZE" flag:"max-size" help:"size limit of uploaded videos in bytes"`
+	ResumableExpiry time.Duration `yaml:"resumable_expiry" env:"RESUMABLE_UPLOAD_EXPIRY" flag:"resumable-expiry" help:"time an unfinished resumable upload is kept"`
+}
+
+type Storage struct {
+	JobStorePath string   `yaml:"job_store_path" env:"JOB_STORE_PATH" flag:"job-store-path" help:"append-only log of the jobs, to resume them after a restart"`
+	Output       string   `yaml:"output" env:"OUTPUT_STORAGE" flag:"output" help:"s3://bucket/prefix the processed videos are uploaded to, empty to keep them in the output root of their tenant"`
+	InputBuckets []string `yaml:"input_buckets" env:"S3_INPUT_BUCKETS" flag:"input-buckets" help:"comma separated buckets s3:// inputs may be read from"`
+	S3           S3       `yaml:"s3" env:"S3" flag:"s3"`
+}
+
+// S3 configures the client of the S3-compatible object store, such as AWS S3 or MinIO
+type S3 struct {
+	Endpoint        string `yaml:"endpoint" env:"ENDPOINT" flag:"endpoint" help:"URL of the object store, AWS S3 in the region when empty"`
+	Region          string `yaml:"region" env:"REGION" flag:"region" help:"region the requests are signed for"`
+	AccessKeyID     string `yaml:"access_key_id" env:"ACCESS_KEY_ID" flag:"access-key-id" help:"access key of the object store"`
+	SecretAccessKey string `yaml:"secret_access_key" env:"SECRET_ACCESS_KEY"`
+	PathStyle       bool   `yaml:"path_style" env:"PATH_STYLE" flag:"path-style" help:"put the bucket in the path of the URLs instead of the host name, as MinIO expects"`
+}
+
+type Webhooks struct {
+	Secret               string      `yaml:"secret" env:"WEBHOOK_SECRET"`
+	LogPath              string      `yaml:"log_path" env:"WEBHOOK_LOG_PATH" flag:"log-path" help:"append-only log of the callback deliveries"`
+	AllowedSchemes       []string    `yaml:"allowed_schemes" env:"CALLBACK_ALLOWED_SCHEMES" flag:"allowed-schemes" help:"comma separated URL schemes callbacks may use"`
+	AllowedHosts         []string    `yaml:"allowed_hosts" env:"CALLBACK_ALLOWED_HOSTS" flag:"allowed-hosts" help:"comma separated hosts callbacks may be sent to, empty for any"`
+	AllowPrivateNetworks bool        `yaml:"allow_private_networks" env:"CALLBACK_ALLOW_PRIVATE_NETWORKS" flag:"allow-private-networks" help:"allow callbacks to loopback and private addresses"`
+	Retry                RetryPolicy `yaml:"retry" env:"RETRY_WEBHOOK" flag:"retry"`
+}
+
+// Retry holds the retry policy of every pipeline stage, see the RetryStage constants of the upload package
+type Retry struct {
+	Extract      RetryPolicy `yaml:"extract" env:"EXTRACT" flag:"extract"`
+	Transcribe   RetryPolicy `yaml:"transcribe" env:"TRANSCRIBE" flag:"transcribe"`
+	Split        RetryPolicy `yaml:"split" env:"SPLIT" flag:"split"`
+	TTS          RetryPolicy `yaml:"tts" env:"TTS" flag:"tts"`
+	SegmentMerge RetryPolicy `yaml:"segment_merge" env:"SEGMENT_MERGE" flag:"segment-merge"`
+	Concat       RetryPolicy `yaml:"concat" env:"CONCAT" flag:"concat"`
+	Transfer     RetryPolicy `yaml:"transfer" env:"TRANSFER" flag:"transfer"`
+	Job          RetryPolicy `yaml:"job" env:"JOB" flag:"job"`
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"max_attempts" env:"MAX_ATTEMPTS" flag:"max-attempts" help:"total number of attempts, 1 disables retries"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env:"INITIAL_BACKOFF" flag:"initial-backoff" help:"wait before the first retry"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" env:"MAX_BACKOFF" flag:"max-backoff" help:"upper bound of the wait between attempts"`
+	Multiplier     float64       `yaml:"multiplier"`
+	Jitter         float64       `yaml:"jitter"`
+}
+
+type Health struct {
+	MinFreeDiskMB uint64 `yaml:"min_free_disk_mb" env:"READY_MIN_FREE_DISK_MB" flag:"min-free-disk-mb" help:"free space under temp_dir needed to be ready"`
+}
+
+// Watch configures the watch-folder mode, which submits the videos dropped into the input root of a tenant
+type Watch struct {
+	Enabled      bool          `yaml:"enabled" env:"ENABLED" flag:"enabled" help:"submit the videos dropped into the input root of watch.tenant"`
+	Tenant       string        `yaml:"tenant" env:"TENANT" flag:"tenant" help:"tenant whose input root is watched"`
+	Pattern      string        `yaml:"pattern" env:"PATTERN" flag:"pattern" help:"file name pattern of the watched videos"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"POLL_INTERVAL" flag:"poll-interval" help:"time between two scans of the folder"`
+	StableFor    time.Duration `yaml:"stable_for" env:"STABLE_FOR" flag:"stable-for" help:"time a video must stay unchanged before it is submitted"`
+}
+
+// Default returns the configuration used for everything the file, the environment and the flags leave out
+func Default() Config {
+	policies := upload.DefaultRetryPolicies()
+	return Config{
+		TempDir: upload.DefaultTempDir,
+		Log: Log{
+			Level:      "info",
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
+		Tracing: Tracing{
+			ServiceName: "video-processing",
+		},
+		Processing: Processing{
+			Workers:             upload.DefaultNumWorkers,
+			Voice:               upload.DefaultVoice,
+			JobTimeout:          upload.DefaultJobTimeout,
+			QueueCapacity:       upload.DefaultQueueCapacity,
+			ShutdownGracePeriod: upload.DefaultShutdownGracePeriod,
+		},
+		Uploads: Uploads{
+			MaxSize:         upload.DefaultMaxUploadSize,
+			ResumableExpiry: upload.DefaultResumableUploadExpiry,
+		},
+		Storage: Storage{
+			JobStorePath: "data/jobs.log",
+			S3: S3{
+				Region: "us-east-1",
+			},
+		},
+		Webhooks: Webhooks{
+			LogPath:        "data/webhooks.log",
+			AllowedSchemes: []string{"http", "https"},
+			Retry:          newRetryPolicy(webhook.DefaultPolicy),
+		},
+		Retry: Retry{
+			Extract:      newRetryPolicy(policies[upload.RetryStageExtract]),
+			Transcribe:   newRetryPolicy(policies[upload.RetryStageTranscribe]),
+			Split:        newRetryPolicy(policies[upload.RetryStageSplit]),
+			TTS:          newRetryPolicy(policies[upload.RetryStageTTS]),
+			SegmentMerge: newRetryPolicy(policies[upload.RetryStageSegmentMerge]),
+			Concat:       newRetryPolicy(policies[upload.RetryStageConcat]),
+			Transfer:     newRetryPolicy(policies[upload.RetryStageTransfer]),
+			Job:          newRetryPolicy(policies[upload.RetryStageJob]),
+		},
+		Health: Health{
+			MinFreeDiskMB: upload.DefaultMinFreeDiskSpace >> 20,
+		},
+		Watch: Watch{
+			Tenant:       auth.DefaultTenantID,
+			Pattern:      upload.DefaultWatchPattern,
+			PollInterval: upload.DefaultWatchPollInterval,
+			StableFor:    upload.DefaultWatchStableFor,
+		},
+	}
+}
+
+// Validate checks every setting and returns all the problems found, one per line
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port (VIDEO_PROCESSING_PORT) %q must be a number between 1 and 65535", c.Port)
+	check(c.TempDir != "", "temp_dir (TEMP_DIR) must be set")
+
+	check(c.Log.Path != "", "log.path (VIDEO_PROCESSING_LOG_PATH) must be set")
+	if _, err := c.LogLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("log.level (LOG_LEVEL): %v", err))
+	}
+	check(c.Log.MaxSizeMB > 0, "log.max_size_mb (LOG_MAX_SIZE_MB) must be positive")
+	check(c.Log.MaxBackups >= 0, "log.max_backups (LOG_MAX_BACKUPS) must not be negative")
+
+	for name, endpoint := range map[string]string{
+		"tracing.otlp_endpoint (OTEL_EXPORTER_OTLP_ENDPOINT)":               c.Tracing.OTLPEndpoint,
+		"tracing.otlp_traces_endpoint (OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)": c.Tracing.OTLPTracesEndpoint,
+	} {
+		if endpoint != "" {
+			u, err := url.Parse(endpoint)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "%s %q must be an http or https URL", name, endpoint)
+		}
+	}
+	if _, err := tracing.ParseHeaders(c.Tracing.OTLPHeaders); err != nil {
+		errs = append(errs, fmt.Errorf("tracing.otlp_headers (OTEL_EXPORTER_OTLP_HEADERS): %v", err))
+	}
+	check(c.Tracing.ServiceName != "", "tracing.service_name (OTEL_SERVICE_NAME) must be set")
+
+	tenants, err := c.LoadTenants()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid tenant configuration (set tenants.file / TENANTS_FILE, or API_KEYS for a single tenant): %v", err))
+	}
+
+	check(c.Processing.Workers > 0, "processing.workers (NUM_WORKERS) must be positive")
+	check(c.Processing.Voice != "", "processing.voice (ACAPELA_VOICE) must be set")
+	check(c.Processing.JobTimeout > 0, "processing.job_timeout (JOB_TIMEOUT) must be positive")
+	check(c.Processing.QueueCapacity > 0, "processing.queue_capacity (JOB_QUEUE_CAPACITY) must be positive")
+	check(c.Processing.MaxJobsPerClient >= 0, "processing.max_jobs_per_client (MAX_JOBS_PER_CLIENT) must not be negative")
+	check(c.Processing.ShutdownGracePeriod >= 0, "processing.shutdown_grace_period (SHUTDOWN_GRACE_PERIOD) must not be negative")
+
+	check(c.Uploads.MaxSize > 0, "uploads.max_size (MAX_UPLOAD_SIZE) must be positive")
+	check(c.Uploads.ResumableExpiry > 0, "uploads.resumable_expiry (RESUMABLE_UPLOAD_EXPIRY) must be positive")
+
+	check(c.Storage.JobStorePath != "", "storage.job_store_path (JOB_STORE_PATH) must be set")
+	if _, err := c.ObjectStorage(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid storage configuration (storage.output / OUTPUT_STORAGE, storage.input_buckets / S3_INPUT_BUCKETS, storage.s3 / S3_*): %v", err))
+	}
+	check(c.Webhooks.LogPath != "", "webhooks.log_path (WEBHOOK_LOG_PATH) must be set")
+	if _, err := c.CallbackGuard(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid callback URL allowlist (CALLBACK_ALLOWED_SCHEMES, CALLBACK_ALLOWED_HOSTS): %v", err))
+	}
+
+	if c.Watch.Enabled {
+		if tenants != nil {
+			_, ok := tenants.Get(c.Watch.Tenant)
+			check(ok, "watch.tenant (WATCH_TENANT) %q is not a configured tenant", c.Watch.Tenant)
+		}
+		_, err := filepath.Match(c.Watch.Pattern, "")
+		check(c.Watch.Pattern != "" && err == nil, "watch.pattern (WATCH_PATTERN) %q must be a valid file name pattern", c.Watch.Pattern)
+		check(c.Watch.PollInterval > 0, "watch.poll_interval (WATCH_POLL_INTERVAL) must be positive")
+		check(c.Watch.StableFor >= 0, "watch.stable_for (WATCH_STABLE_FOR) must not be negative")
+	}
+
+	errs = append(errs, c.Webhooks.Retry.validate("webhooks.retry", "RETRY_WEBHOOK")...)
+	for _, stage := range c.Retry.stages() {
+		errs = append(errs, stage.policy.validate("retry."+stage.name, "RETRY_"+stage.env)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidatePipeline checks the settings used to run the pipeline on a local video without the server:
+// the temp dir, the voice, the job timeout, the retry policies and the credentials of the default tenant
+func (c Config) ValidatePipeline() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.TempDir != "", "temp_dir (TEMP_DIR) must be set")
+	check(c.Processing.Voice != "", "processing.voice (ACAPELA_VOICE) must be set")
+	check(c.Processing.JobTimeout > 0, "processing.job_timeout (JOB_TIMEOUT) must be positive")
+
+	tenant := c.Tenants.Default
+	check(tenant.WhisperAPIKey != "", "tenants.default.whisper_api_key (WHISPER_API_KEY) must be set")
+	check(tenant.AcapelaEmail != "", "tenants.default.acapela_email (ACAPELA_EMAIL) must be set")
+	check(tenant.AcapelaPassword != "", "tenants.default.acapela_password (ACAPELA_PASSWORD) must be set")
+
+	for _, stage := range c.Retry.stages() {
+		errs = append(errs, stage.policy.validate("retry."+stage.name, "RETRY_"+stage.env)...)
+	}
+	return errors.Join(errs...)
+}
+
+// LogLevel returns the minimum level of the log records that are written
+func (c Config) LogLevel() (slog.Level, error) {
+	return logging.ParseLevel(c.Log.Level)
+}
+
+// LoadTenants returns the tenants of the tenants file, or the single default tenant without one
+func (c Config) LoadTenants() (*auth.Tenants, error) {
+	if c.Tenants.File != "" {
+		return auth.LoadTenants(c.Tenants.File)
+	}
+	tenant := c.Tenants.Default.tenant()
+	if len(tenant.S3InputPrefixes) == 0 {
+		// The single tenant may read the whole input buckets, there is no other tenant to keep apart
+		for _, bucket := range c.Storage.InputBuckets {
+			tenant.S3InputPrefixes = append(tenant.S3InputPrefixes, "s3://"+bucket)
+		}
+	}
+	return auth.NewTenants([]auth.Tenant{tenant})
+}
+
+func (t Tenant) tenant() auth.Tenant {
+	return auth.Tenant{
+		ID:              auth.DefaultTenantID,
+		APIKeys:         t.APIKeys,
+		Admin:           true,
+		InputRoot:       t.InputRoot,
+		OutputRoot:      t.OutputRoot,
+		UploadRoot:      t.UploadRoot,
+		S3InputPrefixes: t.S3InputPrefixes,
+		WhisperAPIKey:   t.WhisperAPIKey,
+		AcapelaEmail:    t.AcapelaEmail,
+		AcapelaPassword: t.AcapelaPassword,
+		Limits: auth.Limits{
+			ConcurrentJobs:        t.Limits.ConcurrentJobs,
+			JobsPerHour:           t.Limits.JobsPerHour,
+			VideoMinutesPerDay:    t.Limits.VideoMinutesPerDay,
+			TTSCharactersPerMonth: t.Limits.TTSCharactersPerMonth,
+		},
+	}
+}
+
+// TracesEndpoint returns the URL the spans are posted to, or "" when they are not sent to a collector
+func (c Config) TracesEndpoint() string {
+	if c.Tracing.OTLPTracesEndpoint != "" {
+		return c.Tracing.OTLPTracesEndpoint
+	}
+	if c.Tracing.OTLPEndpoint != "" {
+		return strings.TrimSuffix(c.Tracing.OTLPEndpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// CallbackGuard returns the allowlist the callback URLs are checked against
+func (c Config) CallbackGuard() (*webhook.URLGuard, error) {
+	return webhook.NewURLGuard(c.Webhooks.AllowedSchemes, c.Webhooks.AllowedHosts, c.Webhooks.AllowPrivateNetworks)
+}
+
+// ObjectStorage returns where the s3:// inputs are read from and the outputs are kept. The object
+// store is only used when an output bucket or input buckets are configured.
+func (c Config) ObjectStorage() (*storage.Storage, error) {
+	var s3 *storage.S3
+	if c.Storage.Output != "" || len(c.Storage.InputBuckets) > 0 {
+		var err error
+		s3, err = storage.NewS3(storage.S3Config{
+			Endpoint:        c.Storage.S3.Endpoint,
+			Region:          c.Storage.S3.Region,
+			AccessKeyID:     c.Storage.S3.AccessKeyID,
+			SecretAccessKey: c.Storage.S3.SecretAccessKey,
+			PathStyle:       c.Storage.S3.PathStyle,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return storage.New(s3, c.Storage.InputBuckets, c.Storage.Output)
+}
+
+// RetryPolicies returns the retry policy of every pipeline stage
+func (c Config) RetryPolicies() retry.Policies {
+	policies := make(retry.Policies)
+	for _, stage := range c.Retry.stages() {
+		policies[stage.name] = stage.policy.Policy()
+	}
+	return policies
+}
+
+type retryStage struct {
+	name   string // stage name in the upload package and key in the YAML file
+	env    string
+	policy RetryPolicy
+}
+
+func (r Retry) stages() []retryStage {
+	return []retryStage{
+		{upload.RetryStageExtract, "EXTRACT", r.Extract},
+		{upload.RetryStageTranscribe, "TRANSCRIBE", r.Transcribe},
+		{upload.RetryStageSplit, "SPLIT", r.Split},
+		{upload.RetryStageTTS, "TTS", r.TTS},
+		{upload.RetryStageSegmentMerge, "SEGMENT_MERGE", r.SegmentMerge},
+		{upload.RetryStageConcat, "CONCAT", r.Concat},
+		{upload.RetryStageTransfer, "TRANSFER", r.Transfer},
+		{upload.RetryStageJob, "JOB", r.Job},
+	}
+}
+
+func newRetryPolicy(p retry.Policy) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    p.MaxAttempts,
+		InitialBackoff: p.InitialBackoff,
+		MaxBackoff:     p.MaxBackoff,
+		Multiplier:     p.Multiplier,
+		Jitter:         p.Jitter,
+	}
+}
+
+// Policy returns the policy the retry package works with
+func (p RetryPolicy) Policy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    p.MaxAttempts,
+		InitialBackoff: p.InitialBackoff,
+		MaxBackoff:     p.MaxBackoff,
+		Multiplier:     p.Multiplier,
+		Jitter:         p.Jitter,
+	}
+}
+
+func (p RetryPolicy) validate(key string, env string) []error {
+	var errs []error
+	if p.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("%s.max_attempts (%s_MAX_ATTEMPTS) must be positive", key, env))
+	}
+	if p.InitialBackoff < 0 {
+		errs = append(errs, fmt.Errorf("%s.initial_backoff (%s_INITIAL_BACKOFF) must not be negative", key, env))
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		errs = append(errs, fmt.Errorf("%s.max_backoff (%s_MAX_BACKOFF) must not be less than the initial backoff", key, env))
+	}
+	if p.Multiplier < 1 {
+		errs = append(errs, fmt.Errorf("%s.multiplier must be at least 1", key))
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("%s.jitter must be between 0 and 1", key))
+	}
+	return errs
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// validConfig returns the defaults completed with the settings that have none
+func validConfig() Config {
+	cfg := Default()
+	cfg.Port = "8080"
+	cfg.Log.Path = "logs/service.log"
+	cfg.Tenants.Default = Tenant{
+		APIKeys:    []string{"0123456789abcdef"},
+		InputRoot:  "videos/in",
+		OutputRoot: "videos/out",
+	}
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("valid configuration rejected: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string
+	}{
+		{"port not a number", func(c *Config) { c.Port = "http" }, "port (VIDEO_PROCESSING_PORT)"},
+		{"port out of range", func(c *Config) { c.Port = "70000" }, "port (VIDEO_PROCESSING_PORT)"},
+		{"no temp dir", func(c *Config) { c.TempDir = "" }, "temp_dir (TEMP_DIR) must be set"},
+		{"invalid log level", func(c *Config) { c.Log.Level = "loud" }, "log.level (LOG_LEVEL)"},
+		{"invalid otlp endpoint", func(c *Config) { c.Tracing.OTLPEndpoint = "collector:4318" }, "tracing.otlp_endpoint"},
+		{"no api key", func(c *Config) { c.Tenants.Default.APIKeys = nil }, "has no API key"},
+		{"short api key", func(c *Config) { c.Tenants.Default.APIKeys = []string{"short"} }, "at least 16 characters"},
+		{"no output root", func(c *Config) { c.Tenants.Default.OutputRoot = "" }, "input_root and output_root are required"},
+		{"negative quota", func(c *Config) { c.Tenants.Default.Limits.JobsPerHour = -1 }, "limits must not be negative"},
+		{"no workers", func(c *Config) { c.Processing.Workers = 0 }, "processing.workers (NUM_WORKERS)"},
+		{"no job timeout", func(c *Config) { c.Processing.JobTimeout = 0 }, "processing.job_timeout (JOB_TIMEOUT)"},
+		{"negative client limit", func(c *Config) { c.Processing.MaxJobsPerClient = -1 }, "processing.max_jobs_per_client"},
+		{"output bucket without credentials", func(c *Config) { c.Storage.Output = "s3://videos/dubbed" }, "invalid storage configuration"},
+		{"callback schemes", func(c *Config) { c.Webhooks.AllowedSchemes = nil }, "invalid callback URL allowlist"},
+		{"watch unknown tenant", func(c *Config) { c.Watch.Enabled, c.Watch.Tenant = true, "nobody" }, `watch.tenant (WATCH_TENANT) "nobody"`},
+		{"watch invalid pattern", func(c *Config) { c.Watch.Enabled, c.Watch.Pattern = true, "[" }, "watch.pattern (WATCH_PATTERN)"},
+		{"retry attempts", func(c *Config) { c.Retry.TTS.MaxAttempts = 0 }, "retry.tts"},
+		{"webhook retry attempts", func(c *Config) { c.Webhooks.Retry.MaxAttempts = 0 }, "webhooks.retry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := validConfig()
+	cfg.Port = ""
+	cfg.Processing.Workers = 0
+	cfg.Uploads.MaxSize = 0
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	for _, want := range []string{"port", "processing.workers", "uploads.max_size"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v, want it to report %s", err, want)
+		}
+	}
+}
+
+func TestValidatePipeline(t *testing.T) {
+	// The server settings are not needed to run the pipeline on a local video
+	cfg := Default()
+	cfg.Tenants.Default = Tenant{WhisperAPIKey: "sk-test", AcapelaEmail: "dub@example.com", AcapelaPassword: "secret"}
+	if err := cfg.ValidatePipeline(); err != nil {
+		t.Fatalf("valid pipeline configuration rejected: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string
+	}{
+		{"no temp dir", func(c *Config) { c.TempDir = "" }, "temp_dir (TEMP_DIR)"},
+		{"no voice", func(c *Config) { c.Processing.Voice = "" }, "processing.voice (ACAPELA_VOICE)"},
+		{"no whisper key", func(c *Config) { c.Tenants.Default.WhisperAPIKey = "" }, "(WHISPER_API_KEY) must be set"},
+		{"no acapela email", func(c *Config) { c.Tenants.Default.AcapelaEmail = "" }, "(ACAPELA_EMAIL) must be set"},
+		{"no acapela password", func(c *Config) { c.Tenants.Default.AcapelaPassword = "" }, "(ACAPELA_PASSWORD) must be set"},
+		{"retry attempts", func(c *Config) { c.Retry.Transcribe.MaxAttempts = 0 }, "retry.transcribe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := cfg
+			tt.change(&changed)
+			err := changed.ValidatePipeline()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidatePipeline = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadTenantsS3InputPrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		buckets  []string
+		prefixes []string
+		want     []string
+	}{
+		{"whole input buckets by default", []string{"videos", "shared"}, nil, []string{"s3://videos", "s3://shared"}},
+		{"configured prefixes", []string{"videos"}, []string{"s3://videos/acme"}, []string{"s3://videos/acme"}},
+		{"no input buckets", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Storage.InputBuckets = tt.buckets
+			cfg.Tenants.Default.S3InputPrefixes = tt.prefixes
+
+			tenants, err := cfg.LoadTenants()
+			if err != nil {
+				t.Fatalf("LoadTenants: %v", err)
+			}
+			tenant, _ := tenants.Get("")
+			if strings.Join(tenant.S3InputPrefixes, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("S3 input prefixes = %v, want %v", tenant.S3InputPrefixes, tt.want)
+			}
+		})
+	}
+}
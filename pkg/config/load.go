@@ -0,0 +1,209 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the YAML file to load when the -config flag is not given
+const FileEnv = "CONFIG_FILE"
+
+// Load builds the configuration from the defaults, the YAML file given with -config or CONFIG_FILE,
+// the environment and the flags in args, in that order of precedence, and validates it.
+// flag.ErrHelp is returned when args ask for the usage, which is then written to output.
+func Load(name string, args []string, output io.Writer) (Config, error) {
+	return load(name, args, output, Config.Validate)
+}
+
+// LoadPipeline builds the configuration like Load, but only validates what running the pipeline on a
+// local video needs, see ValidatePipeline. It is meant for the tools running the pipeline without the server.
+func LoadPipeline(name string, args []string, output io.Writer) (Config, error) {
+	return load(name, args, output, Config.ValidatePipeline)
+}
+
+func load(name string, args []string, output io.Writer, validate func(Config) error) (Config, error) {
+	cfg := Default()
+	settings := collectSettings(&cfg)
+
+	// The flags are parsed first to find the file, but only applied once the file and the environment are
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	configFile := flags.String("config", os.Getenv(FileEnv), "YAML configuration file")
+	var flagValues []settingValue
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		s := s
+		record := func(v string) error {
+			// Values are checked now so the error names the flag, and set once the environment is applied
+			if err := setValue(reflect.New(s.value.Type()).Elem(), v); err != nil {
+				return err
+			}
+			flagValues = append(flagValues, settingValue{s, v})
+			return nil
+		}
+		if s.value.Kind() == reflect.Bool {
+			flags.BoolFunc(s.flag, s.help, record)
+		} else {
+			flags.Func(s.flag, s.help, record)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	if *configFile != "" {
+		if err := loadFile(*configFile, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		if s.env == "" {
+			continue
+		}
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := setValue(s.value, v); err != nil {
+				return Config{}, fmt.Errorf("invalid %s %q: %v", s.env, v, err)
+			}
+		}
+	}
+
+	for _, fv := range flagValues {
+		setValue(fv.setting.value, fv.value)
+	}
+
+	if err := validate(cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile decodes the YAML file into cfg, keeping the values of the keys it leaves out.
+// Unknown keys are rejected so a typo does not silently fall back to a default.
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %v", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	return nil
+}
+
+// setting is a single value of the configuration with its environment variable and flag names
+type setting struct {
+	value reflect.Value
+	env   string
+	flag  string
+	help  string
+}
+
+type settingValue struct {
+	setting setting
+	value   string
+}
+
+// collectSettings lists the fields of cfg that hold a value, joining the env and flag prefixes of
+// the sections they are in
+func collectSettings(cfg *Config) []setting {
+	var settings []setting
+	var walk func(v reflect.Value, envPrefix string, flagPrefix string)
+	walk = func(v reflect.Value, envPrefix string, flagPrefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			env := joinName(envPrefix, field.Tag.Get("env"), "_")
+			flagName := joinName(flagPrefix, field.Tag.Get("flag"), ".")
+			if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+				walk(v.Field(i), env, flagName)
+				continue
+			}
+			s := setting{value: v.Field(i), help: field.Tag.Get("help")}
+			if field.Tag.Get("env") != "" {
+				s.env = env
+			}
+			if field.Tag.Get("flag") != "" {
+				s.flag = flagName
+			}
+			settings = append(settings, s)
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "", "")
+	return settings
+}
+
+func joinName(prefix string, name string, separator string) string {
+	if prefix == "" || name == "" {
+		return prefix + name
+	}
+	return prefix + separator + name
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setValue parses s into the value, according to its type. Lists are comma separated.
+func setValue(value reflect.Value, s string) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case value.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+	case value.Kind() == reflect.String:
+		value.SetString(s)
+	case value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		value.SetBool(b)
+	case value.Kind() == reflect.Int || value.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		value.SetInt(n)
+	case value.Kind() == reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be a non-negative integer")
+		}
+		value.SetUint(n)
+	case value.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		value.SetFloat(f)
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
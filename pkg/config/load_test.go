@@ -0,0 +1,168 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// baseFile holds the settings every valid configuration needs
+const baseFile = `
+port: "8080"
+log:
+  path: logs/service.log
+tenants:
+  default:
+    api_keys: ["0123456789abcdef"]
+    input_root: videos/in
+    output_root: videos/out
+`
+
+// isolateEnv makes Load ignore the environment of the process running the tests
+func isolateEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv(FileEnv, "")
+	for _, s := range collectSettings(&Config{}) {
+		if s.env != "" {
+			t.Setenv(s.env, "")
+		}
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name           string
+		file           string
+		env            map[string]string
+		args           []string
+		wantWorkers    int
+		wantTimeout    time.Duration
+		wantTTSRetries int
+	}{
+		{
+			name:           "defaults",
+			wantWorkers:    Default().Processing.Workers,
+			wantTimeout:    Default().Processing.JobTimeout,
+			wantTTSRetries: Default().Retry.TTS.MaxAttempts,
+		},
+		{
+			name:           "file overrides defaults",
+			file:           "processing:\n  workers: 3\n  job_timeout: 10m\nretry:\n  tts:\n    max_attempts: 7\n",
+			wantWorkers:    3,
+			wantTimeout:    10 * time.Minute,
+			wantTTSRetries: 7,
+		},
+		{
+			name:           "env overrides file",
+			file:           "processing:\n  workers: 3\n  job_timeout: 10m\nretry:\n  tts:\n    max_attempts: 7\n",
+			env:            map[string]string{"NUM_WORKERS": "4", "RETRY_TTS_MAX_ATTEMPTS": "8"},
+			wantWorkers:    4,
+			wantTimeout:    10 * time.Minute,
+			wantTTSRetries: 8,
+		},
+		{
+			name:           "flags override env and file",
+			file:           "processing:\n  workers: 3\n  job_timeout: 10m\n",
+			env:            map[string]string{"NUM_WORKERS": "4", "JOB_TIMEOUT": "20m"},
+			args:           []string{"-processing.workers=5", "-retry.tts.max-attempts", "9"},
+			wantWorkers:    5,
+			wantTimeout:    20 * time.Minute,
+			wantTTSRetries: 9,
+		},
+		{
+			name:           "empty env values are ignored",
+			file:           "processing:\n  workers: 3\n",
+			env:            map[string]string{"NUM_WORKERS": ""},
+			wantWorkers:    3,
+			wantTimeout:    Default().Processing.JobTimeout,
+			wantTTSRetries: Default().Retry.TTS.MaxAttempts,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := append([]string{"-config", writeFile(t, baseFile+tt.file)}, tt.args...)
+
+			cfg, err := Load("test", args, io.Discard)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if cfg.Processing.Workers != tt.wantWorkers {
+				t.Errorf("workers = %d, want %d", cfg.Processing.Workers, tt.wantWorkers)
+			}
+			if cfg.Processing.JobTimeout != tt.wantTimeout {
+				t.Errorf("job timeout = %v, want %v", cfg.Processing.JobTimeout, tt.wantTimeout)
+			}
+			if cfg.Retry.TTS.MaxAttempts != tt.wantTTSRetries {
+				t.Errorf("TTS max attempts = %d, want %d", cfg.Retry.TTS.MaxAttempts, tt.wantTTSRetries)
+			}
+		})
+	}
+}
+
+func TestLoadFileFromEnv(t *testing.T) {
+	isolateEnv(t)
+	t.Setenv(FileEnv, writeFile(t, baseFile+"temp_dir: from-env\n"))
+
+	cfg, err := Load("test", nil, io.Discard)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.TempDir != "from-env" {
+		t.Errorf("temp dir = %q, want the one of the file named by %s", cfg.TempDir, FileEnv)
+	}
+
+	cfg, err = Load("test", []string{"-config", writeFile(t, baseFile+"temp_dir: from-flag\n")}, io.Discard)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.TempDir != "from-flag" {
+		t.Errorf("temp dir = %q, want the one of the file given with -config", cfg.TempDir)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"unknown key", "procesing:\n  workers: 3\n", nil, nil, "field procesing not found"},
+		{"invalid env value", "", map[string]string{"NUM_WORKERS": "many"}, nil, "NUM_WORKERS"},
+		{"invalid flag value", "", nil, []string{"-processing.job-timeout=soon"}, "processing.job-timeout"},
+		{"secrets have no flag", "", nil, []string{"-tenants.default.whisper-api-key=sk"}, "flag provided but not defined"},
+		{"unexpected argument", "", nil, []string{"video.mp4"}, `unexpected argument "video.mp4"`},
+		{"validation", "", map[string]string{"NUM_WORKERS": "0"}, nil, "processing.workers (NUM_WORKERS) must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := append([]string{"-config", writeFile(t, baseFile+tt.file)}, tt.args...)
+
+			_, err := Load("test", args, io.Discard)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
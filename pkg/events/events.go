@@ -0,0 +1,292 @@
+package events
+
+import (
+	"math"
+	"sync"
+	"time"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+// Event types
+const (
+	TypeState          = "state"           // the job moved to another stage
+	TypeSegment        = "segment"         // a segment was dubbed
+	TypeFFmpegProgress = "ffmpeg_progress" // a long running ffmpeg command made progress
+)
+
+// How many events of a job are kept for late subscribers
+const maxHistory = 1000
+
+// How long the events of a finished job stay available for replay
+const finishedRetention = time.Hour
+
+// Slow subscribers are dropped once this many events are waiting for them; they can
+// reconnect with the id of the last event they saw to replay what they missed
+const subscriberBuffer = 64
+
+// Event is a single progress update of a job
+type Event struct {
+	ID            int       `json:"id"` // sequence number within the job, starting at 1
+	JobID         string    `json:"job_id"`
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	State         string    `json:"state,omitempty"`          // state events
+	SegmentIndex  *int      `json:"segment_index,omitempty"`  // segment events
+	SegmentsDone  int       `json:"segments_done,omitempty"`  // segment events
+	SegmentsTotal int       `json:"segments_total,omitempty"` // segment events
+	Stage         string    `json:"stage,omitempty"`          // ffmpeg progress events: extract or concat
+	Percent       float64   `json:"percent,omitempty"`        // ffmpeg progress events
+}
+
+type stream struct {
+	events      []Event
+	nextID      int
+	finished    bool
+	subscribers map[chan Event]struct{}
+	lastPercent map[string]int // last whole percent published per ffmpeg stage
+	cleanup     *time.Timer    // removes the stream of the finished job once its retention is over
+}
+
+// Hub keeps the recent progress events of every job and fans them out to subscribers
+type Hub struct {
+	mu        sync.Mutex
+	streams   map[string]*stream
+	registry  *jobs.Registry // set by Watch, used to start the streams of jobs the hub has not seen
+	retention time.Duration  // how long the events of a finished job stay available
+}
+
+func NewHub() *Hub {
+	return &Hub{streams: make(map[string]*stream), retention: finishedRetention}
+}
+
+// Publish records the event for the job and sends it to its subscribers.
+// The id and time are assigned by the hub. It never blocks.
+func (h *Hub) Publish(jobID string, event Event) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.stream(jobID)
+	if s.finished {
+		return
+	}
+	h.publish(s, jobID, event)
+}
+
+// Finish publishes the terminal state of the job and ends the streams of its subscribers.
+// The events are kept for replay for a while.
+func (h *Hub) Finish(jobID string, state string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.stream(jobID)
+	if s.finished {
+		return
+	}
+	h.publish(s, jobID, Event{Type: TypeState, State: state})
+	s.finished = true
+	for ch := range s.subscribers {
+		close(ch)
+		delete(s.subscribers, ch)
+	}
+
+	var cleanup *time.Timer
+	cleanup = time.AfterFunc(h.retention, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		// Restart stops the timer, but it may already have fired; a stream reopened and finished
+		// again in the meantime has a timer of its own
+		if current, ok := h.streams[jobID]; ok && current == s && s.cleanup == cleanup {
+			delete(h.streams, jobID)
+		}
+	})
+	s.cleanup = cleanup
+}
+
+// Restart reopens the stream of a finished job that is run again (e.g. a retried job)
+func (h *Hub) Restart(jobID string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.streams[jobID]; ok {
+		s.finished = false
+		s.lastPercent = make(map[string]int)
+		if s.cleanup != nil {
+			s.cleanup.Stop()
+			s.cleanup = nil
+		}
+	}
+}
+
+// Subscribe returns the recorded events with an id greater than afterID, and a channel receiving
+// the events published from now on. The channel is closed when the job finishes or the subscriber
+// falls too far behind; cancel must be called once the subscriber is done.
+// Jobs the hub has not seen yet, such as jobs restored from the job store, start with their current
+// state; for jobs that already finished only that state is replayed and the channel is closed.
+// ok is false, with a closed channel, if the job is unknown.
+func (h *Hub) Subscribe(jobID string, afterID int) (replay []Event, live <-chan Event, cancel func(), ok bool) {
+	// The registry calls Watch's listener while it is locked, so it is read before h.mu is taken
+	var status jobs.Status
+	found := true
+	if h.registry != nil {
+		status, found = h.registry.Get(jobID)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, subscriberBuffer)
+	s, known := h.streams[jobID]
+	if !known {
+		if !found {
+			close(ch)
+			return nil, ch, func() {}, false
+		}
+		if status.State.Terminal() {
+			// Nothing is published for the job anymore, a stream would never be finished
+			close(ch)
+			final := Event{JobID: jobID, Type: TypeState, Time: status.UpdatedAt, State: string(status.State)}
+			return []Event{final}, ch, func() {}, true
+		}
+		s = h.stream(jobID)
+		if h.registry != nil {
+			h.publish(s, jobID, Event{Type: TypeState, State: string(status.State)})
+		}
+	}
+	for _, event := range s.events {
+		if event.ID > afterID {
+			replay = append(replay, event)
+		}
+	}
+
+	if s.finished {
+		close(ch)
+		return replay, ch, func() {}, true
+	}
+	s.subscribers[ch] = struct{}{}
+
+	cancel = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+	return replay, ch, cancel, true
+}
+
+// Watch publishes a state event for every state change of the registry's jobs,
+// and ends the streams of the jobs that finish. It must be called before Subscribe.
+func (h *Hub) Watch(registry *jobs.Registry) {
+	h.registry = registry
+	registry.OnStateChange(func(status jobs.Status) {
+		if status.State.Terminal() {
+			h.Finish(status.ID, string(status.State))
+			return
+		}
+		if status.State == jobs.StateQueued {
+			// A failed job that is retried gets its stream back
+			h.Restart(status.ID)
+		}
+		h.Publish(status.ID, Event{Type: TypeState, State: string(status.State)})
+	})
+}
+
+// Reporter returns the progress reporter of a job
+func (h *Hub) Reporter(jobID string) *Reporter {
+	if h == nil {
+		return nil
+	}
+	return &Reporter{hub: h, jobID: jobID}
+}
+
+// stream returns the stream of the job, creating it if needed. The caller must hold h.mu.
+func (h *Hub) stream(jobID string) *stream {
+	s, ok := h.streams[jobID]
+	if !ok {
+		s = &stream{
+			subscribers: make(map[chan Event]struct{}),
+			lastPercent: make(map[string]int),
+		}
+		h.streams[jobID] = s
+	}
+	return s
+}
+
+// publish stamps the event, records it and fans it out. The caller must hold h.mu.
+func (h *Hub) publish(s *stream, jobID string, event Event) {
+	s.nextID++
+	event.ID = s.nextID
+	event.JobID = jobID
+	event.Time = time.Now().UTC()
+
+	if event.Type == TypeState {
+		// A new stage starts its ffmpeg progress from zero
+		s.lastPercent = make(map[string]int)
+	}
+
+	s.events = append(s.events, event)
+	if len(s.events) > maxHistory {
+		s.events = s.events[len(s.events)-maxHistory:]
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+			close(ch)
+			delete(s.subscribers, ch)
+		}
+	}
+}
+
+// Reporter publishes the progress of a single job. A nil Reporter discards everything.
+type Reporter struct {
+	hub   *Hub
+	jobID string
+}
+
+// SegmentDubbed reports that the segment was dubbed, done out of total segments are finished
+func (r *Reporter) SegmentDubbed(segmentIndex int, done int, total int) {
+	if r == nil {
+		return
+	}
+	r.hub.Publish(r.jobID, Event{
+		Type:          TypeSegment,
+		SegmentIndex:  &segmentIndex,
+		SegmentsDone:  done,
+		SegmentsTotal: total,
+	})
+}
+
+// FFmpegProgress reports how far, in percent, the ffmpeg command of the stage is.
+// Only changes of at least one whole percent are published.
+func (r *Reporter) FFmpegProgress(stage string, percent float64) {
+	if r == nil {
+		return
+	}
+	percent = math.Max(0, math.Min(100, percent))
+
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
+	s := r.hub.stream(r.jobID)
+	whole := int(percent)
+	if last, ok := s.lastPercent[stage]; s.finished || (ok && whole <= last) {
+		return
+	}
+	s.lastPercent[stage] = whole
+	r.hub.publish(s, r.jobID, Event{Type: TypeFFmpegProgress, Stage: stage, Percent: float64(whole)})
+}
@@ -0,0 +1,174 @@
+package events
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+// receive returns the events sent on live until it is closed or nothing arrives for a while
+func receive(t *testing.T, live <-chan Event) (events []Event, closed bool) {
+	t.Helper()
+	for {
+		select {
+		case event, ok := <-live:
+			if !ok {
+				return events, true
+			}
+			events = append(events, event)
+		case <-time.After(100 * time.Millisecond):
+			return events, false
+		}
+	}
+}
+
+func TestSubscribeReplaysAndFollows(t *testing.T) {
+	h := NewHub()
+	h.Publish("job", Event{Type: TypeState, State: "queued"})
+	h.Publish("job", Event{Type: TypeState, State: "extracting"})
+
+	replay, live, cancel, ok := h.Subscribe("job", 1)
+	defer cancel()
+	if !ok || len(replay) != 1 || replay[0].ID != 2 || replay[0].State != "extracting" || replay[0].JobID != "job" {
+		t.Fatalf("replay = %+v, %v, want the event after id 1", replay, ok)
+	}
+
+	reporter := h.Reporter("job")
+	reporter.FFmpegProgress("extract", 10.4)
+	reporter.FFmpegProgress("extract", 10.9) // same whole percent, not published
+	reporter.FFmpegProgress("extract", 250)
+	reporter.SegmentDubbed(3, 1, 4)
+	h.Finish("job", "done")
+	h.Publish("job", Event{Type: TypeState, State: "late"})
+
+	events, closed := receive(t, live)
+	if !closed {
+		t.Error("live channel still open after Finish")
+	}
+	want := []Event{
+		{ID: 3, Type: TypeFFmpegProgress, Stage: "extract", Percent: 10},
+		{ID: 4, Type: TypeFFmpegProgress, Stage: "extract", Percent: 100},
+		{ID: 5, Type: TypeSegment, SegmentsDone: 1, SegmentsTotal: 4},
+		{ID: 6, Type: TypeState, State: "done"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("received %+v, want %d events", events, len(want))
+	}
+	for i, event := range events {
+		if event.ID != want[i].ID || event.Type != want[i].Type || event.State != want[i].State ||
+			event.Percent != want[i].Percent || event.SegmentsDone != want[i].SegmentsDone {
+			t.Errorf("event %d = %+v, want %+v", i, event, want[i])
+		}
+	}
+	if events[2].SegmentIndex == nil || *events[2].SegmentIndex != 3 {
+		t.Errorf("segment event = %+v, want segment 3", events[2])
+	}
+
+	// Late subscribers get the history and a closed channel
+	replay, live, _, _ = h.Subscribe("job", 0)
+	if _, closed := receive(t, live); len(replay) != 6 || !closed {
+		t.Errorf("subscription to a finished job = %d events, closed %v", len(replay), closed)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	h := NewHub()
+	_, live, cancel, _ := h.Subscribe("job", 0)
+	defer cancel()
+	for i := 0; i <= subscriberBuffer; i++ {
+		h.Publish("job", Event{Type: TypeSegment})
+	}
+
+	events, closed := receive(t, live)
+	if !closed || len(events) != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events, closed %v, want %d then closed", len(events), closed, subscriberBuffer)
+	}
+	// It reconnects with the last id it saw and replays what it missed
+	replay, _, cancel, _ := h.Subscribe("job", events[len(events)-1].ID)
+	defer cancel()
+	if len(replay) != 1 {
+		t.Errorf("replay after reconnecting = %d events, want the one missed", len(replay))
+	}
+}
+
+func TestRestartKeepsTheStream(t *testing.T) {
+	h := NewHub()
+	h.retention = 20 * time.Millisecond
+	known := func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		_, ok := h.streams["job"]
+		return ok
+	}
+
+	h.Publish("job", Event{Type: TypeState, State: "queued"})
+	h.Finish("job", "failed")
+	// The job is retried before the retention of its first run is over
+	h.Restart("job")
+	time.Sleep(3 * h.retention)
+	if !known() {
+		t.Fatal("stream of the retried job removed by the cleanup of its first run")
+	}
+
+	_, live, cancel, _ := h.Subscribe("job", 0)
+	defer cancel()
+	h.Publish("job", Event{Type: TypeState, State: "extracting"})
+	if events, _ := receive(t, live); len(events) != 1 || events[0].State != "extracting" {
+		t.Errorf("events of the retried job = %+v", events)
+	}
+
+	h.Finish("job", "done")
+	time.Sleep(3 * h.retention)
+	if known() {
+		t.Error("stream of the finished job kept past its retention")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	registry := jobs.NewRegistry()
+	h := NewHub()
+	h.Watch(registry)
+
+	status, _ := registry.Create(jobs.Status{})
+	_, live, cancel, ok := h.Subscribe(status.ID, 0)
+	defer cancel()
+	if !ok {
+		t.Fatal("job created after Watch is unknown")
+	}
+	registry.SetState(status.ID, jobs.StateExtracting)
+	registry.Fail(status.ID, errors.New("no audio stream"))
+
+	events, closed := receive(t, live)
+	if !closed || len(events) != 2 || events[0].State != "extracting" || events[1].State != "failed" {
+		t.Errorf("events = %+v, closed %v, want extracting then failed", events, closed)
+	}
+
+	// A retried job gets its stream back
+	if _, err := registry.Retry(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	replay, live, cancel, _ := h.Subscribe(status.ID, 0)
+	defer cancel()
+	if last := replay[len(replay)-1]; last.State != "queued" {
+		t.Errorf("last event of the retried job = %+v, want queued", last)
+	}
+	if _, closed := receive(t, live); closed {
+		t.Error("stream of the retried job is closed")
+	}
+
+	// Jobs the hub has not seen, such as jobs restored from the job store, and unknown jobs
+	done, _ := registry.Create(jobs.Status{})
+	registry.Complete(done.ID, "/out/done.mp4", "")
+	h.mu.Lock()
+	delete(h.streams, done.ID)
+	h.mu.Unlock()
+	if replay, live, _, ok := h.Subscribe(done.ID, 0); !ok || len(replay) != 1 || replay[0].State != "done" {
+		t.Errorf("subscription to a finished job the hub has not seen = %+v, %v", replay, ok)
+	} else if _, closed := receive(t, live); !closed {
+		t.Error("live channel of a finished job is open")
+	}
+	if _, _, _, ok := h.Subscribe("unknown", 0); ok {
+		t.Error("unknown job reported as known")
+	}
+}
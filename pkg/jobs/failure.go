@@ -0,0 +1,64 @@
+package jobs
+
+import "errors"
+
+// ErrorCode is a machine readable reason for a job failure.
+type ErrorCode string
+
+const (
+	ErrorCodeInternal            ErrorCode = "internal_error"
+	ErrorCodeInvalidInput        ErrorCode = "invalid_input"
+	ErrorCodeFFmpeg              ErrorCode = "ffmpeg_failed"
+	ErrorCodeUpstreamRejected    ErrorCode = "upstream_rejected"    // Whisper or Acapela refused the request (4xx)
+	ErrorCodeUpstreamUnavailable ErrorCode = "upstream_unavailable" // Whisper or Acapela kept failing (5xx, 429, network)
+	ErrorCodeDeadlineExceeded    ErrorCode = "deadline_exceeded"
+	ErrorCodeQueueFull           ErrorCode = "queue_full"
+	ErrorCodeQuotaExceeded       ErrorCode = "quota_exceeded" // the tenant ran out of a quota, e.g. TTS characters
+)
+
+// Failure describes why a job failed, as reported by the jobs API and the failure callback.
+type Failure struct {
+	Code         ErrorCode `json:"code"`
+	Stage        State     `json:"stage"`                   // stage the job was in when it failed
+	SegmentIndex *int      `json:"segment_index,omitempty"` // set when a single segment failed to dub
+	Message      string    `json:"message"`
+}
+
+// Error attaches an error code, and optionally the failing segment, to a job failure.
+// Fail records them in the job's Failure; other errors are reported as internal errors.
+type Error struct {
+	Code         ErrorCode
+	SegmentIndex *int
+	Err          error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// newFailure describes err, which happened while the job was in the given stage.
+func newFailure(stage State, err error) *Failure {
+	failure := &Failure{Code: ErrorCodeInternal, Stage: stage, Message: err.Error()}
+
+	var jobErr *Error
+	if errors.As(err, &jobErr) {
+		failure.Code = jobErr.Code
+		if jobErr.SegmentIndex != nil {
+			segmentIndex := *jobErr.SegmentIndex
+			failure.SegmentIndex = &segmentIndex
+		}
+	}
+	return failure
+}
+
+func (f *Failure) clone() *Failure {
+	if f == nil {
+		return nil
+	}
+	c := *f
+	if f.SegmentIndex != nil {
+		segmentIndex := *f.SegmentIndex
+		c.SegmentIndex = &segmentIndex
+	}
+	return &c
+}
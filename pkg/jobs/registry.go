@@ -0,0 +1,679 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the lifecycle stage a job is currently in.
+type State string
+
+const (
+	StateQueued       State = "queued"
+	StateExtracting   State = "extracting"
+	StateTranscribing State = "transcribing"
+	StateSplitting    State = "splitting"
+	StateDubbing      State = "dubbing"
+	StateMerging      State = "merging"
+	StateDone         State = "done"
+	StateFailed       State = "failed"
+	StateCancelled    State = "cancelled"
+)
+
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job has already finished")
+	ErrJobNotFailed = errors.New("only failed jobs can be retried")
+
+	// ErrInterrupted is the cancellation cause of jobs stopped by a shutdown. Their state is left
+	// untouched so they are requeued, and resume from their checkpoint, on the next startup.
+	ErrInterrupted = errors.New("job interrupted by shutdown")
+)
+
+// Terminal reports whether no further transitions are expected from this state.
+func (s State) Terminal() bool {
+	return s == StateDone || s == StateFailed || s == StateCancelled
+}
+
+// Status is a snapshot of a single job as reported by the jobs API.
+type Status struct {
+	ID                  string              `json:"id"`
+	State               State               `json:"state"`
+	FileName            string              `json:"file_name"`
+	UnprocessedFilePath string              `json:"unprocessed_file_path"`
+	ProcessedFilePath   string              `json:"processed_file_path,omitempty"` // local path, or s3:// URI when kept in a bucket
+	ProcessedFileURL    string              `json:"processed_file_url,omitempty"`  // URL of the output in the object store
+	CallbackURL         string              `json:"callback_url,omitempty"`
+	ClientID            string              `json:"client_id,omitempty"`
+	TenantID            string              `json:"tenant_id,omitempty"`
+	BatchID             string              `json:"batch_id,omitempty"`
+	BatchCallbackURL    string              `json:"batch_callback_url,omitempty"`
+	IdempotencyKey      string              `json:"idempotency_key,omitempty"`
+	Voice               string              `json:"voice,omitempty"`          // Acapela voice of the job, the service's voice when empty
+	Language            string              `json:"language,omitempty"`       // language spoken in the video, the service's default when empty
+	Subtitles           string              `json:"subtitles,omitempty"`      // burn, srt, both or none, burn when empty
+	ContentHash         string              `json:"content_hash,omitempty"`   // hash of the input video and processing options
+	VideoSeconds        float64             `json:"video_seconds,omitempty"`  // duration of the input, counted against the tenant's quota
+	TTSCharacters       int                 `json:"tts_characters,omitempty"` // characters sent to Acapela
+	TraceParent         string              `json:"trace_parent,omitempty"`   // W3C trace context of the last run of the job
+	Error               string              `json:"error,omitempty"`
+	Failure             *Failure            `json:"failure,omitempty"`
+	WorkerID            int                 `json:"worker_id,omitempty"`
+	Retries             int                 `json:"retries"`
+	CreatedAt           time.Time           `json:"created_at"`
+	UpdatedAt           time.Time           `json:"updated_at"`
+	FinishedAt          *time.Time          `json:"finished_at,omitempty"`
+	StageTimestamps     map[State]time.Time `json:"stage_timestamps"`
+}
+
+// Registry keeps track of every job submitted to this process.
+// When backed by a Store, every change is also persisted so jobs survive restarts.
+type Registry struct {
+	mu      sync.RWMutex
+	jobs    map[string]*Status
+	cancels map[string]context.CancelCauseFunc // cancel funcs of the jobs that are currently running
+	store   *Store
+
+	listenersMu    sync.RWMutex
+	listeners      []func(Status) // called whenever a job reaches a terminal state
+	stateListeners []func(Status) // called synchronously on every state change
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		jobs:    make(map[string]*Status),
+		cancels: make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// NewPersistentRegistry rebuilds the registry from the store.
+// Jobs that had not reached a terminal state are put back into the queued state;
+// use Pending to find them and hand them to the workers again.
+func NewPersistentRegistry(store *Store) (*Registry, error) {
+	snapshots, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewRegistry()
+	r.store = store
+	for id, snapshot := range snapshots {
+		status := snapshot.clone()
+		r.jobs[id] = &status
+	}
+
+	for _, status := range r.jobs {
+		if status.State.Terminal() {
+			continue
+		}
+		slog.Info("Job was interrupted when the service stopped, putting it back in the queue", "job_id", status.ID, "state", status.State)
+		r.apply(status, func(s *Status) {
+			s.State = StateQueued
+			s.WorkerID = 0
+		})
+	}
+
+	return r, nil
+}
+
+// Create registers a new queued job built from the given template and returns its snapshot.
+// The registry assigns the id, state and timestamps. With a store, it returns once the job is on
+// disk, so a job the client is told about survives a crash.
+func (r *Registry) Create(template Status) (Status, error) {
+	status, err := newStatus(template)
+	if err != nil {
+		return Status{}, err
+	}
+
+	r.mu.Lock()
+	r.insert(&status)
+	r.mu.Unlock()
+
+	if err := r.sync(status.ID); err != nil {
+		return Status{}, err
+	}
+	return status.clone(), nil
+}
+
+// CreateUnique is Create for submissions that must not be processed twice. Instead of registering
+// a new job it returns the duplicate found by FindDuplicate, if any; created reports which happened.
+// The lookup and the creation are atomic, so concurrent duplicate submissions end up with one job.
+func (r *Registry) CreateUnique(template Status) (status Status, created bool, err error) {
+	status, err = newStatus(template)
+	if err != nil {
+		return Status{}, false, err
+	}
+
+	r.mu.Lock()
+	if existing, ok := r.duplicateOf(template); ok {
+		existing := existing.clone()
+		r.mu.Unlock()
+		// The duplicate may have just been created, it must be on disk too
+		if r.store != nil {
+			if err := r.store.Sync(); err != nil {
+				return Status{}, false, err
+			}
+		}
+		return existing, false, nil
+	}
+	r.insert(&status)
+	r.mu.Unlock()
+
+	if err := r.sync(status.ID); err != nil {
+		return Status{}, false, err
+	}
+	return status.clone(), true, nil
+}
+
+// FindDuplicate returns the job of the same tenant a submission built from template would duplicate:
+//   - the job the same client submitted with the same idempotency key, whatever its state, other
+//     than the jobs of the template's own batch, which all carry the key of the batch;
+//   - otherwise a job with the same content hash that is queued, running, or done with its
+//     output still on disk. Done jobs are preferred, failed and cancelled jobs are never reused.
+func (r *Registry) FindDuplicate(template Status) (Status, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	existing, ok := r.duplicateOf(template)
+	if !ok {
+		return Status{}, false
+	}
+	return existing.clone(), true
+}
+
+// duplicateOf implements FindDuplicate. The caller must hold r.mu.
+func (r *Registry) duplicateOf(template Status) (*Status, bool) {
+	if template.IdempotencyKey != "" {
+		for _, status := range r.jobs {
+			if status.TenantID == template.TenantID && status.ClientID == template.ClientID &&
+				status.IdempotencyKey == template.IdempotencyKey && (template.BatchID == "" || status.BatchID != template.BatchID) {
+				return status, true
+			}
+		}
+	}
+	if template.ContentHash == "" {
+		return nil, false
+	}
+
+	var match *Status
+	for _, status := range r.jobs {
+		if status.TenantID != template.TenantID || status.ContentHash != template.ContentHash {
+			continue
+		}
+		switch status.State {
+		case StateFailed, StateCancelled:
+			continue
+		case StateDone:
+			// Outputs kept in a bucket are not checked, only the local ones may have been removed
+			if status.ProcessedFileURL == "" {
+				if _, err := os.Stat(status.ProcessedFilePath); err != nil {
+					continue
+				}
+			}
+			return status, true
+		}
+		if match == nil || status.CreatedAt.Before(match.CreatedAt) {
+			match = status
+		}
+	}
+	return match, match != nil
+}
+
+// newStatus builds the snapshot of a new queued job from the template.
+// The registry assigns the id, state and timestamps.
+func newStatus(template Status) (Status, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to generate job id: %v", err)
+	}
+
+	now := time.Now().UTC()
+	status := template.clone()
+	status.ID = id
+	status.State = StateQueued
+	status.CreatedAt = now
+	status.UpdatedAt = now
+	status.FinishedAt = nil
+	status.StageTimestamps = map[State]time.Time{StateQueued: now}
+	return status, nil
+}
+
+// insert registers the new job, persists it and notifies the state listeners.
+// The caller must hold r.mu.
+func (r *Registry) insert(status *Status) {
+	r.jobs[status.ID] = status
+	r.persist(*status)
+	r.notifyStateChange(status.clone())
+}
+
+// SetState moves a job into the given stage and records when it happened.
+func (r *Registry) SetState(id string, state State) {
+	r.update(id, func(s *Status) {
+		s.State = state
+	})
+}
+
+// SetWorker records which worker picked up the job.
+func (r *Registry) SetWorker(id string, workerID int) {
+	r.update(id, func(s *Status) {
+		s.WorkerID = workerID
+	})
+}
+
+// SetTraceParent records the trace context of the run of the job, the callbacks continue its trace.
+func (r *Registry) SetTraceParent(id string, traceParent string) {
+	r.update(id, func(s *Status) {
+		s.TraceParent = traceParent
+	})
+}
+
+// SetRetries records how many times the job has been retried.
+func (r *Registry) SetRetries(id string, retries int) {
+	r.update(id, func(s *Status) {
+		s.Retries = retries
+	})
+}
+
+// MoveInput records that the video of the job was moved to path. Unlike the other updates it also
+// applies to finished jobs, whose video may be moved once they finish, so that a retry finds it.
+func (r *Registry) MoveInput(id string, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.jobs[id]
+	if !ok {
+		return
+	}
+	r.apply(status, func(s *Status) {
+		s.UnprocessedFilePath = path
+	})
+}
+
+// Complete marks a job as done and records where its output is kept, and its URL when it is
+// kept in an object store.
+func (r *Registry) Complete(id string, processedFilePath string, processedFileURL string) {
+	r.update(id, func(s *Status) {
+		s.State = StateDone
+		s.ProcessedFilePath = processedFilePath
+		s.ProcessedFileURL = processedFileURL
+	})
+}
+
+// Fail marks a job as failed with the given error.
+// The failure is attributed to the stage the job was in; wrap err in an *Error to give it a code.
+func (r *Registry) Fail(id string, err error) {
+	r.update(id, func(s *Status) {
+		if err != nil {
+			s.Error = err.Error()
+			s.Failure = newFailure(s.State, err)
+		}
+		s.State = StateFailed
+	})
+}
+
+// OnFinished registers fn to be called, in its own goroutine, with the snapshot of every job
+// that reaches a terminal state (done, failed or cancelled).
+func (r *Registry) OnFinished(fn func(Status)) {
+	r.listenersMu.Lock()
+	defer r.listenersMu.Unlock()
+
+	r.listeners = append(r.listeners, fn)
+}
+
+// AttachCancel registers the function that stops the running job.
+// It returns false if the job has already reached a terminal state (e.g. it was
+// cancelled while still queued), in which case the job should not be started.
+func (r *Registry) AttachCancel(id string, cancel context.CancelCauseFunc) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.jobs[id]
+	if !ok || status.State.Terminal() {
+		return false
+	}
+	r.cancels[id] = cancel
+	return true
+}
+
+// DetachCancel forgets the cancel func once the job is no longer running.
+func (r *Registry) DetachCancel(id string) {
+	r.mu.Lock()
+	delete(r.cancels, id)
+	r.mu.Unlock()
+}
+
+// Cancel marks a queued or running job as cancelled and stops it if it is running.
+func (r *Registry) Cancel(id string) (Status, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.jobs[id]
+	if !ok {
+		return Status{}, ErrJobNotFound
+	}
+	if status.State.Terminal() {
+		return status.clone(), ErrJobFinished
+	}
+
+	r.apply(status, func(s *Status) {
+		s.State = StateCancelled
+	})
+	if cancel, ok := r.cancels[id]; ok {
+		cancel(context.Canceled)
+		delete(r.cancels, id)
+	}
+	return status.clone(), nil
+}
+
+// InterruptRunning stops every running job with ErrInterrupted and returns how many were stopped.
+func (r *Registry) InterruptRunning() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	interrupted := len(r.cancels)
+	for id, cancel := range r.cancels {
+		cancel(ErrInterrupted)
+		delete(r.cancels, id)
+	}
+	return interrupted
+}
+
+// Running returns the number of jobs that are currently being processed by a worker.
+func (r *Registry) Running() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.cancels)
+}
+
+// Retry puts a failed job back into the queued state so it can be run again.
+func (r *Registry) Retry(id string) (Status, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.jobs[id]
+	if !ok {
+		return Status{}, ErrJobNotFound
+	}
+	if status.State != StateFailed {
+		return status.clone(), ErrJobNotFailed
+	}
+
+	r.apply(status, func(s *Status) {
+		s.State = StateQueued
+		s.Error = ""
+		s.Failure = nil
+		s.WorkerID = 0
+		s.FinishedAt = nil
+	})
+	return status.clone(), nil
+}
+
+// Discard removes a job that was created but could not be handed to the workers after all, for a
+// submission the client was told to retry. Unlike Fail it sends no callback and leaves no failed job
+// behind for the idempotency key to return. The state change listeners see the job cancelled, so
+// its progress stream ends. Jobs that are no longer queued are left alone.
+func (r *Registry) Discard(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.jobs[id]
+	if !ok || status.State != StateQueued {
+		return
+	}
+	delete(r.jobs, id)
+	if r.store != nil {
+		if err := r.store.Remove(id); err != nil {
+			slog.Error("Failed to persist job removal", "job_id", id, "error", err)
+		}
+	}
+
+	discarded := status.clone()
+	discarded.State = StateCancelled
+	r.notifyStateChange(discarded)
+}
+
+// RevertRetry puts a retried job that could not be handed to the workers after all back to how it
+// failed, previous being its snapshot before Retry. No callback is sent, the job did not fail again.
+// Jobs that are no longer queued are left alone.
+func (r *Registry) RevertRetry(previous Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.jobs[previous.ID]
+	if !ok || status.State != StateQueued || previous.State != StateFailed {
+		return
+	}
+	*status = previous.clone()
+	status.UpdatedAt = time.Now().UTC()
+	r.persist(*status)
+	r.notifyStateChange(status.clone())
+}
+
+// Get returns a snapshot of the job with the given id.
+func (r *Registry) Get(id string) (Status, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	status, ok := r.jobs[id]
+	if !ok {
+		return Status{}, false
+	}
+	return status.clone(), true
+}
+
+// List returns snapshots of all known jobs, oldest first.
+func (r *Registry) List() []Status {
+	r.mu.RLock()
+	list := make([]Status, 0, len(r.jobs))
+	for _, status := range r.jobs {
+		list = append(list, status.clone())
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// ActiveJobsForClient counts the queued and running jobs submitted by the client.
+func (r *Registry) ActiveJobsForClient(clientID string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := 0
+	for _, status := range r.jobs {
+		if status.ClientID == clientID && !status.State.Terminal() {
+			count++
+		}
+	}
+	return count
+}
+
+// Usage is what the jobs of a tenant consumed, see Registry.Usage
+type Usage struct {
+	Jobs          int
+	VideoSeconds  float64
+	TTSCharacters int
+	OldestJob     time.Time // creation time of the oldest job counted
+}
+
+// Usage sums the jobs created since the given time whose tenant id is accepted by owns.
+func (r *Registry) Usage(owns func(tenantID string) bool, since time.Time) Usage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var usage Usage
+	for _, status := range r.jobs {
+		if status.CreatedAt.Before(since) || !owns(status.TenantID) {
+			continue
+		}
+		usage.Jobs++
+		usage.VideoSeconds += status.VideoSeconds
+		usage.TTSCharacters += status.TTSCharacters
+		if usage.OldestJob.IsZero() || status.CreatedAt.Before(usage.OldestJob) {
+			usage.OldestJob = status.CreatedAt
+		}
+	}
+	return usage
+}
+
+// AddTTSCharacters records that n more characters of the job were sent to Acapela.
+func (r *Registry) AddTTSCharacters(id string, n int) {
+	r.update(id, func(s *Status) {
+		s.TTSCharacters += n
+	})
+}
+
+// Batch returns snapshots of the jobs submitted together under the batch id, oldest first.
+func (r *Registry) Batch(batchID string) []Status {
+	var batch []Status
+	for _, status := range r.List() {
+		if status.BatchID == batchID {
+			batch = append(batch, status)
+		}
+	}
+	return batch
+}
+
+// NewBatchID generates the id shared by the jobs of a batch.
+func NewBatchID() (string, error) {
+	return newJobID()
+}
+
+// Pending returns snapshots of all jobs that have not reached a terminal state, oldest first.
+func (r *Registry) Pending() []Status {
+	var pending []Status
+	for _, status := range r.List() {
+		if !status.State.Terminal() {
+			pending = append(pending, status)
+		}
+	}
+	return pending
+}
+
+func (r *Registry) update(id string, change func(s *Status)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.jobs[id]
+	if !ok || status.State.Terminal() {
+		// Terminal states are final, late updates from a cancelled job are ignored
+		return
+	}
+	r.apply(status, change)
+}
+
+// apply runs change on the job, stamps the timestamps and persists the result.
+// The caller must hold r.mu.
+func (r *Registry) apply(status *Status, change func(s *Status)) {
+	previous := status.State
+	change(status)
+
+	now := time.Now().UTC()
+	status.UpdatedAt = now
+	if status.State != previous {
+		status.StageTimestamps[status.State] = now
+	}
+	if status.State.Terminal() && status.FinishedAt == nil {
+		status.FinishedAt = &now
+	}
+
+	r.persist(*status)
+
+	if status.State != previous {
+		r.notifyStateChange(status.clone())
+		if status.State.Terminal() {
+			r.notifyFinished(status.clone())
+		}
+	}
+}
+
+// OnStateChange registers fn to be called with the snapshot of a job every time its state changes,
+// including when it is created. fn is called synchronously, in order, while the registry is locked:
+// it must return quickly and must not call back into the registry.
+func (r *Registry) OnStateChange(fn func(Status)) {
+	r.listenersMu.Lock()
+	defer r.listenersMu.Unlock()
+
+	r.stateListeners = append(r.stateListeners, fn)
+}
+
+// notifyStateChange hands the snapshot to the state listeners. The caller must hold r.mu.
+func (r *Registry) notifyStateChange(status Status) {
+	r.listenersMu.RLock()
+	defer r.listenersMu.RUnlock()
+
+	for _, fn := range r.stateListeners {
+		fn(status)
+	}
+}
+
+// notifyFinished hands the snapshot of a finished job to the listeners without holding r.mu.
+func (r *Registry) notifyFinished(status Status) {
+	r.listenersMu.RLock()
+	defer r.listenersMu.RUnlock()
+
+	for _, fn := range r.listeners {
+		go fn(status)
+	}
+}
+
+// sync waits until the new job is on disk. The disk is waited for without holding r.mu, so the
+// other jobs move on meanwhile. A job whose creation could not be written is forgotten: it was not
+// handed to a worker yet, and the caller reports the submission as failed.
+func (r *Registry) sync(id string) error {
+	if r.store == nil {
+		return nil
+	}
+	err := r.store.Sync()
+	if err != nil {
+		r.mu.Lock()
+		delete(r.jobs, id)
+		r.mu.Unlock()
+		return fmt.Errorf("failed to persist job %s: %w", id, err)
+	}
+	return nil
+}
+
+// persist queues the snapshot for the store, if there is one. It does not wait for the disk, so it
+// is cheap enough to call with r.mu held, which keeps the snapshots of a job in order.
+func (r *Registry) persist(status Status) {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.Append(status); err != nil {
+		slog.Error("Failed to persist job", "job_id", status.ID, "error", err)
+	}
+}
+
+func (s *Status) clone() Status {
+	c := *s
+	c.StageTimestamps = make(map[State]time.Time, len(s.StageTimestamps))
+	for k, v := range s.StageTimestamps {
+		c.StageTimestamps[k] = v
+	}
+	if s.FinishedAt != nil {
+		finishedAt := *s.FinishedAt
+		c.FinishedAt = &finishedAt
+	}
+	c.Failure = s.Failure.clone()
+	return c
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,345 @@
+package jobs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// restart reopens the registry from the log at path, without closing the store of the previous
+// registry, as after a crash
+func restart(t *testing.T, path string) *Registry {
+	t.Helper()
+	registry, err := NewPersistentRegistry(openTestStore(t, path))
+	if err != nil {
+		t.Fatalf("NewPersistentRegistry: %v", err)
+	}
+	return registry
+}
+
+func TestCreateIsOnDiskWhenItReturns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	registry := restart(t, path)
+
+	status, err := registry.Create(Status{FileName: "lecture.mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unique, created, err := registry.CreateUnique(Status{FileName: "talk.mp4", IdempotencyKey: "k"})
+	if err != nil || !created {
+		t.Fatalf("CreateUnique = %v, %v", created, err)
+	}
+
+	restarted := restart(t, path)
+	for _, id := range []string{status.ID, unique.ID} {
+		if _, ok := restarted.Get(id); !ok {
+			t.Errorf("job %s acknowledged before a crash is lost", id)
+		}
+	}
+}
+
+func TestRestartRequeuesInterruptedJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	registry := restart(t, path)
+
+	create := func(name string) string {
+		status, err := registry.Create(Status{FileName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.ID
+	}
+	queued := create("queued.mp4")
+	running := create("running.mp4")
+	done := create("done.mp4")
+	failed := create("failed.mp4")
+
+	registry.SetWorker(running, 3)
+	registry.SetState(running, StateDubbing)
+	registry.Complete(done, "/out/done.mp4", "")
+	registry.Fail(failed, errors.New("no audio stream"))
+	if err := registry.store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := restart(t, path)
+	tests := []struct {
+		id        string
+		wantState State
+	}{
+		{queued, StateQueued},
+		{running, StateQueued},
+		{done, StateDone},
+		{failed, StateFailed},
+	}
+	for _, tt := range tests {
+		status, ok := restarted.Get(tt.id)
+		if !ok {
+			t.Errorf("job %s lost", tt.id)
+			continue
+		}
+		if status.State != tt.wantState {
+			t.Errorf("job %s is %s after the restart, want %s", status.FileName, status.State, tt.wantState)
+		}
+	}
+
+	status, _ := restarted.Get(running)
+	if status.WorkerID != 0 {
+		t.Errorf("requeued job still has worker %d", status.WorkerID)
+	}
+	if _, ok := status.StageTimestamps[StateDubbing]; !ok {
+		t.Error("requeued job lost the timestamps of the stages it went through")
+	}
+	failedStatus, _ := restarted.Get(failed)
+	if failedStatus.Failure == nil || failedStatus.Error != "no audio stream" {
+		t.Errorf("failed job restored as %+v, want its failure", failedStatus)
+	}
+
+	pending := restarted.Pending()
+	if len(pending) != 2 || pending[0].ID != queued || pending[1].ID != running {
+		t.Errorf("Pending = %v, want the queued then the interrupted job", pending)
+	}
+}
+
+func TestRestartAfterTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	registry := restart(t, path)
+	status, err := registry.Create(Status{FileName: "lecture.mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.SetState(status.ID, StateTranscribing)
+	if err := registry.store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The process died while writing the transition to splitting
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"recorded_at":"2024-01-01T00:00:00Z","job":{"id":"` + status.ID + `","state":"split`)
+	file.Close()
+
+	restarted := restart(t, path)
+	restored, ok := restarted.Get(status.ID)
+	if !ok {
+		t.Fatal("job lost after a torn record")
+	}
+	if restored.State != StateQueued {
+		t.Errorf("job is %s, want it requeued", restored.State)
+	}
+	if _, ok := restored.StageTimestamps[StateTranscribing]; !ok {
+		t.Error("job lost the transitions recorded before the torn one")
+	}
+
+	// And again, now that the log was compacted
+	if _, ok := restart(t, path).Get(status.ID); !ok {
+		t.Error("job lost after a second restart")
+	}
+}
+
+func TestTerminalStatesAreFinal(t *testing.T) {
+	registry := NewRegistry()
+	status, _ := registry.Create(Status{FileName: "lecture.mp4"})
+	if _, err := registry.Cancel(status.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	registry.SetState(status.ID, StateMerging)
+	registry.Complete(status.ID, "/out/lecture.mp4", "")
+	if got, _ := registry.Get(status.ID); got.State != StateCancelled || got.ProcessedFilePath != "" {
+		t.Errorf("cancelled job updated to %s %q", got.State, got.ProcessedFilePath)
+	}
+	if _, err := registry.Cancel(status.ID); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("second Cancel = %v, want ErrJobFinished", err)
+	}
+	if _, err := registry.Retry(status.ID); !errors.Is(err, ErrJobNotFailed) {
+		t.Errorf("Retry of a cancelled job = %v, want ErrJobNotFailed", err)
+	}
+
+	// The input of a finished job may still be moved
+	registry.MoveInput(status.ID, "/in/done/lecture.mp4")
+	if got, _ := registry.Get(status.ID); got.UnprocessedFilePath != "/in/done/lecture.mp4" {
+		t.Errorf("input path = %q after MoveInput", got.UnprocessedFilePath)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	registry := NewRegistry()
+	status, _ := registry.Create(Status{FileName: "lecture.mp4"})
+	registry.Fail(status.ID, &Error{Code: ErrorCodeInvalidInput, Err: errors.New("no audio")})
+
+	retried, err := registry.Retry(status.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.State != StateQueued || retried.Error != "" || retried.Failure != nil || retried.FinishedAt != nil {
+		t.Errorf("retried job = %+v, want it queued without its failure", retried)
+	}
+	if _, err := registry.Retry("unknown"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Retry of an unknown job = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestCreateUniqueFindsDuplicates(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    Status
+		finish      func(r *Registry, id string)
+		template    Status
+		wantCreated bool
+	}{
+		{
+			name:        "same idempotency key",
+			existing:    Status{ClientID: "c", IdempotencyKey: "k"},
+			template:    Status{ClientID: "c", IdempotencyKey: "k"},
+			wantCreated: false,
+		},
+		{
+			name:        "same idempotency key of another client",
+			existing:    Status{ClientID: "c", IdempotencyKey: "k"},
+			template:    Status{ClientID: "d", IdempotencyKey: "k"},
+			wantCreated: true,
+		},
+		{
+			name:        "same idempotency key of another tenant",
+			existing:    Status{TenantID: "acme", ClientID: "c", IdempotencyKey: "k"},
+			template:    Status{TenantID: "globex", ClientID: "c", IdempotencyKey: "k"},
+			wantCreated: true,
+		},
+		{
+			name:        "same idempotency key of a job of the same batch",
+			existing:    Status{ClientID: "c", IdempotencyKey: "k", BatchID: "b"},
+			template:    Status{ClientID: "c", IdempotencyKey: "k", BatchID: "b"},
+			wantCreated: true,
+		},
+		{
+			name:        "same idempotency key of a job of another batch",
+			existing:    Status{ClientID: "c", IdempotencyKey: "k", BatchID: "b"},
+			template:    Status{ClientID: "c", IdempotencyKey: "k", BatchID: "other"},
+			wantCreated: false,
+		},
+		{
+			name:        "same content of a queued job",
+			existing:    Status{ContentHash: "h"},
+			template:    Status{ContentHash: "h"},
+			wantCreated: false,
+		},
+		{
+			name:        "same content of a failed job",
+			existing:    Status{ContentHash: "h"},
+			finish:      func(r *Registry, id string) { r.Fail(id, errors.New("failed")) },
+			template:    Status{ContentHash: "h"},
+			wantCreated: true,
+		},
+		{
+			name:        "same content of a done job whose output was removed",
+			existing:    Status{ContentHash: "h"},
+			finish:      func(r *Registry, id string) { r.Complete(id, filepath.Join(os.TempDir(), "missing-output.mp4"), "") },
+			template:    Status{ContentHash: "h"},
+			wantCreated: true,
+		},
+		{
+			name:        "same content of a done job kept in a bucket",
+			existing:    Status{ContentHash: "h"},
+			finish:      func(r *Registry, id string) { r.Complete(id, "s3://videos/out.mp4", "https://videos/out.mp4") },
+			template:    Status{ContentHash: "h"},
+			wantCreated: false,
+		},
+		{
+			name:        "other content",
+			existing:    Status{ContentHash: "h"},
+			template:    Status{ContentHash: "other"},
+			wantCreated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewRegistry()
+			existing, err := registry.Create(tt.existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.finish != nil {
+				tt.finish(registry, existing.ID)
+			}
+
+			status, created, err := registry.CreateUnique(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created != tt.wantCreated {
+				t.Fatalf("created = %v, want %v", created, tt.wantCreated)
+			}
+			if !created && status.ID != existing.ID {
+				t.Errorf("returned job %s, want the duplicate %s", status.ID, existing.ID)
+			}
+		})
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	registry := restart(t, path)
+	finished := make(chan Status, 1)
+	registry.OnFinished(func(status Status) { finished <- status })
+
+	status, err := registry.Create(Status{ClientID: "c", IdempotencyKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Discard(status.ID)
+	if _, ok := registry.Get(status.ID); ok {
+		t.Error("discarded job still registered")
+	}
+	if _, created, _ := registry.CreateUnique(Status{ClientID: "c", IdempotencyKey: "k"}); !created {
+		t.Error("submission with the key of a discarded job returned a duplicate")
+	}
+	if err := registry.store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restart(t, path).Get(status.ID); ok {
+		t.Error("discarded job restored after a restart")
+	}
+	select {
+	case status := <-finished:
+		t.Errorf("discarded job reported as finished: %+v", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Jobs the workers already have are not discarded
+	running, _ := registry.Create(Status{})
+	registry.SetState(running.ID, StateExtracting)
+	registry.Discard(running.ID)
+	if _, ok := registry.Get(running.ID); !ok {
+		t.Error("running job discarded")
+	}
+}
+
+func TestRevertRetry(t *testing.T) {
+	registry := NewRegistry()
+	finished := make(chan Status, 2)
+	registry.OnFinished(func(status Status) { finished <- status })
+
+	status, _ := registry.Create(Status{})
+	registry.Fail(status.ID, &Error{Code: ErrorCodeInternal, Err: errors.New("ffmpeg crashed")})
+	<-finished
+	failed, _ := registry.Get(status.ID)
+
+	if _, err := registry.Retry(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	registry.RevertRetry(failed)
+	reverted, _ := registry.Get(status.ID)
+	if reverted.State != StateFailed || reverted.Error != "ffmpeg crashed" || reverted.Failure == nil || reverted.FinishedAt == nil {
+		t.Errorf("reverted job = %+v, want its failure back", reverted)
+	}
+	select {
+	case status := <-finished:
+		t.Errorf("reverted retry reported as finished again: %+v", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
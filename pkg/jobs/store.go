@@ -0,0 +1,281 @@
+package jobs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errStoreClosed = errors.New("job store is closed")
+
+// Store is an append-only log of job snapshots on disk.
+// Every state transition is appended as one JSON line. Appends are queued and written by a
+// background writer, which batches the records queued in the meantime into a single write and
+// fsync, so transitions never wait for the disk; Sync waits for the records that must not be lost,
+// such as the creation of a job the client is about to be told about. Load compacts the log down to
+// the latest snapshot of every job, so it keeps how every job ended without growing with every transition.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	pending *batch // records queued but not written yet, nil when there are none
+	writing *batch // records being written and synced, nil when there are none
+	closed  bool
+
+	writeMu sync.Mutex    // held while the file is written, synced or replaced
+	wake    chan struct{} // signals the writer that records are pending
+	done    chan struct{} // closed once the writer has written everything and stopped
+}
+
+// batch is a group of records written and synced together
+type batch struct {
+	data []byte
+	done chan struct{} // closed once the records are written and synced, or failed to be
+	err  error         // why the records could not be written, set before done is closed
+}
+
+type storeRecord struct {
+	RecordedAt time.Time `json:"recorded_at"`
+	Job        Status    `json:"job"`
+	Removed    bool      `json:"removed,omitempty"` // the job was discarded, only its id is recorded
+}
+
+// OpenStore opens (or creates) the job log at the given path.
+func OpenStore(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create job store directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job store %s: %v", path, err)
+	}
+
+	s := &Store{path: path, file: file, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go s.writer()
+	return s, nil
+}
+
+// Append queues a snapshot of the job to be written to the end of the log.
+// It returns without waiting for the disk; Sync waits for it, Close writes whatever is still queued.
+func (s *Store) Append(status Status) error {
+	return s.append(storeRecord{RecordedAt: time.Now().UTC(), Job: status})
+}
+
+// Remove queues a record removing the job from the log, Load forgets it.
+func (s *Store) Remove(id string) error {
+	return s.append(storeRecord{RecordedAt: time.Now().UTC(), Job: Status{ID: id}, Removed: true})
+}
+
+func (s *Store) append(record storeRecord) error {
+	status := record.Job
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %v", status.ID, err)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("failed to append job %s: %w", status.ID, errStoreClosed)
+	}
+	if s.pending == nil {
+		s.pending = &batch{done: make(chan struct{})}
+	}
+	s.pending.data = append(append(s.pending.data, line...), '\n')
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// The writer is already due to run and picks these records up too
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// writer writes the queued records until the store is closed
+func (s *Store) writer() {
+	defer close(s.done)
+	for range s.wake {
+		if err := s.flush(); err != nil {
+			slog.Error("Failed to write job store", "path", s.path, "error", err)
+		}
+	}
+}
+
+// flush writes and syncs the records queued so far
+func (s *Store) flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	b := s.pending
+	s.pending = nil
+	s.writing = b
+	s.mu.Unlock()
+	if b == nil {
+		return nil
+	}
+
+	_, err := s.file.Write(b.data)
+	if err == nil {
+		err = s.file.Sync()
+	}
+
+	s.mu.Lock()
+	s.writing = nil
+	s.mu.Unlock()
+	b.err = err
+	close(b.done)
+	return err
+}
+
+// Sync waits until the records appended so far are written and synced, and returns the error that
+// kept them from being written. Concurrent callers share the same write and fsync.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	batches := []*batch{s.writing, s.pending}
+	s.mu.Unlock()
+
+	for _, b := range batches {
+		if b == nil {
+			continue
+		}
+		<-b.done
+		if b.err != nil {
+			return fmt.Errorf("failed to write job store %s: %v", s.path, b.err)
+		}
+	}
+	return nil
+}
+
+// Load replays the log and returns the latest snapshot of every job, then rewrites the log with
+// only those snapshots.
+func (s *Store) Load() (map[string]Status, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job store %s: %v", s.path, err)
+	}
+	defer file.Close()
+
+	latest := make(map[string]storeRecord)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		var record storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash in the middle of a write leaves a truncated last line behind
+			slog.Warn("Skipping unreadable job store record", "line", lineNumber, "error", err)
+			continue
+		}
+		if record.Removed {
+			delete(latest, record.Job.ID)
+			continue
+		}
+		latest[record.Job.ID] = record
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read job store %s: %v", s.path, err)
+	}
+
+	if err := s.compact(latest, lineNumber); err != nil {
+		// The uncompacted log is still valid, it is only larger than it needs to be
+		slog.Warn("Failed to compact job store", "path", s.path, "error", err)
+	}
+
+	snapshots := make(map[string]Status, len(latest))
+	for id, record := range latest {
+		snapshots[id] = record.Job
+	}
+	return snapshots, nil
+}
+
+// compact replaces the log with the given records, through a temporary file so a crash leaves
+// either the old or the new log behind. The caller must hold s.writeMu.
+func (s *Store) compact(latest map[string]storeRecord, lines int) error {
+	if lines == len(latest) {
+		return nil
+	}
+
+	records := make([]storeRecord, 0, len(latest))
+	for _, record := range latest {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].RecordedAt.Before(records[j].RecordedAt) })
+
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+
+	tmp := s.path + ".compact"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Appends must go to the new log, not the replaced one
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen job store %s: %v", s.path, err)
+	}
+	s.file.Close()
+	s.file = file
+	slog.Info("Compacted job store", "path", s.path, "records", lines, "jobs", len(records))
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close writes the records still queued and closes the log. Later appends fail.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errStoreClosed
+	}
+	s.closed = true
+	close(s.wake)
+	s.mu.Unlock()
+
+	// The writer drains the records queued before closed was set, then stops
+	<-s.done
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,178 @@
+package jobs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func snapshot(id string, state State) Status {
+	return Status{ID: id, State: state, FileName: id + ".mp4", StageTimestamps: map[State]time.Time{}}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestStoreLoadKeepsLatestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	store := openTestStore(t, path)
+	for _, status := range []Status{
+		snapshot("a", StateQueued),
+		snapshot("b", StateQueued),
+		snapshot("a", StateExtracting),
+		snapshot("a", StateDone),
+		snapshot("b", StateDubbing),
+	} {
+		if err := store.Append(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestStore(t, path)
+	snapshots, err := reopened.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]State{"a": StateDone, "b": StateDubbing}
+	if len(snapshots) != len(want) {
+		t.Fatalf("loaded %d jobs, want %d", len(snapshots), len(want))
+	}
+	for id, state := range want {
+		if snapshots[id].State != state {
+			t.Errorf("job %s is %s, want %s", id, snapshots[id].State, state)
+		}
+	}
+	if lines := countLines(t, path); lines != len(want) {
+		t.Errorf("log has %d records after compaction, want %d", lines, len(want))
+	}
+}
+
+func TestStoreLoadSkipsTornLastRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		torn string
+	}{
+		{"truncated record", `{"recorded_at":"2024-01-01T00:00:00Z","job":{"id":"c","sta`},
+		{"truncated record of a known job", `{"recorded_at":"2024-01-01T00:00:00Z","job":{"id":"a","state":"do`},
+		{"partial line of garbage", "\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jobs.log")
+			store := openTestStore(t, path)
+			store.Append(snapshot("a", StateQueued))
+			store.Append(snapshot("b", StateDone))
+			if err := store.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The process died in the middle of writing the next record
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.WriteString(tt.torn)
+			file.Close()
+
+			reopened := openTestStore(t, path)
+			snapshots, err := reopened.Load()
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if len(snapshots) != 2 || snapshots["a"].State != StateQueued || snapshots["b"].State != StateDone {
+				t.Fatalf("loaded %v, want a queued and b done", snapshots)
+			}
+
+			// Records appended after the replay must not be glued to the torn one
+			if err := reopened.Append(snapshot("a", StateExtracting)); err != nil {
+				t.Fatal(err)
+			}
+			if err := reopened.Close(); err != nil {
+				t.Fatal(err)
+			}
+			snapshots, err = openTestStore(t, path).Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshots["a"].State != StateExtracting {
+				t.Errorf("job a is %s after a second restart, want %s", snapshots["a"].State, StateExtracting)
+			}
+		})
+	}
+}
+
+func TestStoreRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	store := openTestStore(t, path)
+	store.Append(snapshot("a", StateQueued))
+	store.Append(snapshot("b", StateQueued))
+	store.Remove("a")
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := openTestStore(t, path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshots["a"]; ok || len(snapshots) != 1 {
+		t.Errorf("loaded %v, want only b", snapshots)
+	}
+	if lines := countLines(t, path); lines != 1 {
+		t.Errorf("log has %d records after compaction, want 1", lines)
+	}
+}
+
+func TestStoreSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	store := openTestStore(t, path)
+	for i := 0; i < 10; i++ {
+		if err := store.Append(snapshot("a", StateQueued)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	// Without closing the store, as after a crash
+	if lines := countLines(t, path); lines != 10 {
+		t.Errorf("log has %d records once synced, want 10", lines)
+	}
+	if err := store.Sync(); err != nil {
+		t.Errorf("Sync with nothing queued: %v", err)
+	}
+}
+
+func TestStoreClosed(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "jobs.log"))
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(snapshot("a", StateQueued)); err == nil {
+		t.Error("Append succeeded on a closed store")
+	}
+	if err := store.Close(); err == nil {
+		t.Error("second Close succeeded")
+	}
+}
@@ -0,0 +1,75 @@
+// Package logging sets up the structured JSON logs of the service. Records logged with a context
+// carry the attributes added to it with With, such as the job ID, worker ID and segment index,
+// and the trace and span IDs of the span in progress, so interleaved lines can be told apart.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"videoUploadAndProcessing/pkg/tracing"
+)
+
+type attrsKey struct{}
+
+// With returns a copy of ctx whose log records carry the attributes given as in slog.Logger.With,
+// e.g. With(ctx, "job_id", id). They replace the attributes of ctx with the same keys.
+func With(ctx context.Context, args ...any) context.Context {
+	added := slog.Group("", args...).Value.Group()
+	existing, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+
+	attrs := make([]slog.Attr, 0, len(existing)+len(added))
+	for _, attr := range existing {
+		replaced := false
+		for _, a := range added {
+			if a.Key == attr.Key {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			attrs = append(attrs, attr)
+		}
+	}
+	attrs = append(attrs, added...)
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// New creates a logger writing JSON records of at least the given level to w
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// ParseLevel reads a level name: debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// contextHandler adds the attributes of the context and its trace to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if traceID, spanID := tracing.IDs(ctx); traceID != "" {
+		r.AddAttrs(slog.String("trace_id", traceID), slog.String("span_id", spanID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
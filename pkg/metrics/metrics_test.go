@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useRegistry has the constructors register with an empty registry for the rest of the test
+func useRegistry(t *testing.T) {
+	previous := Default
+	Default = NewRegistry()
+	t.Cleanup(func() { Default = previous })
+}
+
+func TestWrite(t *testing.T) {
+	useRegistry(t)
+	requests := NewCounter("test_requests_total", "Requests by path\nand status, with a \\ in the help.", "path", "status")
+	requests.Inc("/upload", "200")
+	requests.Add(2, "/upload", "200")
+	requests.Inc(`/say "hi"`+"\n"+`C:\videos`, "500")
+
+	busy := NewGauge("test_busy_workers", "Busy workers.")
+	busy.Inc()
+	busy.Inc()
+	busy.Dec()
+	NewGaugeFunc("test_queue_depth", "Jobs waiting.", func() float64 { return math.Inf(1) })
+
+	durations := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.5}, "stage")
+	durations.Observe(0.5, "dub")
+	durations.Observe(0.75, "dub")
+	durations.Observe(3, "dub")
+	durations.Observe(0.1, "extract")
+
+	want := `# HELP test_busy_workers Busy workers.
+# TYPE test_busy_workers gauge
+test_busy_workers 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{stage="dub",le="0.5"} 1
+test_duration_seconds_bucket{stage="dub",le="1"} 2
+test_duration_seconds_bucket{stage="dub",le="+Inf"} 3
+test_duration_seconds_sum{stage="dub"} 4.25
+test_duration_seconds_count{stage="dub"} 3
+test_duration_seconds_bucket{stage="extract",le="0.5"} 1
+test_duration_seconds_bucket{stage="extract",le="1"} 1
+test_duration_seconds_bucket{stage="extract",le="+Inf"} 1
+test_duration_seconds_sum{stage="extract"} 0.1
+test_duration_seconds_count{stage="extract"} 1
+# HELP test_queue_depth Jobs waiting.
+# TYPE test_queue_depth gauge
+test_queue_depth +Inf
+# HELP test_requests_total Requests by path\nand status, with a \\ in the help.
+# TYPE test_requests_total counter
+test_requests_total{path="/say \"hi\"\nC:\\videos",status="500"} 1
+test_requests_total{path="/upload",status="200"} 3
+`
+	var out strings.Builder
+	if err := Default.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("Write =\n%s\nwant\n%s", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("GET /metrics = %d\n%s", rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text exposition format", contentType)
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	useRegistry(t)
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"registered twice", func() {
+			NewCounter("test_twice_total", "")
+			NewCounter("test_twice_total", "")
+		}},
+		{"wrong number of label values", func() { NewGauge("test_labels", "", "stage").Set(1) }},
+		{"counter decreased", func() { NewCounter("test_decreased_total", "").Add(-1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			tt.fn()
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StatusError is returned when a remote API answers with a non-200 status code
+type StatusError struct {
+	Service    string
+	StatusCode int
+	RetryAfter time.Duration // parsed from the Retry-After header, if any
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status code %d", e.Service, e.StatusCode)
+}
+
+// NewStatusError builds a StatusError from the response of the given service
+func NewStatusError(service string, resp *http.Response) *StatusError {
+	statusErr := &StatusError{Service: service, StatusCode: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		statusErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return statusErr
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, e.g. because the input is invalid
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsTransient reports whether the operation that returned err may succeed if it is tried again.
+// Timeouts, network errors, 408, 429 and 5xx responses are transient; errors marked Permanent,
+// other 4xx responses, missing files and cancellations are not. Anything else, such as a
+// failing ffmpeg run, is treated as transient.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var permanentErr *permanentError
+	if errors.As(err, &permanentErr) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusRequestTimeout,
+			statusErr.StatusCode == http.StatusTooManyRequests,
+			statusErr.StatusCode >= 500:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	return true
+}
+
+// RetryAfter returns the wait requested by the remote API through Retry-After, if any
+func RetryAfter(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"unknown error", errors.New("ffmpeg exited with status 1"), true},
+		{"permanent", Permanent(errors.New("invalid input")), false},
+		{"wrapped permanent", fmt.Errorf("stage failed: %w", Permanent(&StatusError{StatusCode: 503})), false},
+		{"canceled", context.Canceled, false},
+		{"wrapped canceled", fmt.Errorf("request failed: %w", context.Canceled), false},
+		{"deadline exceeded", context.DeadlineExceeded, true},
+		{"400", &StatusError{Service: "api", StatusCode: http.StatusBadRequest}, false},
+		{"401", &StatusError{Service: "api", StatusCode: http.StatusUnauthorized}, false},
+		{"404", &StatusError{Service: "api", StatusCode: http.StatusNotFound}, false},
+		{"408", &StatusError{Service: "api", StatusCode: http.StatusRequestTimeout}, true},
+		{"429", &StatusError{Service: "api", StatusCode: http.StatusTooManyRequests}, true},
+		{"500", &StatusError{Service: "api", StatusCode: http.StatusInternalServerError}, true},
+		{"wrapped 503", fmt.Errorf("call failed: %w", &StatusError{Service: "api", StatusCode: http.StatusServiceUnavailable}), true},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"dns error", &net.DNSError{Err: "no such host", Name: "example.invalid"}, true},
+		{"missing file", &fs.PathError{Op: "open", Path: "/missing", Err: fs.ErrNotExist}, false},
+		{"wrapped missing file", fmt.Errorf("failed to open input: %w", os.ErrNotExist), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{"no header", "", 0},
+		{"seconds", "30", 30 * time.Second},
+		{"zero", "0", 0},
+		{"negative", "-5", 0},
+		{"http date is ignored", "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			err := NewStatusError("api", resp)
+			if err.StatusCode != http.StatusTooManyRequests {
+				t.Errorf("StatusCode = %d, want %d", err.StatusCode, http.StatusTooManyRequests)
+			}
+			if got := RetryAfter(fmt.Errorf("wrapped: %w", err)); got != tt.want {
+				t.Errorf("RetryAfter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package retry
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy describes how often and how fast a failing operation is retried
+type Policy struct {
+	MaxAttempts    int           // total number of attempts, 1 disables retries
+	InitialBackoff time.Duration // wait before the first retry
+	MaxBackoff     time.Duration // upper bound of the wait between attempts
+	Multiplier     float64       // growth factor of the wait after every attempt
+	Jitter         float64       // fraction (0-1) of the wait that is randomised
+}
+
+// DefaultPolicy is used for stages without a policy of their own
+var DefaultPolicy = Policy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     16 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// Backoff returns how long to wait before the given retry (1 for the first retry)
+func (p Policy) Backoff(retry int) time.Duration {
+	if retry < 1 {
+		retry = 1
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+
+	// Spread the retries of concurrent workers so they don't hit the APIs at the same moment
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		backoff -= backoff * jitter * rand.Float64()
+	}
+	return time.Duration(backoff)
+}
+
+// Policies holds the retry policy of every stage, keyed by stage name
+type Policies map[string]Policy
+
+// For returns the policy of the stage, or DefaultPolicy if it has none
+func (p Policies) For(stage string) Policy {
+	if policy, ok := p[stage]; ok {
+		return policy
+	}
+	return DefaultPolicy
+}
+
+// Do runs op until it succeeds, fails with a permanent error, runs out of attempts or ctx is done.
+// The last error is returned.
+func Do(ctx context.Context, policy Policy, name string, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || !IsTransient(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		wait := policy.Backoff(attempt)
+		if retryAfter := RetryAfter(err); retryAfter > wait {
+			wait = retryAfter
+		}
+		slog.WarnContext(ctx, "Operation failed, retrying", "operation", name, "attempt", attempt, "max_attempts", policy.MaxAttempts, "backoff", wait.String(), "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
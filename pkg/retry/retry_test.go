@@ -0,0 +1,78 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPolicyBackoff(t *testing.T) {
+	policy := Policy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.Backoff(tt.retry); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.retry, got, tt.want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.Backoff(2); got < 100*time.Millisecond || got > 200*time.Millisecond {
+			t.Fatalf("Backoff(2) with jitter = %v, want between 100ms and 200ms", got)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1}
+	tests := []struct {
+		name         string
+		err          error
+		wantAttempts int
+	}{
+		{"transient error uses every attempt", &StatusError{Service: "api", StatusCode: http.StatusBadGateway}, 3},
+		{"permanent error is not retried", Permanent(errors.New("invalid input")), 1},
+		{"client error is not retried", &StatusError{Service: "api", StatusCode: http.StatusBadRequest}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := Do(context.Background(), policy, "test", func() error {
+				attempts++
+				return tt.err
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Do returned %v, want %v", err, tt.err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+
+	t.Run("succeeds after a transient error", func(t *testing.T) {
+		attempts := 0
+		err := Do(context.Background(), policy, "test", func() error {
+			attempts++
+			if attempts == 1 {
+				return context.DeadlineExceeded
+			}
+			return nil
+		})
+		if err != nil || attempts != 2 {
+			t.Errorf("Do = %v after %d attempts, want nil after 2", err, attempts)
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/tracing"
+)
+
+// Files larger than this are uploaded in parts of this size, a single PUT is limited to 5 GiB
+const multipartPartSize = 64 << 20
+
+const s3Service = "S3"
+
+// S3Config configures the client of an S3-compatible object store
+type S3Config struct {
+	Endpoint        string // e.g. http://minio:9000, https://s3.<region>.amazonaws.com when empty
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool // bucket in the path instead of the host name, as MinIO expects
+}
+
+// S3 reads and writes the objects of an S3-compatible object store, such as AWS S3 or MinIO
+type S3 struct {
+	endpoint    *url.URL
+	pathStyle   bool
+	credentials credentials
+	client      *http.Client
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: must be an http or https URL", cfg.Endpoint)
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("the S3 access key ID and secret access key are required")
+	}
+	return &S3{
+		endpoint:  endpoint,
+		pathStyle: cfg.PathStyle,
+		credentials: credentials{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			region:          cfg.Region,
+		},
+		client: &http.Client{},
+	}, nil
+}
+
+// ObjectURL returns the URL of the object, which is only readable without credentials if the
+// bucket allows it
+func (s *S3) ObjectURL(bucket string, key string) string {
+	return s.objectURL(bucket, key).String()
+}
+
+// PresignGet returns a URL any HTTP client, such as ffprobe, can read the object from until expires has passed
+func (s *S3) PresignGet(bucket string, key string, expires time.Duration) string {
+	return s.credentials.presign(s.objectURL(bucket, key), expires, time.Now()).String()
+}
+
+// Download writes the object to the local file path, through a temporary file so path is never left half written
+func (s *S3) Download(ctx context.Context, bucket string, key string, path string) error {
+	res, err := s.do(ctx, http.MethodGet, bucket, key, nil, nil, unsignedPayload, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".download"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, res.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to download s3://%s/%s: %w", bucket, key, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Upload stores the local file at path as the object, in several parts if it is large
+func (s *S3) Upload(ctx context.Context, path string, bucket string, key string, contentType string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() <= multipartPartSize {
+		header := http.Header{"Content-Type": {contentType}}
+		res, err := s.do(ctx, http.MethodPut, bucket, key, nil, header, unsignedPayload, io.NewSectionReader(f, 0, info.Size()))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+	return s.uploadMultipart(ctx, f, info.Size(), bucket, key, contentType)
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// uploadMultipart uploads the file part by part, aborting the upload if a part fails so the store
+// does not keep the parts already sent
+func (s *S3) uploadMultipart(ctx context.Context, f *os.File, size int64, bucket string, key string, contentType string) (err error) {
+	header := http.Header{"Content-Type": {contentType}}
+	res, err := s.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, header, sha256Hex(nil), nil)
+	if err != nil {
+		return err
+	}
+	var initiated initiateMultipartUploadResult
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("failed to start the multipart upload of s3://%s/%s: %v", bucket, key, err)
+	}
+	uploadID := url.Values{"uploadId": {initiated.UploadID}}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Not tied to ctx, which may be what stopped the upload
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if res, abortErr := s.do(abortCtx, http.MethodDelete, bucket, key, uploadID, nil, sha256Hex(nil), nil); abortErr != nil {
+			slog.WarnContext(ctx, "Failed to abort multipart upload", "bucket", bucket, "key", key, "error", abortErr)
+		} else {
+			res.Body.Close()
+		}
+	}()
+
+	var completed completeMultipartUpload
+	for offset, partNumber := int64(0), 1; offset < size; offset, partNumber = offset+multipartPartSize, partNumber+1 {
+		length := size - offset
+		if length > multipartPartSize {
+			length = multipartPartSize
+		}
+		query := url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {initiated.UploadID}}
+		res, err := s.do(ctx, http.MethodPut, bucket, key, query, nil, unsignedPayload, io.NewSectionReader(f, offset, length))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		completed.Parts = append(completed.Parts, completedPart{PartNumber: partNumber, ETag: res.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return err
+	}
+	res, err = s.do(ctx, http.MethodPost, bucket, key, uploadID, nil, sha256Hex(body), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// The store may report a failure in the body of a 200 response
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("failed to complete the multipart upload of s3://%s/%s: %s: %s", bucket, key, result.Code, result.Message)
+	}
+	return nil
+}
+
+// CheckBucket makes sure the bucket exists and the credentials may use it
+func (s *S3) CheckBucket(ctx context.Context, bucket string) error {
+	res, err := s.do(ctx, http.MethodHead, bucket, "", nil, nil, sha256Hex(nil), nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object, or the bucket when key is empty. Responses other than
+// 2xx are returned as a *retry.StatusError, after logging the error reported by the store.
+func (s *S3) do(ctx context.Context, method string, bucket string, key string, query url.Values, header http.Header, payloadHash string, body io.Reader) (*http.Response, error) {
+	u := s.objectURL(bucket, key)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if section, ok := body.(*io.SectionReader); ok {
+		req.ContentLength = section.Size()
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.credentials.sign(req, payloadHash, time.Now())
+
+	span := tracing.StartRequest(req, "S3 "+method)
+	res, err := s.client.Do(req)
+	span.EndRequest(res, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&s3Err)
+		slog.ErrorContext(ctx, "Unexpected status code from S3", "method", method, "bucket", bucket, "key", key,
+			"status_code", res.StatusCode, "code", s3Err.Code, "message", s3Err.Message)
+		return nil, retry.NewStatusError(s3Service, res)
+	}
+	return res, nil
+}
+
+// objectURL returns the URL of the object, or of the bucket when key is empty
+func (s *S3) objectURL(bucket string, key string) *url.URL {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		path += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = path + "/" + key
+	if key == "" && s.pathStyle {
+		u.Path = path
+	}
+	u.RawPath = canonicalURI(&u)
+	return &u
+}
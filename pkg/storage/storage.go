@@ -0,0 +1,219 @@
+// Package storage moves the inputs and outputs of the jobs between the local disk, where the pipeline
+// works on them, and where they are kept: the local directories of the tenants, or the buckets of an
+// S3-compatible object store. Objects of the store are named with s3://bucket/key URIs.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const s3Scheme = "s3://"
+
+// How long the presigned URL used to probe an input stays valid
+const probeURLExpiry = 15 * time.Minute
+
+// ErrInputNotAllowed is returned for s3:// inputs that cannot or may not be read
+var ErrInputNotAllowed = errors.New("input not allowed")
+
+// Object is a file kept by a backend
+type Object struct {
+	Location string // s3://bucket/key, or the path of a local file
+	URL      string // URL of the object in the store, empty for local files
+}
+
+// Backend keeps the outputs of the jobs
+type Backend interface {
+	// Put stores the local file at path under key and returns where it is kept.
+	// The local file may be moved, or left in place.
+	Put(ctx context.Context, path string, key string) (Object, error)
+}
+
+// Local keeps the outputs in a local directory
+type Local struct {
+	Root string
+}
+
+// Put moves the file to key under the root, leaving it alone if it is already there
+func (l Local) Put(ctx context.Context, path string, key string) (Object, error) {
+	dest := filepath.Join(l.Root, filepath.FromSlash(key))
+	if filepath.Clean(path) == dest {
+		return Object{Location: dest}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return Object{}, err
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return Object{}, err
+	}
+	return Object{Location: dest}, nil
+}
+
+// Bucket keeps the outputs under a prefix of an S3 bucket
+type Bucket struct {
+	S3     *S3
+	Name   string
+	Prefix string
+}
+
+// Put uploads the file to the prefix and key, the local file is left in place
+func (b Bucket) Put(ctx context.Context, filePath string, key string) (Object, error) {
+	key = path.Join(b.Prefix, key)
+	if err := b.S3.Upload(ctx, filePath, b.Name, key, contentType(filePath)); err != nil {
+		return Object{}, err
+	}
+	return Object{Location: s3Scheme + b.Name + "/" + key, URL: b.S3.ObjectURL(b.Name, key)}, nil
+}
+
+// IsS3URI reports whether the input names an object of the store rather than a local file
+func IsS3URI(uri string) bool {
+	return strings.HasPrefix(uri, s3Scheme)
+}
+
+// ParseS3URI splits s3://bucket/key into the bucket and the key
+func ParseS3URI(uri string) (bucket string, key string, err error) {
+	if !IsS3URI(uri) {
+		return "", "", fmt.Errorf("%q is not an s3:// URI", uri)
+	}
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(uri, s3Scheme), "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("%q must be s3://bucket/key", uri)
+	}
+	return bucket, key, nil
+}
+
+// Storage reads the s3:// inputs of the jobs and keeps their outputs. A nil Storage only knows the
+// local directories of the tenants.
+type Storage struct {
+	s3           *S3
+	inputBuckets map[string]bool // buckets s3:// inputs may be read from
+	output       *Bucket         // nil when the outputs stay in the output root of their tenant
+}
+
+// New creates the storage. inputBuckets lists the buckets s3:// inputs may be read from; output is
+// s3://bucket/prefix, or empty to keep the outputs in the output root of their tenant. s3 may be nil
+// if neither is used.
+func New(s3 *S3, inputBuckets []string, output string) (*Storage, error) {
+	s := &Storage{s3: s3, inputBuckets: make(map[string]bool)}
+	for _, bucket := range inputBuckets {
+		s.inputBuckets[bucket] = true
+	}
+	if s3 == nil && (len(inputBuckets) > 0 || output != "") {
+		return nil, errors.New("the S3 endpoint and credentials are required to use buckets")
+	}
+
+	if output != "" {
+		if !IsS3URI(output) {
+			return nil, fmt.Errorf("output %q must be s3://bucket or s3://bucket/prefix", output)
+		}
+		name, prefix, _ := strings.Cut(strings.TrimPrefix(output, s3Scheme), "/")
+		if name == "" {
+			return nil, fmt.Errorf("output %q must be s3://bucket or s3://bucket/prefix", output)
+		}
+		s.output = &Bucket{S3: s3, Name: name, Prefix: strings.Trim(prefix, "/")}
+	}
+	return s, nil
+}
+
+// CheckInput returns ErrInputNotAllowed unless the s3:// input may be read by a tenant whose inputs
+// must be under one of the s3://bucket/prefix locations of prefixes
+func (s *Storage) CheckInput(uri string, prefixes []string) error {
+	bucket, key, err := ParseS3URI(uri)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInputNotAllowed, err)
+	}
+	if s == nil || s.s3 == nil {
+		return fmt.Errorf("%w: s3:// inputs are not enabled", ErrInputNotAllowed)
+	}
+	if !s.inputBuckets[bucket] {
+		return fmt.Errorf("%w: bucket %q is not an input bucket", ErrInputNotAllowed, bucket)
+	}
+	if !underPrefix(prefixes, bucket, key) {
+		return fmt.Errorf("%w: %s is not under the input prefixes of the tenant", ErrInputNotAllowed, uri)
+	}
+	return nil
+}
+
+// underPrefix reports whether the object is under one of the s3://bucket/prefix locations. Keys
+// with empty, . or .. segments are refused, some stores resolve them to other keys.
+func underPrefix(prefixes []string, bucket string, key string) bool {
+	if path.Clean("/"+key) != "/"+key {
+		return false
+	}
+	for _, location := range prefixes {
+		if !IsS3URI(location) {
+			continue
+		}
+		name, prefix, _ := strings.Cut(strings.TrimPrefix(location, s3Scheme), "/")
+		prefix = strings.Trim(prefix, "/")
+		if name == bucket && (prefix == "" || strings.HasPrefix(key, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch downloads the s3:// input, which must be under one of the prefixes, to the local file path
+func (s *Storage) Fetch(ctx context.Context, uri string, prefixes []string, path string) error {
+	if err := s.CheckInput(uri, prefixes); err != nil {
+		return err
+	}
+	bucket, key, _ := ParseS3URI(uri)
+	return s.s3.Download(ctx, bucket, key, path)
+}
+
+// ProbeURL returns what ffprobe can read the input from: a presigned URL for s3:// inputs under one
+// of the prefixes, the input itself otherwise
+func (s *Storage) ProbeURL(input string, prefixes []string) string {
+	if !IsS3URI(input) || s.CheckInput(input, prefixes) != nil {
+		return input
+	}
+	bucket, key, _ := ParseS3URI(input)
+	return s.s3.PresignGet(bucket, key, probeURLExpiry)
+}
+
+// Outputs returns where the outputs of a tenant are kept: under the tenant's ID in the output
+// bucket, or in its output root
+func (s *Storage) Outputs(tenantID string, outputRoot string) Backend {
+	if s == nil || s.output == nil {
+		return Local{Root: filepath.Clean(outputRoot)}
+	}
+	bucket := *s.output
+	bucket.Prefix = path.Join(bucket.Prefix, tenantID)
+	return bucket
+}
+
+// Check makes sure the output bucket can be used, it does nothing when the outputs are local
+func (s *Storage) Check(ctx context.Context) error {
+	if s == nil || s.output == nil {
+		return nil
+	}
+	return s.s3.CheckBucket(ctx, s.output.Name)
+}
+
+// Description tells where the outputs are kept, for the logs and the readiness check
+func (s *Storage) Description() string {
+	if s == nil || s.output == nil {
+		return "output roots of the tenants"
+	}
+	return s3Scheme + path.Join(s.output.Name, s.output.Prefix)
+}
+
+// contentType guesses the type of the object from its extension
+func contentType(filePath string) string {
+	if t := mime.TypeByExtension(filepath.Ext(filePath)); t != "" {
+		return t
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".srt":
+		return "application/x-subrip"
+	}
+	return "application/octet-stream"
+}
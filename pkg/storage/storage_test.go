@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckInput(t *testing.T) {
+	store := &Storage{s3: &S3{}, inputBuckets: map[string]bool{"videos": true, "shared": true}}
+	acme := []string{"s3://videos/acme", "s3://shared"}
+
+	tests := []struct {
+		name     string
+		uri      string
+		prefixes []string
+		wantErr  bool
+	}{
+		{"under the tenant prefix", "s3://videos/acme/lecture.mp4", acme, false},
+		{"in a subfolder of the prefix", "s3://videos/acme/2024/lecture.mp4", acme, false},
+		{"whole bucket", "s3://shared/any/lecture.mp4", acme, false},
+		{"key of another tenant", "s3://videos/globex/lecture.mp4", acme, true},
+		{"prefix is not a path segment", "s3://videos/acme-corp/lecture.mp4", acme, true},
+		{"dot dot segment", "s3://videos/acme/../globex/lecture.mp4", acme, true},
+		{"dot segment", "s3://videos/acme/./lecture.mp4", acme, true},
+		{"empty segment", "s3://videos/acme//lecture.mp4", acme, true},
+		{"bucket not an input bucket", "s3://private/acme/lecture.mp4", []string{"s3://private/acme"}, true},
+		{"tenant without prefixes", "s3://videos/acme/lecture.mp4", nil, true},
+		{"not a key", "s3://videos", acme, true},
+		{"local path", "/videos/acme/lecture.mp4", acme, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.CheckInput(tt.uri, tt.prefixes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckInput(%q) = %v, want error %v", tt.uri, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInputNotAllowed) {
+				t.Errorf("CheckInput(%q) = %v, want ErrInputNotAllowed", tt.uri, err)
+			}
+		})
+	}
+}
+
+func TestCheckInputWithoutS3(t *testing.T) {
+	var store *Storage
+	if err := store.CheckInput("s3://videos/acme/lecture.mp4", []string{"s3://videos"}); !errors.Is(err, ErrInputNotAllowed) {
+		t.Errorf("CheckInput = %v, want ErrInputNotAllowed when s3:// inputs are not enabled", err)
+	}
+}
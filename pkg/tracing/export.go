@@ -0,0 +1,211 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a batch of spans may take to export
+const exportTimeout = 10 * time.Second
+
+// Exporter sends finished spans of the service somewhere
+type Exporter interface {
+	Export(ctx context.Context, service string, spans []SpanData) error
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector with OTLP/HTTP, JSON encoded
+type OTLPExporter struct {
+	endpoint string // e.g. http://collector:4318/v1/traces
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewOTLPExporter creates an exporter posting to endpoint, the full URL of the traces receiver,
+// with the extra headers (e.g. for authentication)
+func NewOTLPExporter(endpoint string, headers map[string]string) *OTLPExporter {
+	return &OTLPExporter{endpoint: endpoint, headers: headers, client: &http.Client{Timeout: exportTimeout}}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, service string, spans []SpanData) error {
+	body, err := json.Marshal(newExportRequest(service, spans))
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ParseHeaders reads headers written as in OTEL_EXPORTER_OTLP_HEADERS: "name1=value1,name2=value2"
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("header %q is not of the form name=value", pair)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// FileExporter appends spans to a file, one OTLP/JSON export request per line, for offline use.
+// The file can be replayed to a collector or read with the collector's file receiver.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter opens (or creates) the file the spans are appended to
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(ctx context.Context, service string, spans []SpanData) error {
+	line, err := json.Marshal(newExportRequest(service, spans))
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file, call it after the provider is shut down
+func (e *FileExporter) Close() error {
+	return e.file.Close()
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              SpanKind   `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            jsonStatus `json:"status"`
+}
+
+type jsonStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // 64-bit integers are strings in OTLP/JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newExportRequest(service string, spans []SpanData) exportRequest {
+	encoded := make([]jsonSpan, len(spans))
+	for i, span := range spans {
+		encoded[i] = jsonSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(span.Attributes),
+			Status:            jsonStatus{Code: span.StatusCode, Message: span.StatusMessage},
+		}
+		if span.ParentSpanID.IsValid() {
+			encoded[i].ParentSpanID = span.ParentSpanID.String()
+		}
+	}
+
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: encodeAttributes([]Attribute{String("service.name", service)})},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "videoUploadAndProcessing"}, Spans: encoded}},
+	}}}
+}
+
+func encodeAttributes(attrs []Attribute) []keyValue {
+	encoded := make([]keyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		var value anyValue
+		switch v := attr.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, keyValue{Key: attr.Key, Value: value})
+	}
+	return encoded
+}
@@ -0,0 +1,406 @@
+// Package tracing records spans of the processing pipeline and exports them in the OpenTelemetry
+// (OTLP) format, to a collector or to a local file. Trace context is propagated with the W3C
+// traceparent header. Until Init is called, Start returns nil spans and nothing is recorded;
+// every method of *Span is safe to call on nil.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceParentHeader carries the trace context of a request, see https://www.w3.org/TR/trace-context/
+const TraceParentHeader = "traceparent"
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id SpanID) IsValid() bool   { return id != SpanID{} }
+
+// SpanKind tells whether a span is work done in the service or a call to another one, as in OTLP
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindClient   SpanKind = 3
+)
+
+// StatusCode is the outcome of a span, as in OTLP
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key/value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{} // string, int64, float64 or bool
+}
+
+func String(key string, value string) Attribute    { return Attribute{key, value} }
+func Int(key string, value int) Attribute          { return Attribute{key, int64(value)} }
+func Strings(key string, value []string) Attribute { return Attribute{key, strings.Join(value, " ")} }
+
+// SpanData is a finished span as handed to the exporters
+type SpanData struct {
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentSpanID  SpanID // zero for the root span of a trace
+	Name          string
+	Kind          SpanKind
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	StatusCode    StatusCode
+	StatusMessage string
+}
+
+// Span is an operation being timed. It is exported when End is called.
+type Span struct {
+	provider *Provider
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// RecordError marks the span as failed with err, a nil err is ignored
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.StatusCode = StatusError
+	s.data.StatusMessage = err.Error()
+}
+
+// End finishes the span and queues it for export. Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	s.provider.enqueue(data)
+}
+
+// TraceParent returns the traceparent header value identifying the span, or "" for a nil span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return formatTraceParent(s.data.TraceID, s.data.SpanID)
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// remoteParent is the trace context of a span recorded elsewhere, e.g. by an earlier run of a job
+type remoteParent struct {
+	traceID TraceID
+	spanID  SpanID
+}
+
+// Start begins a span, child of the span in ctx if there is one. The returned context carries the
+// new span so the spans started with it become its children. The span is nil when tracing is off.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	return start(ctx, name, KindInternal, attrs)
+}
+
+func start(ctx context.Context, name string, kind SpanKind, attrs []Attribute) (context.Context, *Span) {
+	p := global.Load()
+	if p == nil {
+		return ctx, nil
+	}
+
+	span := &Span{provider: p, data: SpanData{
+		SpanID:     newSpanID(),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: attrs,
+	}}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentSpanID = parent.data.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(remoteParent); ok {
+		span.data.TraceID = remote.traceID
+		span.data.ParentSpanID = remote.spanID
+	} else {
+		span.data.TraceID = newTraceID()
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// TraceParent returns the traceparent header value of the span in ctx, or of the trace ctx continues,
+// or "" if there is none
+func TraceParent(ctx context.Context) string {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok && span != nil {
+		return span.TraceParent()
+	}
+	if remote, ok := ctx.Value(remoteKey{}).(remoteParent); ok {
+		return formatTraceParent(remote.traceID, remote.spanID)
+	}
+	return ""
+}
+
+// IDs returns the trace and span IDs of the span in ctx, or empty strings if there is none
+func IDs(ctx context.Context) (traceID string, spanID string) {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok && span != nil {
+		return span.data.TraceID.String(), span.data.SpanID.String()
+	}
+	return "", ""
+}
+
+// ContextWithTraceParent returns a copy of ctx whose spans continue the trace of the traceparent
+// header value. An empty or invalid value leaves ctx as it is.
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	traceID, spanID, ok := parseTraceParent(traceParent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, remoteParent{traceID: traceID, spanID: spanID})
+}
+
+// StartRequest begins a client span for the outgoing request, child of the span in the request
+// context, and sets the traceparent header so the receiver can continue the trace
+func StartRequest(req *http.Request, name string) *Span {
+	_, span := start(req.Context(), name, KindClient, []Attribute{
+		String("http.request.method", req.Method),
+		String("url.full", redactURL(req)),
+		String("server.address", req.URL.Hostname()),
+	})
+	if span != nil {
+		req.Header.Set(TraceParentHeader, span.TraceParent())
+	}
+	return span
+}
+
+// EndRequest records the response status, or the error when there is no response, and ends the span
+func (s *Span) EndRequest(resp *http.Response, err error) {
+	if s == nil {
+		return
+	}
+	if resp != nil {
+		s.SetAttributes(Int("http.response.status_code", resp.StatusCode))
+		if err == nil && resp.StatusCode >= 400 {
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+		}
+	}
+	s.RecordError(err)
+	s.End()
+}
+
+// redactURL drops the query string and credentials, which may hold secrets, from the request URL
+func redactURL(req *http.Request) string {
+	return redact(req.URL)
+}
+
+// RedactURL drops the query string and credentials, which may hold secrets such as the signature
+// of a presigned URL, from s when it is an absolute URL. Other strings are returned unchanged.
+func RedactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s
+	}
+	return redact(u)
+}
+
+func redact(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = ""
+	redacted.Fragment = ""
+	return redacted.String()
+}
+
+func formatTraceParent(traceID TraceID, spanID SpanID) string {
+	return "00-" + traceID.String() + "-" + spanID.String() + "-01"
+}
+
+// parseTraceParent reads the trace and parent span IDs of a traceparent header value. The flags
+// must be well formed but are otherwise ignored, every trace is recorded. Versions after 00 may
+// append fields, which are skipped.
+func parseTraceParent(value string) (TraceID, SpanID, bool) {
+	var traceID TraceID
+	var spanID SpanID
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, spanID, false
+	}
+	var header [2]byte
+	if _, err := hex.Decode(header[:], []byte(parts[0]+parts[3])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, traceID.IsValid() && spanID.IsValid()
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// Size of the queue of finished spans; spans ending while it is full are dropped
+const maxQueuedSpans = 4096
+
+// Spans are exported in batches of up to this many, at least every exportInterval
+const (
+	maxExportBatch = 512
+	exportInterval = 5 * time.Second
+)
+
+// Provider batches finished spans and hands them to the exporters in the background
+type Provider struct {
+	service   string
+	exporters []Exporter
+	dropped   atomic.Int64
+	done      chan struct{}
+
+	mu     sync.RWMutex
+	queue  chan SpanData
+	closed bool
+}
+
+var global atomic.Pointer[Provider]
+
+// Init starts recording spans of the service and exporting them. Call Shutdown before exiting
+// so the last spans are exported.
+func Init(service string, exporters ...Exporter) *Provider {
+	p := &Provider{
+		service:   service,
+		exporters: exporters,
+		queue:     make(chan SpanData, maxQueuedSpans),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	global.Store(p)
+	return p
+}
+
+// Shutdown stops recording spans and exports the ones still queued, giving up when ctx is done
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	global.CompareAndSwap(p, nil)
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Provider) enqueue(span SpanData) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	// The provider may have been shut down while the span was running
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- span:
+	default:
+		if p.dropped.Add(1)%1000 == 1 {
+			slog.Warn("Span queue is full, dropping spans", "dropped", p.dropped.Load())
+		}
+	}
+}
+
+func (p *Provider) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, maxExportBatch)
+	for {
+		select {
+		case span, ok := <-p.queue:
+			if !ok {
+				p.export(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < maxExportBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		p.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (p *Provider) export(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	for _, exporter := range p.exporters {
+		if err := exporter.Export(ctx, p.service, batch); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+const DefaultQueueCapacity = 100 // 工作佇列的預設容量
+
+// Without any finished job to learn from, assume a job takes this long
+const defaultEstimatedJobDuration = 5 * time.Minute
+
+// How many recent job durations are used to estimate Retry-After
+const observedDurationWindow = 50
+
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrClientLimit = errors.New("too many unfinished jobs for this client")
+	ErrDraining    = errors.New("service is shutting down")
+)
+
+// Clients rejected while draining should come back once the replacement instance is up
+const drainingRetryAfter = 30 * time.Second
+
+// AdmissionError is returned when a submission is rejected instead of queued
+type AdmissionError struct {
+	Err        error
+	StatusCode int           // 503 when the queue is full, 429 when the client or tenant is over its limit
+	RetryAfter time.Duration // estimated wait before the submission may succeed
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", e.Err, e.RetryAfter)
+}
+
+func (e *AdmissionError) Unwrap() error { return e.Err }
+
+// AdmissionController decides whether a new job may be queued, so HTTP handlers never block on a full queue.
+// It rejects submissions when the queue is full or the client already has too many unfinished jobs,
+// and estimates when to come back from the queue depth and recent job durations.
+type AdmissionController struct {
+	queue          chan Job
+	registry       *jobs.Registry
+	quotas         *Quotas // its wait lists hold queued jobs too, may be nil
+	workers        int
+	perClientLimit int // 每個客戶端未完成工作的上限，0 代表不限制
+	draining       atomic.Bool
+
+	mu        sync.Mutex
+	durations []time.Duration // most recent job durations, oldest first
+}
+
+func NewAdmissionController(queue chan Job, registry *jobs.Registry, quotas *Quotas, workers int, perClientLimit int) *AdmissionController {
+	if workers < 1 {
+		workers = 1
+	}
+	return &AdmissionController{
+		queue:          queue,
+		registry:       registry,
+		quotas:         quotas,
+		workers:        workers,
+		perClientLimit: perClientLimit,
+	}
+}
+
+// Admit checks whether the client may submit a job right now
+func (a *AdmissionController) Admit(clientID string) error {
+	return a.AdmitBatch(clientID, 1)
+}
+
+// AdmitBatch checks whether the client may submit n jobs at once right now
+func (a *AdmissionController) AdmitBatch(clientID string, n int) error {
+	if a == nil {
+		return nil
+	}
+
+	if a.draining.Load() {
+		return &AdmissionError{Err: ErrDraining, StatusCode: http.StatusServiceUnavailable, RetryAfter: drainingRetryAfter}
+	}
+
+	if a.QueueDepth()+n > cap(a.queue) {
+		return a.reject(ErrQueueFull, http.StatusServiceUnavailable)
+	}
+
+	if a.perClientLimit > 0 && a.registry.ActiveJobsForClient(clientID)+n > a.perClientLimit {
+		return a.reject(ErrClientLimit, http.StatusTooManyRequests)
+	}
+	return nil
+}
+
+// QueueDepth returns how many jobs are waiting to be run: in the queue, or for a slot of their tenant
+func (a *AdmissionController) QueueDepth() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.queue) + a.quotas.Waiting()
+}
+
+// StopAdmitting rejects every submission from now on, used when the service drains before shutting down
+func (a *AdmissionController) StopAdmitting() {
+	if a != nil {
+		a.draining.Store(true)
+	}
+}
+
+// QueueFull builds the error returned when the queue filled up between Admit and the enqueue
+func (a *AdmissionController) QueueFull() error {
+	return a.reject(ErrQueueFull, http.StatusServiceUnavailable)
+}
+
+// ObserveDuration records how long a finished job took, to refine the Retry-After estimate
+func (a *AdmissionController) ObserveDuration(duration time.Duration) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.durations = append(a.durations, duration)
+	if len(a.durations) > observedDurationWindow {
+		a.durations = a.durations[len(a.durations)-observedDurationWindow:]
+	}
+}
+
+// EstimatedWait estimates how long a new job waits before a worker picks it up
+func (a *AdmissionController) EstimatedWait() time.Duration {
+	average := defaultEstimatedJobDuration
+	if a != nil {
+		a.mu.Lock()
+		if len(a.durations) > 0 {
+			var total time.Duration
+			for _, d := range a.durations {
+				total += d
+			}
+			average = total / time.Duration(len(a.durations))
+		}
+		a.mu.Unlock()
+	}
+
+	depth, workers := 0, 1
+	if a != nil {
+		depth, workers = a.QueueDepth(), a.workers
+	}
+
+	// Every worker drains one job per average duration; a new job waits for the jobs ahead of it
+	rounds := math.Ceil(float64(depth+1) / float64(workers))
+	wait := time.Duration(rounds) * average
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+	return wait
+}
+
+func (a *AdmissionController) reject(err error, statusCode int) *AdmissionError {
+	return &AdmissionError{Err: err, StatusCode: statusCode, RetryAfter: a.EstimatedWait()}
+}
+
+// writeAdmissionError responds to a rejected submission with its status code and a Retry-After header
+func writeAdmissionError(w http.ResponseWriter, err *AdmissionError) {
+	seconds := int(math.Ceil(err.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, err.Error(), err.StatusCode)
+}
+
+// clientID identifies the submitter for the per-client limit and deduplication: the authenticated
+// tenant and the API key it used, or the remote address when the request is not authenticated.
+// Headers sent by the client are not trusted, they would let it pick its own limit.
+func clientID(r *http.Request) string {
+	if tenant, ok := auth.FromContext(r.Context()); ok {
+		if key := auth.KeyID(r); key != "" {
+			return tenant.ID + "/" + key
+		}
+		return tenant.ID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,65 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/tracing"
+	"videoUploadAndProcessing/pkg/webhook"
+)
+
+var errNoCallbackURL = errors.New("job has no callback URL")
+
+// @Schema
+// description: Payload POSTed to the callback URL once a job is done, failed or cancelled
+type CallbackPayload struct {
+	// @Field example:3f2a9c0d1b7e4a56 description:"ID of the job"
+	JobID string `json:"job_id"`
+	// @Field example:done description:"Terminal state of the job: done, failed or cancelled"
+	Status jobs.State `json:"status"`
+	// @Field example:/home/shared/processed_videos/lecture_processed.mp4 description:"Output video, only when done"
+	ProcessedVideoPath string `json:"processed_video_path,omitempty"`
+	// @Field example:https://videos.s3.us-east-1.amazonaws.com/dubbed/acme/lecture_3f2a9c0d1b7e4a56_processed.mp4 description:"URL of the output video, only when done and kept in an object store"
+	ProcessedVideoURL string `json:"processed_video_url,omitempty"`
+	// @Field description:"Error code, failing stage, segment index and message, only when failed"
+	Error *jobs.Failure `json:"error,omitempty"`
+	// @Field description:"When the job reached its terminal state"
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// NewCallbackPayload builds the callback payload of a finished job
+func NewCallbackPayload(status jobs.Status) CallbackPayload {
+	return CallbackPayload{
+		JobID:              status.ID,
+		Status:             status.State,
+		ProcessedVideoPath: status.ProcessedFilePath,
+		ProcessedVideoURL:  status.ProcessedFileURL,
+		Error:              status.Failure,
+		FinishedAt:         status.FinishedAt,
+	}
+}
+
+// SendCallback hands the callback of a job that reached a terminal state to the webhook dispatcher,
+// which signs it, retries it and records it in the delivery log.
+// It is registered with Registry.OnFinished so every done, failed and cancelled job is reported.
+func SendCallback(webhooks *webhook.Dispatcher, status jobs.Status) (webhook.Delivery, error) {
+	if status.CallbackURL == "" {
+		return webhook.Delivery{}, errNoCallbackURL
+	}
+
+	ctx := tracing.ContextWithTraceParent(context.Background(), status.TraceParent)
+	delivery, err := webhooks.Deliver(ctx, status.ID, callbackEvent(status.State), status.CallbackURL, NewCallbackPayload(status))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send callback", "job_id", status.ID, "error", err)
+		return webhook.Delivery{}, err
+	}
+	slog.InfoContext(ctx, "Callback queued", "job_id", status.ID, "delivery_id", delivery.ID)
+	return delivery, nil
+}
+
+// callbackEvent names the webhook event of a terminal state, e.g. job.done
+func callbackEvent(state jobs.State) string {
+	return "job." + string(state)
+}
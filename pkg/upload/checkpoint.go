@@ -0,0 +1,172 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"videoUploadAndProcessing/pkg/tracing"
+)
+
+const checkpointFileName = "checkpoint.json"
+
+// checkpointStage names a step of ProcessJob whose outputs are kept on disk
+type checkpointStage string
+
+const (
+	stageInputFetched   checkpointStage = "input_fetched"
+	stageAudioExtracted checkpointStage = "audio_extracted"
+	stageTranscribed    checkpointStage = "transcribed"
+	stageSubtitled      checkpointStage = "subtitles_created"
+	stageSplit          checkpointStage = "video_split"
+	stageDubbed         checkpointStage = "segments_dubbed"
+	stageMerged         checkpointStage = "segments_merged"
+	stageUploaded       checkpointStage = "output_uploaded"
+)
+
+// checkpoint records the outputs of every completed stage of a job inside its temp directory,
+// so a failed or interrupted job can resume from the last completed stage instead of starting over
+type checkpoint struct {
+	mu      sync.Mutex
+	path    string
+	started time.Time     // when the stage in progress started, for the stage duration metric
+	span    *tracing.Span // span of the stage in progress
+
+	CompletedStages   []checkpointStage `json:"completed_stages"`
+	InputPath         string            `json:"input_path,omitempty"` // local copy of an s3:// input
+	AudioPath         string            `json:"audio_path,omitempty"`
+	WhisperPath       string            `json:"whisper_path,omitempty"`
+	SRTPath           string            `json:"srt_path,omitempty"`
+	VideoDuration     float64           `json:"video_duration,omitempty"`
+	AllSegmentPaths   []string          `json:"all_segment_paths,omitempty"`
+	VoiceSegmentPaths []string          `json:"voice_segment_paths,omitempty"`
+	DubbedSegments    map[int]string    `json:"dubbed_segments,omitempty"` // voice segment index -> dubbed segment path
+	MergedSegments    []string          `json:"merged_segments,omitempty"`
+	OutputVideo       string            `json:"output_video,omitempty"`
+	OutputLocation    string            `json:"output_location,omitempty"` // where the output video is kept
+	OutputURL         string            `json:"output_url,omitempty"`      // URL of the output video in the object store
+}
+
+// loadCheckpoint reads the checkpoint stored in tempDirPrefix, or returns an empty one
+func loadCheckpoint(tempDirPrefix string) (*checkpoint, error) {
+	cp := &checkpoint{
+		path:           filepath.Join(tempDirPrefix, checkpointFileName),
+		DubbedSegments: make(map[int]string),
+	}
+
+	data, err := os.ReadFile(cp.path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %v", cp.path, err)
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint %s: %v", cp.path, err)
+	}
+	if cp.DubbedSegments == nil {
+		cp.DubbedSegments = make(map[int]string)
+	}
+	return cp, nil
+}
+
+// completed reports whether the stage finished in this or an earlier run
+func (c *checkpoint) completed(stage checkpointStage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.CompletedStages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// startStage starts timing and tracing a stage, it returns the context to run the stage with
+func (c *checkpoint) startStage(ctx context.Context, stage checkpointStage) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = time.Now()
+	ctx, c.span = tracing.Start(ctx, string(stage))
+	return ctx
+}
+
+// abortStage ends the span of a stage that did not complete with the error that stopped it
+func (c *checkpoint) abortStage(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.span != nil {
+		c.span.RecordError(err)
+		c.span.End()
+		c.span = nil
+	}
+}
+
+// complete records the outputs of a stage through record and saves the checkpoint
+func (c *checkpoint) complete(stage checkpointStage, record func()) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stageDuration.Observe(time.Since(c.started).Seconds(), string(stage))
+	c.span.End()
+	c.span = nil
+	record()
+	c.CompletedStages = append(c.CompletedStages, stage)
+	return c.save()
+}
+
+// dubbedSegment returns the dubbed segment of an earlier run, if there is one
+func (c *checkpoint) dubbedSegment(voiceIdx int) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	segmentPath, ok := c.DubbedSegments[voiceIdx]
+	return segmentPath, ok
+}
+
+// markSegmentDubbed records a finished segment; called concurrently by the segment workers
+func (c *checkpoint) markSegmentDubbed(voiceIdx int, segmentPath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.DubbedSegments[voiceIdx] = segmentPath
+	return c.save()
+}
+
+// save writes the checkpoint atomically. The caller must hold c.mu.
+func (c *checkpoint) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+
+	tempPath := c.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := os.Rename(tempPath, c.path); err != nil {
+		return fmt.Errorf("failed to replace checkpoint: %v", err)
+	}
+	return nil
+}
+
+// saveJSON writes v to filePath as JSON, used to keep API responses that are expensive to recreate
+func saveJSON(filePath string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", filePath, err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", filePath, err)
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+// loadJSON reads a file written by saveJSON into v
+func loadJSON(filePath string, v interface{}) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,146 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/storage"
+	"videoUploadAndProcessing/pkg/whisper_api"
+)
+
+// IdempotencyKeyHeader lets a client retry a submission safely: every submission of the same client
+// carrying the same key returns the job created by the first one instead of queueing a new one
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+// DefaultVoice is the Acapela voice the segments are dubbed with unless another one is configured
+const DefaultVoice = "Ryan22k_NT"
+
+var errInvalidIdempotencyKey = errors.New("invalid Idempotency-Key header")
+
+// ProcessingOptions are the settings that change the output of a job besides its input video.
+// They are part of the content hash, so videos processed with other options are not deduplicated.
+type ProcessingOptions struct {
+	Voice     string `json:"voice"`
+	Language  string `json:"language,omitempty"`  // 影片語音的語言，空字串代表 whisper_api.DefaultLanguage
+	Subtitles string `json:"subtitles,omitempty"` // 字幕的處理方式，空字串代表 SubtitlesBurn
+}
+
+// How the subtitles of a job are delivered
+const (
+	SubtitlesBurn = "burn" // rendered into the video
+	SubtitlesFile = "srt"  // written to an SRT file next to the video, see SubtitleFilePath
+	SubtitlesBoth = "both" // rendered into the video and written to an SRT file
+	SubtitlesNone = "none" // left out
+)
+
+// Validate checks the subtitle mode and the language, which must be an ISO 639-1 code such as "en"
+func (o ProcessingOptions) Validate() error {
+	switch o.Subtitles {
+	case "", SubtitlesBurn, SubtitlesFile, SubtitlesBoth, SubtitlesNone:
+	default:
+		return fmt.Errorf("invalid subtitles %q: must be %s, %s, %s or %s", o.Subtitles, SubtitlesBurn, SubtitlesFile, SubtitlesBoth, SubtitlesNone)
+	}
+	if o.Language != "" && !isLanguageCode(o.Language) {
+		return fmt.Errorf("invalid language %q: must be a two letter ISO 639-1 code such as %q", o.Language, whisper_api.DefaultLanguage)
+	}
+	return nil
+}
+
+// burnSubtitles reports whether the subtitles are rendered into the dubbed segments
+func (o ProcessingOptions) burnSubtitles() bool {
+	return o.Subtitles == "" || o.Subtitles == SubtitlesBurn || o.Subtitles == SubtitlesBoth
+}
+
+// writeSubtitleFile reports whether an SRT file is written next to the output video
+func (o ProcessingOptions) writeSubtitleFile() bool {
+	return o.Subtitles == SubtitlesFile || o.Subtitles == SubtitlesBoth
+}
+
+func isLanguageCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// processingOptions returns the options the worker processes a job with, the fields set in overrides
+// taking precedence over the worker's settings
+func (w Worker) processingOptions(overrides ProcessingOptions) ProcessingOptions {
+	options := overrides
+	if options.Voice == "" {
+		options.Voice = w.Voice
+	}
+	if options.Voice == "" {
+		options.Voice = DefaultVoice
+	}
+	return options
+}
+
+// jobOptions returns the processing options given to the job when it was submitted
+func jobOptions(status jobs.Status) ProcessingOptions {
+	return ProcessingOptions{Voice: status.Voice, Language: status.Language, Subtitles: status.Subtitles}
+}
+
+// idempotencyKey returns the Idempotency-Key header of the request, which may be empty
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("%w: longer than %d characters", errInvalidIdempotencyKey, maxIdempotencyKeyLength)
+	}
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return "", fmt.Errorf("%w: only printable ASCII characters are allowed", errInvalidIdempotencyKey)
+		}
+	}
+	return key, nil
+}
+
+// hashContent sets the content hash of the submission when the worker deduplicates submissions.
+// Objects of the store are not downloaded before the job runs, so they are not hashed.
+func hashContent(worker Worker, template *jobs.Status) {
+	if !worker.Deduplicate || template.ContentHash != "" || storage.IsS3URI(template.UnprocessedFilePath) {
+		return
+	}
+	hash, err := contentHash(template.UnprocessedFilePath, worker.processingOptions(jobOptions(*template)))
+	if err != nil {
+		// The job fails later with a proper error if the video cannot be read
+		slog.Warn("Failed to hash video, not deduplicating it", "path", template.UnprocessedFilePath, "error", err)
+		return
+	}
+	template.ContentHash = hash
+}
+
+// contentHash identifies what a job produces: the SHA-256 of the input video followed by the processing options
+func contentHash(videoPath string, options ProcessingOptions) (string, error) {
+	f, err := os.Open(videoPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", videoPath, err)
+	}
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	h.Write([]byte{0})
+	h.Write(encodedOptions)
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package upload
+
+import (
+	"errors"
+	"runtime"
+)
+
+// freeDiskSpace is not implemented on this platform, the disk space check always fails
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space cannot be checked on " + runtime.GOOS)
+}
@@ -0,0 +1,190 @@
+package upload
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+const DefaultShutdownGracePeriod = 5 * time.Minute // 關機時等待執行中工作完成的預設時間
+
+// How long interrupted workers get to kill their ffmpeg processes and record their checkpoint
+const interruptTimeout = 30 * time.Second
+
+// @Schema
+// description: Drain status of the service
+type DrainStatus struct {
+	// @Field example:true description:"Whether the service stopped accepting new jobs"
+	Draining bool `json:"draining"`
+	// @Field description:"When draining started"
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// @Field description:"When running jobs are interrupted if they have not finished"
+	GraceDeadline *time.Time `json:"grace_deadline,omitempty"`
+	// @Field example:3 description:"Jobs still being processed"
+	RunningJobs int `json:"running_jobs"`
+	// @Field example:12 description:"Jobs left in the queue, they are resumed after the restart"
+	QueuedJobs int `json:"queued_jobs"`
+	// @Field example:0 description:"Jobs interrupted at the end of the grace period, they are resumed after the restart"
+	InterruptedJobs int `json:"interrupted_jobs"`
+}
+
+// Drainer coordinates a graceful shutdown. Once draining, no new job is admitted or picked up by a worker,
+// running jobs get a grace period to finish, and the rest stay in the job store to be resumed on startup.
+type Drainer struct {
+	registry  *jobs.Registry
+	admission *AdmissionController // stops admitting, and knows how many jobs are still queued
+	quit      chan struct{}        // closed when draining starts
+	workers   sync.WaitGroup
+
+	mu          sync.Mutex
+	startedAt   time.Time
+	deadline    time.Time
+	interrupted int
+}
+
+func NewDrainer(registry *jobs.Registry, admission *AdmissionController) *Drainer {
+	return &Drainer{
+		registry:  registry,
+		admission: admission,
+		quit:      make(chan struct{}),
+	}
+}
+
+// Quit is closed once draining starts. A nil Drainer never drains.
+func (d *Drainer) Quit() <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.quit
+}
+
+// Draining reports whether the service stopped accepting new jobs
+func (d *Drainer) Draining() bool {
+	select {
+	case <-d.Quit():
+		return true
+	default:
+		return false
+	}
+}
+
+// Start stops admitting and starting jobs. Running jobs may keep going until the grace period is over.
+// Calling it again has no effect.
+func (d *Drainer) Start(grace time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.Draining() {
+		return
+	}
+	d.startedAt = time.Now()
+	d.deadline = d.startedAt.Add(grace)
+	d.admission.StopAdmitting()
+	close(d.quit)
+	slog.Info("Draining: no new jobs are accepted", "running_jobs", d.registry.Running(), "deadline", d.deadline.Format(time.RFC3339))
+}
+
+// Drain starts draining if needed and waits for the workers to finish their running jobs.
+// Jobs still running at the end of the grace period are interrupted without being marked as finished,
+// so they are requeued on the next startup and resume from their checkpoint.
+func (d *Drainer) Drain(grace time.Duration) {
+	d.Start(grace)
+
+	d.mu.Lock()
+	remaining := time.Until(d.deadline)
+	d.mu.Unlock()
+
+	if d.waitWorkers(remaining) {
+		slog.Info("Drained: all running jobs finished", "queued_jobs", d.admission.QueueDepth())
+		return
+	}
+
+	interrupted := d.registry.InterruptRunning()
+	d.mu.Lock()
+	d.interrupted = interrupted
+	d.mu.Unlock()
+	slog.Warn("Grace period over, interrupted running jobs, they will resume after the restart", "interrupted_jobs", interrupted)
+
+	if !d.waitWorkers(interruptTimeout) {
+		slog.Warn("Some workers did not stop after being interrupted", "timeout", interruptTimeout.String())
+	}
+}
+
+// Status reports the drain progress
+func (d *Drainer) Status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := DrainStatus{
+		Draining:        d.Draining(),
+		RunningJobs:     d.registry.Running(),
+		QueuedJobs:      d.admission.QueueDepth(),
+		InterruptedJobs: d.interrupted,
+	}
+	if status.Draining {
+		startedAt, deadline := d.startedAt, d.deadline
+		status.StartedAt = &startedAt
+		status.GraceDeadline = &deadline
+	}
+	return status
+}
+
+// waitWorkers reports whether every worker stopped within the timeout
+func (d *Drainer) waitWorkers(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (d *Drainer) workerStarted() {
+	if d != nil {
+		d.workers.Add(1)
+	}
+}
+
+func (d *Drainer) workerStopped() {
+	if d != nil {
+		d.workers.Done()
+	}
+}
+
+// @Summary Drain status
+// @Description Reports whether the service is draining and how many jobs are still running or queued.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} DrainStatus "Drain status"
+// @Router /admin/drain [get]
+
+// @Summary Start draining
+// @Description Stops accepting and starting new jobs, e.g. before a deploy. Running jobs keep going.
+// @Tags admin
+// @Produce json
+// @Success 202 {object} DrainStatus "Drain status"
+// @Failure 405 {object} string "Method Not Allowed"
+// @Router /admin/drain [post]
+
+// HandleDrain is the HTTP handler for GET and POST /admin/drain
+func HandleDrain(w http.ResponseWriter, r *http.Request, drainer *Drainer, grace time.Duration) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, drainer.Status())
+	case http.MethodPost:
+		drainer.Start(grace)
+		writeJSON(w, http.StatusAccepted, drainer.Status())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,456 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/storage"
+	"videoUploadAndProcessing/pkg/tracing"
+	"videoUploadAndProcessing/pkg/webhook"
+)
+
+// Upper bound of the number of videos in a single batch
+const maxBatchSize = 500
+
+// Files matched when a directory is submitted without a glob
+const defaultBatchGlob = "*.mp4"
+
+// Videos of a batch probed or hashed at the same time
+const batchPrepareConcurrency = 8
+
+const batchCompleteEvent = "batch.complete"
+
+// @Schema
+// description: Batch submission payload, either a list of paths or a directory with a glob
+type BatchRequest struct {
+	// @Field example:["/home/shared/unprocessed_videos/course/01.mp4"] description:"Videos to process, paths or s3://bucket/key objects of the input buckets"
+	VideoPaths []string `json:"video_paths"`
+	// @Field example:/home/shared/unprocessed_videos/course description:"Directory under the tenant's input root to process"
+	Directory string `json:"directory"`
+	// @Field example:*.mp4 description:"File name pattern matched in the directory, *.mp4 by default"
+	Glob string `json:"glob"`
+	// @Field example:false description:"Also match files in the subdirectories"
+	Recursive bool `json:"recursive"`
+	// @Field example:http://callback.url/job description:"Callback URL of every job"
+	CallbackURL string `json:"callback_url"`
+	// @Field example:http://callback.url/batch description:"Callback URL notified once every job of the batch has finished"
+	BatchCallbackURL string `json:"batch_callback_url"`
+}
+
+// @Schema
+// description: Aggregate progress of a batch
+type BatchStatus struct {
+	// @Field example:9c1d2e3f4a5b6c7d description:"ID of the batch"
+	BatchID string `json:"batch_id"`
+	// @Field example:running description:"running until every job has finished, then complete"
+	State string `json:"state"`
+	// @Field example:12 description:"Number of jobs in the batch"
+	Total int `json:"total"`
+	// @Field example:5 description:"Jobs that are done, failed or cancelled"
+	Finished  int `json:"finished"`
+	Done      int `json:"done"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+	// @Field example:41.7 description:"Percentage of finished jobs"
+	Progress float64 `json:"progress"`
+	// @Field description:"Number of jobs in every state"
+	StateCounts map[jobs.State]int `json:"state_counts"`
+	// @Field description:"Status of every job"
+	Jobs []jobs.Status `json:"jobs"`
+	// @Field description:"Existing jobs returned for the submitted videos that duplicate them (same content with deduplication on), they are not part of the batch"
+	Duplicates []jobs.Status `json:"duplicates,omitempty"`
+}
+
+// @Schema
+// description: Payload POSTed to the batch callback URL once every job of the batch has finished
+type BatchCallbackPayload struct {
+	BatchID   string            `json:"batch_id"`
+	Status    string            `json:"status"`
+	Total     int               `json:"total"`
+	Done      int               `json:"done"`
+	Failed    int               `json:"failed"`
+	Cancelled int               `json:"cancelled"`
+	Jobs      []CallbackPayload `json:"jobs"`
+}
+
+// @Summary Submit a batch of videos
+// @Description Creates one job per video under a shared batch ID, from a list of paths or a directory under the tenant's input root and a glob.
+// @Tags batches
+// @Accept json
+// @Produce json
+// @Param Idempotency-Key header string false "Submissions of the same client with the same key return the first batch"
+// @Param request body BatchRequest true "Batch payload"
+// @Success 200 {object} BatchStatus "Successfully queued, or the existing batch"
+// @Failure 400 {object} string "Bad Request"
+// @Failure 405 {object} string "Method Not Allowed"
+// @Failure 429 {object} string "Too many unfinished jobs for this client"
+// @Failure 503 {object} string "Job queue is full"
+// @Router /batches [post]
+
+// @Summary Query batch progress
+// @Description Returns the aggregate progress of a batch and the status of its jobs.
+// @Tags batches
+// @Produce json
+// @Param id path string true "Batch ID"
+// @Success 200 {object} BatchStatus "Batch progress"
+// @Failure 404 {object} string "Not Found"
+// @Router /batches/{id} [get]
+
+// HandleBatches is the HTTP handler for POST /batches and GET /batches/{id}
+func HandleBatches(w http.ResponseWriter, r *http.Request, worker Worker) {
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	batchID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/batches"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && batchID == "":
+		submitBatch(w, r, worker, tenant)
+	case r.Method == http.MethodGet && batchID != "":
+		batch := tenantJobs(tenant, worker.Registry.Batch(batchID))
+		if len(batch) == 0 {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, newBatchStatus(batchID, batch))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func submitBatch(w http.ResponseWriter, r *http.Request, worker Worker, tenant auth.Tenant) {
+	client := clientID(r)
+	key, err := idempotencyKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if batchID, ok := submittedBatch(worker, tenant, client, key); ok {
+		writeJSON(w, http.StatusOK, newBatchStatus(batchID, tenantJobs(tenant, worker.Registry.Batch(batchID))))
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("error decoding JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	paths, err := resolveBatchPaths(worker.Storage, tenant, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateCallbackURL(worker, req.BatchCallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check the tenant's Whisper API key before queueing
+	if tenant.WhisperAPIKey == "" {
+		http.Error(w, errNoWhisperAPIKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	batchID, err := jobs.NewBatchID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create batch: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	templates := make([]jobs.Status, len(paths))
+	for i, path := range paths {
+		templates[i] = jobs.Status{
+			FileName:            filepath.Base(path),
+			UnprocessedFilePath: path,
+			CallbackURL:         req.CallbackURL,
+			ClientID:            client,
+			TenantID:            tenant.ID,
+			BatchID:             batchID,
+			BatchCallbackURL:    req.BatchCallbackURL,
+			IdempotencyKey:      key,
+		}
+	}
+
+	submission, err := registerBatch(worker, tenant, templates, client)
+	if err != nil {
+		writeSubmitError(w, client, err)
+		return
+	}
+	if submission.existingBatchID != "" {
+		writeJSON(w, http.StatusOK, newBatchStatus(submission.existingBatchID, tenantJobs(tenant, worker.Registry.Batch(submission.existingBatchID))))
+		return
+	}
+	slog.Info("Batch queued", "batch_id", batchID, "jobs", len(submission.jobs), "duplicates", len(submission.duplicates))
+	status := newBatchStatus(batchID, tenantJobs(tenant, worker.Registry.Batch(batchID)))
+	status.Duplicates = submission.duplicates
+	writeJSON(w, http.StatusOK, status)
+}
+
+// batchSubmission is what registerBatch made of the videos of a batch
+type batchSubmission struct {
+	jobs            []jobs.Status // jobs created for the batch
+	duplicates      []jobs.Status // existing jobs returned for the videos that duplicate them
+	existingBatchID string        // batch created meanwhile by a submission with the same idempotency key
+}
+
+// registerBatch registers every job of the batch before queueing any of them, so the batch is
+// never seen as complete while some of its jobs have yet to be created. Like registerJob, videos
+// duplicating an existing job (same idempotency key, or same content when Deduplicate is set) get
+// that job instead of a new one.
+func registerBatch(worker Worker, tenant auth.Tenant, templates []jobs.Status, clientID string) (batchSubmission, error) {
+	var submission batchSubmission
+	for _, template := range templates {
+		if err := validateCallbackURL(worker, template.CallbackURL); err != nil {
+			return submission, err
+		}
+	}
+	prepareBatch(worker, tenant, templates)
+
+	// Videos duplicating the content of an existing job do not take a place in the queue, the
+	// idempotency key is checked once the submission holds the tenant's lock
+	fresh := make([]jobs.Status, 0, len(templates))
+	videoSeconds := 0.0
+	for _, template := range templates {
+		content := template
+		content.IdempotencyKey = ""
+		if existing, ok := worker.Registry.FindDuplicate(content); ok {
+			submission.duplicates = append(submission.duplicates, existing)
+			continue
+		}
+		fresh = append(fresh, template)
+		videoSeconds += template.VideoSeconds
+	}
+	if len(fresh) == 0 {
+		return submission, nil
+	}
+
+	err := worker.Quotas.Reserve(tenant, len(fresh), videoSeconds, func() error {
+		// The submissions of the tenant are serialized here, one with the same key may have just created its batch
+		if batchID, ok := submittedBatch(worker, tenant, clientID, fresh[0].IdempotencyKey); ok {
+			submission.existingBatchID = batchID
+			return nil
+		}
+		if err := worker.Admission.AdmitBatch(clientID, len(fresh)); err != nil {
+			return err
+		}
+		for _, template := range fresh {
+			status, created, err := worker.Registry.CreateUnique(template)
+			if err != nil {
+				// Jobs created so far are cancelled so the batch still completes
+				for _, job := range submission.jobs {
+					worker.Registry.Cancel(job.ID)
+				}
+				return fmt.Errorf("failed to register job: %v", err)
+			}
+			if !created {
+				submission.duplicates = append(submission.duplicates, status)
+				continue
+			}
+			submission.jobs = append(submission.jobs, status)
+		}
+		return nil
+	})
+	if err != nil {
+		return batchSubmission{}, err
+	}
+
+	// A job that does not fit in the queue anymore is marked as failed, the others keep going
+	for _, status := range submission.jobs {
+		if err := tryEnqueueJob(worker, status, tenant); err != nil {
+			// The batch was accepted, the job is reported as failed with the others
+			slog.Error("Job of batch could not be queued", "batch_id", status.BatchID, "job_id", status.ID, "error", err)
+			worker.Registry.Fail(status.ID, &jobs.Error{Code: jobs.ErrorCodeQueueFull, Err: err})
+		}
+	}
+	return submission, nil
+}
+
+// submittedBatch returns the batch the client already submitted with the idempotency key. Every
+// job of a batch carries its key, any of them leads back to the batch.
+func submittedBatch(worker Worker, tenant auth.Tenant, clientID string, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	existing, ok := worker.Registry.FindDuplicate(jobs.Status{ClientID: clientID, TenantID: tenant.ID, IdempotencyKey: key})
+	if !ok || existing.BatchID == "" {
+		return "", false
+	}
+	return existing.BatchID, true
+}
+
+// prepareBatch probes the duration of the videos of the batch when the tenant has a video minutes
+// quota, and hashes their content when the worker deduplicates submissions, a few videos at a time
+func prepareBatch(worker Worker, tenant auth.Tenant, templates []jobs.Status) {
+	probe := tenant.Limits.VideoMinutesPerDay > 0
+	if !probe && !worker.Deduplicate {
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, batchPrepareConcurrency)
+	for i := range templates {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(template *jobs.Status) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if probe {
+				template.VideoSeconds = probeVideoSeconds(tenant, worker.Storage, template.UnprocessedFilePath)
+			}
+			hashContent(worker, template)
+		}(&templates[i])
+	}
+	wg.Wait()
+}
+
+// resolveBatchPaths lists the videos of the batch, all of them under the input root or the S3 input
+// prefixes of the tenant
+func resolveBatchPaths(store *storage.Storage, tenant auth.Tenant, req BatchRequest) ([]string, error) {
+	if len(req.VideoPaths) > 0 && req.Directory != "" {
+		return nil, errors.New("specify either video_paths or directory, not both")
+	}
+
+	var paths []string
+	switch {
+	case len(req.VideoPaths) > 0:
+		for _, path := range req.VideoPaths {
+			if err := checkInputPath(store, tenant, path); err != nil {
+				return nil, err
+			}
+			paths = append(paths, path)
+		}
+	case req.Directory != "":
+		if !underRoot(tenant.InputRoot, req.Directory) {
+			return nil, errors.New("invalid directory prefix")
+		}
+		glob := req.Glob
+		if glob == "" {
+			glob = defaultBatchGlob
+		}
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+
+		var err error
+		paths, err = globVideos(req.Directory, glob, req.Recursive)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("video_paths or directory is required")
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("no video matched")
+	}
+	if len(paths) > maxBatchSize {
+		return nil, fmt.Errorf("a batch may contain at most %d videos, got %d", maxBatchSize, len(paths))
+	}
+	return paths, nil
+}
+
+// globVideos lists the regular files of dir whose name matches glob, in lexical order
+func globVideos(dir string, glob string, recursive bool) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if matched, _ := filepath.Match(glob, entry.Name()); matched {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+	return paths, nil
+}
+
+func newBatchStatus(batchID string, batch []jobs.Status) BatchStatus {
+	status := BatchStatus{
+		BatchID:     batchID,
+		State:       "running",
+		Total:       len(batch),
+		StateCounts: make(map[jobs.State]int),
+		Jobs:        batch,
+	}
+	for _, job := range batch {
+		status.StateCounts[job.State]++
+		switch job.State {
+		case jobs.StateDone:
+			status.Done++
+		case jobs.StateFailed:
+			status.Failed++
+		case jobs.StateCancelled:
+			status.Cancelled++
+		}
+	}
+	status.Finished = status.Done + status.Failed + status.Cancelled
+	if status.Total > 0 {
+		status.Progress = float64(status.Finished) * 100 / float64(status.Total)
+	}
+	if status.Finished == status.Total {
+		status.State = "complete"
+	}
+	return status
+}
+
+// SendBatchCallback notifies the batch callback URL once the last job of the batch has finished.
+// It is registered with Registry.OnFinished next to SendCallback.
+func SendBatchCallback(webhooks *webhook.Dispatcher, registry *jobs.Registry, finished jobs.Status) {
+	if finished.BatchID == "" || finished.BatchCallbackURL == "" {
+		return
+	}
+
+	status := newBatchStatus(finished.BatchID, registry.Batch(finished.BatchID))
+	if status.State != "complete" {
+		return
+	}
+
+	payload := BatchCallbackPayload{
+		BatchID:   status.BatchID,
+		Status:    status.State,
+		Total:     status.Total,
+		Done:      status.Done,
+		Failed:    status.Failed,
+		Cancelled: status.Cancelled,
+	}
+	for _, job := range status.Jobs {
+		payload.Jobs = append(payload.Jobs, NewCallbackPayload(job))
+	}
+
+	// The last jobs of a batch may finish at the same moment, only one of them sends the callback.
+	// It continues the trace of the job that completed the batch.
+	ctx := tracing.ContextWithTraceParent(context.Background(), finished.TraceParent)
+	delivery, sent, err := webhooks.DeliverOnce(ctx, status.BatchID, batchCompleteEvent, finished.BatchCallbackURL, payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send callback of batch", "batch_id", status.BatchID, "error", err)
+		return
+	}
+	if sent {
+		slog.InfoContext(ctx, "Callback of batch queued", "batch_id", status.BatchID, "delivery_id", delivery.ID)
+	}
+}
@@ -0,0 +1,85 @@
+package upload
+
+import (
+	"testing"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+func batchWorker(queueSize int) Worker {
+	registry := jobs.NewRegistry()
+	quotas := NewQuotas(registry)
+	queue := make(chan Job, queueSize)
+	return Worker{
+		JobQueue:    queue,
+		Registry:    registry,
+		Admission:   NewAdmissionController(queue, registry, quotas, 1, 0),
+		Quotas:      quotas,
+		Deduplicate: true,
+	}
+}
+
+func batchTemplates(batchID, key string, hashes ...string) []jobs.Status {
+	templates := make([]jobs.Status, len(hashes))
+	for i, hash := range hashes {
+		templates[i] = jobs.Status{
+			TenantID:       "acme",
+			ClientID:       "c",
+			BatchID:        batchID,
+			IdempotencyKey: key,
+			FileName:       hash + ".mp4",
+			ContentHash:    hash,
+		}
+	}
+	return templates
+}
+
+func TestRegisterBatchDeduplicates(t *testing.T) {
+	worker := batchWorker(10)
+	tenant := testTenant("acme", auth.Limits{})
+	existing, err := worker.Registry.Create(jobs.Status{TenantID: "acme", ContentHash: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	submission, err := registerBatch(worker, tenant, batchTemplates("b1", "k", "a", "b", "c"), "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submission.jobs) != 2 || len(worker.JobQueue) != 2 {
+		t.Errorf("%d jobs created and %d queued, want the 2 new videos", len(submission.jobs), len(worker.JobQueue))
+	}
+	if len(submission.duplicates) != 1 || submission.duplicates[0].ID != existing.ID {
+		t.Errorf("duplicates = %v, want the existing job of the same content", submission.duplicates)
+	}
+	if batch := worker.Registry.Batch("b1"); len(batch) != 2 {
+		t.Errorf("batch has %d jobs, want 2", len(batch))
+	}
+
+	// The same Idempotency-Key leads back to the batch, whatever videos are submitted again
+	replayed, err := registerBatch(worker, tenant, batchTemplates("b2", "k", "d"), "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.existingBatchID != "b1" || len(replayed.jobs) != 0 {
+		t.Errorf("replayed batch = %+v, want b1 without new jobs", replayed)
+	}
+	if len(worker.JobQueue) != 2 {
+		t.Errorf("%d jobs queued after the replay, want 2", len(worker.JobQueue))
+	}
+}
+
+func TestRegisterBatchWithoutDeduplication(t *testing.T) {
+	worker := batchWorker(10)
+	worker.Deduplicate = false
+	tenant := testTenant("acme", auth.Limits{})
+
+	// Templates of a worker not deduplicating have no content hash
+	submission, err := registerBatch(worker, tenant, batchTemplates("b1", "", "", ""), "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submission.jobs) != 2 || len(submission.duplicates) != 0 {
+		t.Errorf("%d jobs and %d duplicates, want 2 jobs", len(submission.jobs), len(submission.duplicates))
+	}
+}
@@ -0,0 +1,94 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/events"
+)
+
+// Comment lines sent while a job makes no progress, so proxies keep the connection open
+const eventsHeartbeatInterval = 15 * time.Second
+
+// @Summary Stream job progress
+// @Description Server-Sent Events stream of the job's progress: state changes, dubbed segments and ffmpeg percent complete.
+// @Description Past events are replayed first; send Last-Event-ID to resume after a reconnect. The stream ends when the job finishes.
+// @Tags jobs
+// @Produce text/event-stream
+// @Param id path string true "Job ID"
+// @Param Last-Event-ID header int false "Only replay events after this id"
+// @Success 200 {object} events.Event "Stream of events"
+// @Failure 404 {object} string "Not Found"
+// @Router /jobs/{id}/events [get]
+
+// streamJobEvents serves GET /jobs/{id}/events
+func streamJobEvents(w http.ResponseWriter, r *http.Request, jobID string, worker Worker, tenant auth.Tenant) {
+	if _, ok := getJob(worker, tenant, jobID); !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || worker.Events == nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	afterID, _ := strconv.Atoi(lastEventID)
+
+	replay, live, cancel, ok := worker.Events.Subscribe(jobID, afterID)
+	defer cancel()
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range replay {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-live:
+			if !ok {
+				// The job finished, or this client fell behind and should reconnect with Last-Event-ID
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event events.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode event", "job_id", event.JobID, "error", err)
+		return
+	}
+	if event.ID > 0 {
+		fmt.Fprintf(w, "id: %d\n", event.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
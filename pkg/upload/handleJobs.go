@@ -0,0 +1,214 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+// @Schema
+// description: List of the jobs of the tenant
+type JobListResponse struct {
+	Jobs []jobs.Status `json:"jobs"`
+}
+
+// @Summary Query job status
+// @Description Lists the tenant's jobs, or returns the state, timestamps and output path of a single job.
+// @Tags jobs
+// @Produce json
+// @Param id path string false "Job ID"
+// @Success 200 {object} jobs.Status "Job status"
+// @Success 200 {object} JobListResponse "Jobs of the tenant"
+// @Failure 404 {object} string "Not Found"
+// @Failure 405 {object} string "Method Not Allowed"
+// @Router /jobs/{id} [get]
+// @Router /jobs [get]
+
+// @Summary Cancel a job
+// @Description Cancels a queued or running job, killing its ffmpeg processes and aborting its API calls.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} jobs.Status "Cancelled job"
+// @Failure 404 {object} string "Not Found"
+// @Failure 409 {object} string "Job already finished"
+// @Router /jobs/{id} [delete]
+
+// @Summary Retry a failed job
+// @Description Queues a failed job again. It resumes from the last stage that completed before the failure.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} jobs.Status "Requeued job"
+// @Failure 404 {object} string "Not Found"
+// @Failure 409 {object} string "Job has not failed"
+// @Failure 429 {object} string "Too many unfinished jobs for this client"
+// @Failure 503 {object} string "Job queue is full"
+// @Router /jobs/{id}/retry [post]
+
+// @Summary Redeliver a job's callback
+// @Description Sends the callback of a finished job again, as a new signed and retried delivery.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 202 {object} webhook.Delivery "Pending delivery"
+// @Failure 404 {object} string "Not Found"
+// @Failure 409 {object} string "Job has not finished or has no callback URL"
+// @Router /jobs/{id}/callback [post]
+
+// @Summary List a job's callback deliveries
+// @Description Lists every callback delivery of the job with the outcome of each attempt.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} DeliveryListResponse "Deliveries"
+// @Failure 404 {object} string "Not Found"
+// @Router /jobs/{id}/deliveries [get]
+
+// HandleJobs is the HTTP handler for GET /jobs, GET /jobs/{id}, DELETE /jobs/{id}, POST /jobs/{id}/retry,
+// POST /jobs/{id}/callback, GET /jobs/{id}/deliveries and GET /jobs/{id}/events.
+// Only the jobs of the authenticated tenant are visible, the others are reported as not found.
+func HandleJobs(w http.ResponseWriter, r *http.Request, worker Worker) {
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	// The path is /jobs, /jobs/{id} or /jobs/{id}/{action}
+	jobID, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/")
+
+	switch {
+	case action == "retry" && r.Method == http.MethodPost:
+		retryJob(w, jobID, worker, tenant)
+		return
+	case action == "callback" && r.Method == http.MethodPost:
+		redeliverCallback(w, jobID, worker, tenant)
+		return
+	case action == "events" && r.Method == http.MethodGet:
+		streamJobEvents(w, r, jobID, worker, tenant)
+		return
+	case action == "deliveries" && r.Method == http.MethodGet:
+		if _, ok := getJob(worker, tenant, jobID); !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, DeliveryListResponse{Deliveries: worker.Webhooks.List(jobID)})
+		return
+	case action != "":
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case r.Method == http.MethodDelete && jobID != "":
+		cancelJob(w, jobID, worker, tenant)
+		return
+	case r.Method != http.MethodGet:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if jobID == "" {
+		writeJSON(w, http.StatusOK, JobListResponse{Jobs: tenantJobs(tenant, worker.Registry.List())})
+		return
+	}
+
+	status, ok := getJob(worker, tenant, jobID)
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func cancelJob(w http.ResponseWriter, jobID string, worker Worker, tenant auth.Tenant) {
+	if _, ok := getJob(worker, tenant, jobID); !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	status, err := worker.Registry.Cancel(jobID)
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+	case errors.Is(err, jobs.ErrJobFinished):
+		http.Error(w, fmt.Sprintf("Job already %s", status.State), http.StatusConflict)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to cancel job: %v", err), http.StatusInternalServerError)
+	default:
+		slog.Info("Job cancelled by request", "job_id", jobID)
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+func retryJob(w http.ResponseWriter, jobID string, worker Worker, tenant auth.Tenant) {
+	// Check the tenant's Whisper API key before queueing
+	if tenant.WhisperAPIKey == "" {
+		http.Error(w, errNoWhisperAPIKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	current, ok := getJob(worker, tenant, jobID)
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	var admissionErr *AdmissionError
+	if err := worker.Admission.Admit(current.ClientID); errors.As(err, &admissionErr) {
+		writeAdmissionError(w, admissionErr)
+		return
+	}
+
+	status, err := worker.Registry.Retry(jobID)
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+	case errors.Is(err, jobs.ErrJobNotFailed):
+		http.Error(w, fmt.Sprintf("Job is %s, only failed jobs can be retried", status.State), http.StatusConflict)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to retry job: %v", err), http.StatusInternalServerError)
+	default:
+		if err := tryEnqueueJob(worker, status, tenant); err != nil {
+			// The client is told to retry later, the job keeps the failure it had
+			worker.Registry.RevertRetry(current)
+			writeSubmitError(w, status.ClientID, err)
+			return
+		}
+		slog.Info("Job requeued by request", "job_id", jobID)
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+func redeliverCallback(w http.ResponseWriter, jobID string, worker Worker, tenant auth.Tenant) {
+	status, ok := getJob(worker, tenant, jobID)
+	switch {
+	case !ok:
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	case !status.State.Terminal():
+		http.Error(w, fmt.Sprintf("Job is %s, callbacks are only sent for finished jobs", status.State), http.StatusConflict)
+		return
+	case status.CallbackURL == "":
+		http.Error(w, "Job has no callback URL", http.StatusConflict)
+		return
+	}
+
+	delivery, err := SendCallback(worker.Webhooks, status)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to redeliver callback: %v", err), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Callback redelivered by request", "job_id", jobID, "delivery_id", delivery.ID)
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,238 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+// DefaultMaxUploadSize caps the size of a video sent directly to the service (10 GiB)
+const DefaultMaxUploadSize int64 = 10 << 30
+
+const maxCallbackURLLength = 4096
+
+var errInvalidUpload = errors.New("invalid upload")
+
+// @Summary Upload a video file for processing
+// @Description Streams a video to the service, either as multipart/form-data (field "video") or as a raw request body, stores it and triggers its processing.
+// @Tags video
+// @Accept mpfd
+// @Accept octet-stream
+// @Produce json
+// @Param Idempotency-Key header string false "Submissions of the same client with the same key return the first job"
+// @Param video formData file false "Video file (multipart upload)"
+// @Param callback_url formData string false "Callback URL for job status (multipart upload)"
+// @Param filename query string false "File name of the video (raw upload)"
+// @Param callback_url query string false "Callback URL for job status"
+// @Success 200 {object} UploadResponse "Successfully queued, or the existing job of a duplicate"
+// @Failure 400 {object} string "Bad Request"
+// @Failure 405 {object} string "Method Not Allowed"
+// @Failure 413 {object} string "Video too large"
+// @Failure 429 {object} string "Too many unfinished jobs for this client"
+// @Failure 503 {object} string "Job queue is full"
+// @Router /video-upload [post]
+
+// HandleStreamUpload is the HTTP handler for videos sent in the request body.
+// The body is streamed to disk so the video is never held in memory.
+func HandleStreamUpload(w http.ResponseWriter, r *http.Request, worker Worker) {
+	// Check if the HTTP method is POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	// Check the tenant's Whisper API key before accepting the body
+	if tenant.WhisperAPIKey == "" {
+		http.Error(w, errNoWhisperAPIKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A retried submission gets its job back without sending the video again
+	client := clientID(r)
+	key, err := idempotencyKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if existing, ok := worker.Registry.FindDuplicate(jobs.Status{ClientID: client, TenantID: tenant.ID, IdempotencyKey: key}); ok {
+		writeJSON(w, http.StatusOK, newUploadResponse(existing, false, ""))
+		return
+	}
+
+	// Reject early when the job could not be queued, before the client sends the whole video
+	var admissionErr *AdmissionError
+	if err := worker.Quotas.Admit(tenant, 1, 0); errors.As(err, &admissionErr) {
+		writeAdmissionError(w, admissionErr)
+		return
+	}
+	if err := worker.Admission.Admit(client); errors.As(err, &admissionErr) {
+		writeAdmissionError(w, admissionErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, worker.maxUploadSize())
+
+	uploadDir := tenant.UploadDir()
+	callbackURL := r.URL.Query().Get("callback_url")
+	if err := validateCallbackURL(worker, callbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var videoPath string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		videoPath, callbackURL, err = saveMultipartUpload(r, uploadDir, callbackURL)
+	} else {
+		videoPath, err = saveUploadedVideo(r.Body, uploadDir, r.URL.Query().Get("filename"))
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errInvalidUpload):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to store uploaded video", "error", err)
+		http.Error(w, "failed to store uploaded video", http.StatusInternalServerError)
+		return
+	}
+
+	fileName := filepath.Base(videoPath)
+
+	// Log details for debugging
+	slog.DebugContext(r.Context(), "Video uploaded", "path", videoPath, "file_name", fileName)
+
+	status, created, err := registerJob(worker, tenant, jobs.Status{
+		FileName:            fileName,
+		UnprocessedFilePath: videoPath,
+		CallbackURL:         callbackURL,
+		ClientID:            client,
+		TenantID:            tenant.ID,
+		IdempotencyKey:      key,
+	})
+	if err != nil || !created {
+		// The job was not queued, nothing will ever process the stored video
+		os.RemoveAll(filepath.Dir(videoPath))
+	}
+	if err != nil {
+		writeSubmitError(w, client, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newUploadResponse(status, created, "Video uploaded and queued for processing, please wait for callback."))
+}
+
+// saveMultipartUpload stores the "video" part of a multipart body and returns its path
+// together with the callback URL, which may be sent as a form field
+func saveMultipartUpload(r *http.Request, uploadDir string, callbackURL string) (string, string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", errInvalidUpload, err)
+	}
+
+	var videoPath string
+	cleanup := func() {
+		if videoPath != "" {
+			os.RemoveAll(filepath.Dir(videoPath))
+		}
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return "", "", fmt.Errorf("%w: error reading multipart body: %v", errInvalidUpload, err)
+		}
+
+		switch part.FormName() {
+		case "callback_url":
+			value, err := io.ReadAll(io.LimitReader(part, maxCallbackURLLength))
+			if err != nil {
+				part.Close()
+				cleanup()
+				return "", "", fmt.Errorf("%w: error reading callback_url: %v", errInvalidUpload, err)
+			}
+			callbackURL = string(value)
+		case "video":
+			if videoPath != "" {
+				part.Close()
+				cleanup()
+				return "", "", fmt.Errorf("%w: only one video may be uploaded per request", errInvalidUpload)
+			}
+			videoPath, err = saveUploadedVideo(part, uploadDir, part.FileName())
+			if err != nil {
+				part.Close()
+				return "", "", err
+			}
+		}
+		part.Close()
+	}
+
+	if videoPath == "" {
+		return "", "", fmt.Errorf("%w: missing \"video\" field", errInvalidUpload)
+	}
+	return videoPath, callbackURL, nil
+}
+
+// saveUploadedVideo copies src into a new directory under uploadDir and returns the stored path
+func saveUploadedVideo(src io.Reader, uploadDir string, fileName string) (string, error) {
+	fileName = filepath.Base(fileName)
+	if fileName == "." || fileName == string(filepath.Separator) {
+		return "", fmt.Errorf("%w: missing file name", errInvalidUpload)
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %v", err)
+	}
+
+	// Every upload gets its own directory so files with the same name don't collide
+	dir, err := os.MkdirTemp(uploadDir, "upload-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %v", err)
+	}
+
+	videoPath := filepath.Join(dir, fileName)
+	file, err := os.Create(videoPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to create %s: %v", videoPath, err)
+	}
+
+	written, err := io.Copy(file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	slog.Info("Stored uploaded video", "bytes", written, "path", videoPath)
+	return videoPath, nil
+}
+
+// maxUploadSize returns the size limit of uploaded videos in bytes
+func (w Worker) maxUploadSize() int64 {
+	if w.MaxUploadSize > 0 {
+		return w.MaxUploadSize
+	}
+	return DefaultMaxUploadSize
+}
@@ -2,33 +2,55 @@ package upload
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"path/filepath"
-	"strings"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/webhook"
 )
 
 // @Schema
 // description: Video path request payload
 // required: true
 type VideoPathRequest struct {
-	// @Field example:/path/to/video description:"Path to the video to be processed"
+	// @Field example:/path/to/video description:"Path to the video to be processed, or s3://bucket/key of an object in an input bucket"
 	VideoPathToBeProcessed string `json:"video_path_to_be_processed"`
 	// @Field example:http://callback.url description:"Callback URL for job status"
 	CallbackURL string `json:"callback_url"`
 }
 
+// @Schema
+// description: Response returned once a video has been queued
+type UploadResponse struct {
+	// @Field example:3f2a9c0d1b7e4a56 description:"ID used to query the job status"
+	JobID string `json:"job_id"`
+	// @Field example:queued description:"Current state of the job"
+	State jobs.State `json:"state"`
+	// @Field description:"Human readable message"
+	Message string `json:"message"`
+	// @Field example:true description:"The video had already been submitted, the existing job is returned"
+	Duplicate bool `json:"duplicate,omitempty"`
+	// @Field example:/home/shared/processed_videos/lecture_3f2a9c0d1b7e4a56_processed.mp4 description:"Output video of a duplicate that is already done"
+	ProcessedFilePath string `json:"processed_file_path,omitempty"`
+	// @Field description:"URL of the output video of a duplicate that is already done, when kept in an object store"
+	ProcessedFileURL string `json:"processed_file_url,omitempty"`
+}
+
 // @Summary Upload a new video for processing
 // @Description Uploads a video and triggers its processing.
 // @Tags video
 // @Accept json
 // @Produce json
+// @Param Idempotency-Key header string false "Submissions of the same client with the same key return the first job"
 // @Param request body VideoPathRequest true "Video upload payload"
-// @Success 200 {object} VideoPathRequest "Successfully uploaded"
-// @Failure 400 {object} string "Bad Request"
+// @Success 200 {object} UploadResponse "Successfully queued, or the existing job of a duplicate"
+// @Failure 400 {object} string "Bad Request or callback URL not allowed"
 // @Failure 405 {object} string "Method Not Allowed"
+// @Failure 429 {object} string "Too many unfinished jobs for this client"
+// @Failure 503 {object} string "Job queue is full"
 // @Router /new_uploaded [post]
 
 // HandleUpload is the HTTP handler for video uploads
@@ -39,20 +61,28 @@ func HandleUpload(w http.ResponseWriter, r *http.Request, worker Worker) {
 		return
 	}
 
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	key, err := idempotencyKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Decode the JSON payload from the incoming request
 	decoder := json.NewDecoder(r.Body)
 	var videoPathReq VideoPathRequest
-	err := decoder.Decode(&videoPathReq)
+	err = decoder.Decode(&videoPathReq)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error decoding JSON: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	prefix := os.Getenv("UNPROCESSED_VIDEO_PATH")
-
-	// Check if the path starts with the specified prefix
-	if !strings.HasPrefix(videoPathReq.VideoPathToBeProcessed, prefix) {
-		http.Error(w, "Invalid video path prefix", http.StatusBadRequest)
+	// Check if the path is inside the tenant's input root, or an object of an input bucket
+	if err := checkInputPath(worker.Storage, tenant, videoPathReq.VideoPathToBeProcessed); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -63,63 +93,149 @@ func HandleUpload(w http.ResponseWriter, r *http.Request, worker Worker) {
 	fileName := filepath.Base(unprocessedfilePath)
 
 	// Log details for debugging
-	log.Printf("FilePath: %s", unprocessedfilePath)
-	log.Printf("FileName: %s", fileName)
+	slog.DebugContext(r.Context(), "Video submitted", "path", unprocessedfilePath, "file_name", fileName)
+
+	// Check the tenant's Whisper API key before queueing
+	if tenant.WhisperAPIKey == "" {
+		http.Error(w, errNoWhisperAPIKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	submitJob(w, worker, tenant, jobs.Status{
+		FileName:            fileName,
+		UnprocessedFilePath: unprocessedfilePath,
+		CallbackURL:         videoPathReq.CallbackURL,
+		ClientID:            clientID(r),
+		TenantID:            tenant.ID,
+		IdempotencyKey:      key,
+	}, "Processing video at the specified path, please wait for callback.")
+}
 
-	// Retrieve API key from environment variables
-	apiKey := os.Getenv("WHISPER_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "WHISPER_API_KEY environment variable not set", http.StatusBadRequest)
+// submitJob registers the job, queues it for the workers and responds with its id
+func submitJob(w http.ResponseWriter, worker Worker, tenant auth.Tenant, template jobs.Status, message string) {
+	status, created, err := registerJob(worker, tenant, template)
+	if err != nil {
+		writeSubmitError(w, template.ClientID, err)
 		return
 	}
 
-	// Create a channel to receive a completion signal from the worker
-	done := make(chan bool)
+	// Send an HTTP OK status with the job id to indicate successful initiation
+	writeJSON(w, http.StatusOK, newUploadResponse(status, created, message))
+}
 
-	// Create a channel to receive the processed file path from the worker
-	processedFilePathChan := make(chan string)
+// newUploadResponse describes the job a submission was given, which is an existing job for duplicates
+func newUploadResponse(status jobs.Status, created bool, message string) UploadResponse {
+	if created {
+		return UploadResponse{JobID: status.ID, State: status.State, Message: message}
+	}
+	return UploadResponse{
+		JobID:             status.ID,
+		State:             status.State,
+		Message:           "Video was already submitted, returning the existing job.",
+		Duplicate:         true,
+		ProcessedFilePath: status.ProcessedFilePath,
+		ProcessedFileURL:  status.ProcessedFileURL,
+	}
+}
 
-	// Send a job to the worker's job queue
-	worker.JobQueue <- Job{
-		File:                  nil,
-		FileName:              fileName,
-		UnprocessedFilePath:   unprocessedfilePath,
-		ProcessedFilePathChan: processedFilePathChan,
-		APIKey:                apiKey,
-		Done:                  done,
-	}
-
-	// Launch a goroutine to wait for job completion and execute cleanup operations
-	go func() {
-		log.Printf("Go routine started waiting for data from worker channel")
-		<-done                                       // Wait until the worker signals that the job is done
-		processedFilePath := <-processedFilePathChan // Get the processed file path from the channel
-
-		// Build and log the payload for the callback
-		payload := fmt.Sprintf(`{"status":"done", "processed_video_path": "%s"}`, processedFilePath)
-		log.Printf("Payload to be sent: %s", payload)
-
-		// Send the payload to the callback URL
-		resp, err := http.Post(videoPathReq.CallbackURL, "application/json", strings.NewReader(payload))
-		if err != nil {
-			log.Printf("Failed to send callback: %v", err)
-			return
+// writeSubmitError responds to a submission that registerJob did not accept
+func writeSubmitError(w http.ResponseWriter, clientID string, err error) {
+	var admissionErr *AdmissionError
+	if errors.As(err, &admissionErr) {
+		slog.Warn("Rejected job", "client_id", clientID, "error", err)
+		writeAdmissionError(w, admissionErr)
+		return
+	}
+	if errors.Is(err, webhook.ErrInvalidCallbackURL) {
+		slog.Warn("Rejected job", "client_id", clientID, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// registerJob registers the job so its progress can be queried and queues it for the workers.
+// It returns an *AdmissionError instead of blocking when the job cannot be queued right now.
+// Whatever the error, no job is left behind for the submission.
+// A submission duplicating an earlier one (same idempotency key, or same content when Deduplicate
+// is set) is not queued: the existing job is returned with created set to false.
+func registerJob(worker Worker, tenant auth.Tenant, template jobs.Status) (status jobs.Status, created bool, err error) {
+	if err := validateCallbackURL(worker, template.CallbackURL); err != nil {
+		return jobs.Status{}, false, err
+	}
+
+	hashContent(worker, &template)
+	// Duplicates do not take a place in the queue
+	if existing, ok := worker.Registry.FindDuplicate(template); ok {
+		slog.Info("Submission duplicates an existing job", "client_id", template.ClientID, "job_id", existing.ID)
+		return existing, false, nil
+	}
+
+	template.VideoSeconds = probeVideoSeconds(tenant, worker.Storage, template.UnprocessedFilePath)
+	err = worker.Quotas.Reserve(tenant, 1, template.VideoSeconds, func() error {
+		if err := worker.Admission.Admit(template.ClientID); err != nil {
+			return err
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Received non-OK status code from callback: %d", resp.StatusCode)
-		} else {
-			log.Printf("Received 200 status code from callback server!")
+		status, created, err = worker.Registry.CreateUnique(template)
+		if err != nil {
+			return fmt.Errorf("failed to register job: %v", err)
 		}
-	}()
+		return nil
+	})
+	if err != nil {
+		return jobs.Status{}, false, err
+	}
+	if !created {
+		slog.Info("Submission duplicates an existing job", "client_id", template.ClientID, "job_id", status.ID)
+		return status, false, nil
+	}
+	slog.Info("Job registered", "job_id", status.ID, "tenant_id", tenant.ID, "client_id", status.ClientID)
 
-	// Send an HTTP OK status to indicate successful initiation
-	w.WriteHeader(http.StatusOK)
+	if err := tryEnqueueJob(worker, status, tenant); err != nil {
+		// The client is told to submit again, the job must not be reported as failed nor returned for its key
+		worker.Registry.Discard(status.ID)
+		return jobs.Status{}, false, err
+	}
+	return status, true, nil
+}
 
-	// Add a response message
-	responseMessage := "Processing video at the specified path, please wait for callback."
-	_, err = w.Write([]byte(responseMessage))
-	if err != nil {
-		log.Printf("Failed to write response: %v", err)
+// validateCallbackURL refuses callback URLs pointing at internal services or outside the allowlist.
+// Jobs without a callback URL are allowed.
+func validateCallbackURL(worker Worker, callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+	return worker.Webhooks.ValidateURL(callbackURL)
+}
+
+// tryEnqueueJob is the non-blocking version of enqueueJob used by HTTP handlers.
+// If the queue filled up since the job was admitted, it returns an *AdmissionError and leaves the
+// job queued in the registry; the caller decides what becomes of it.
+func tryEnqueueJob(worker Worker, status jobs.Status, tenant auth.Tenant) error {
+	job := newJob(status, tenant)
+	select {
+	case worker.JobQueue <- job:
+	default:
+		return worker.Admission.QueueFull()
+	}
+	return nil
+}
+
+// enqueueJob sends the registered job to the worker's job queue, waiting for room if it is full.
+// The callback is sent by SendCallback once the job reaches a terminal state.
+func enqueueJob(worker Worker, status jobs.Status, tenant auth.Tenant) {
+	// Send a job to the worker's job queue
+	worker.JobQueue <- newJob(status, tenant)
+}
+
+// newJob builds the queue entry of a registered job, processed with the credentials and output root of its tenant
+func newJob(status jobs.Status, tenant auth.Tenant) Job {
+	return Job{
+		ID:                  status.ID,
+		File:                nil,
+		FileName:            status.FileName,
+		UnprocessedFilePath: status.UnprocessedFilePath,
+		Tenant:              tenant,
+		Options:             jobOptions(status),
 	}
 }
@@ -0,0 +1,39 @@
+package upload
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+func TestRegisterJobWithQueueFilledMeanwhile(t *testing.T) {
+	// Without an admission controller nothing keeps the job out of the queue that has no room
+	registry := jobs.NewRegistry()
+	worker := Worker{JobQueue: make(chan Job), Registry: registry}
+	finished := make(chan jobs.Status, 1)
+	registry.OnFinished(func(status jobs.Status) { finished <- status })
+
+	template := jobs.Status{TenantID: "acme", ClientID: "c", IdempotencyKey: "k", FileName: "lecture.mp4"}
+	_, _, err := registerJob(worker, testTenant("acme", auth.Limits{}), template)
+	var admissionErr *AdmissionError
+	if !errors.As(err, &admissionErr) || admissionErr.StatusCode != http.StatusServiceUnavailable || !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("registerJob = %v, want a 503 for the full queue", err)
+	}
+	if jobs := registry.List(); len(jobs) != 0 {
+		t.Errorf("registry keeps %d jobs of the rejected submission", len(jobs))
+	}
+	select {
+	case status := <-finished:
+		t.Errorf("rejected submission reported as finished: %+v", status)
+	default:
+	}
+
+	// Submitted again with the same key once there is room, it is queued
+	worker.JobQueue = make(chan Job, 1)
+	status, created, err := registerJob(worker, testTenant("acme", auth.Limits{}), template)
+	if err != nil || !created || len(worker.JobQueue) != 1 {
+		t.Errorf("registerJob again = %v, %v, %v, want the job queued", status.ID, created, err)
+	}
+}
@@ -0,0 +1,55 @@
+package upload
+
+import (
+	"net/http"
+	"strings"
+	"videoUploadAndProcessing/pkg/webhook"
+)
+
+// @Schema
+// description: List of callback deliveries
+type DeliveryListResponse struct {
+	Deliveries []webhook.Delivery `json:"deliveries"`
+}
+
+// @Summary Query the callback delivery log
+// @Description Lists the callback deliveries, optionally of a single job or in a single state, or returns one delivery.
+// @Tags webhooks
+// @Produce json
+// @Param id path string false "Delivery ID"
+// @Param job_id query string false "Only deliveries of this job"
+// @Param state query string false "Only deliveries in this state: pending, delivered or failed"
+// @Success 200 {object} webhook.Delivery "Delivery"
+// @Success 200 {object} DeliveryListResponse "Deliveries"
+// @Failure 404 {object} string "Not Found"
+// @Failure 405 {object} string "Method Not Allowed"
+// @Router /webhooks/deliveries/{id} [get]
+// @Router /webhooks/deliveries [get]
+
+// HandleWebhookDeliveries is the HTTP handler for GET /webhooks/deliveries and GET /webhooks/deliveries/{id}
+func HandleWebhookDeliveries(w http.ResponseWriter, r *http.Request, webhooks *webhook.Dispatcher) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deliveryID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/deliveries"), "/")
+	if deliveryID != "" {
+		delivery, ok := webhooks.Get(deliveryID)
+		if !ok {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, delivery)
+		return
+	}
+
+	state := webhook.DeliveryState(r.URL.Query().Get("state"))
+	deliveries := make([]webhook.Delivery, 0)
+	for _, delivery := range webhooks.List(r.URL.Query().Get("job_id")) {
+		if state == "" || delivery.State == state {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	writeJSON(w, http.StatusOK, DeliveryListResponse{Deliveries: deliveries})
+}
@@ -0,0 +1,230 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/storage"
+	"videoUploadAndProcessing/pkg/video_processing"
+)
+
+const DefaultMinFreeDiskSpace = 1 << 30 // 暫存目錄至少需要的可用空間 (1 GiB)
+
+// How long the ffmpeg and ffprobe checks may take
+const toolCheckTimeout = 5 * time.Second
+
+// How long the output bucket check may take
+const storageCheckTimeout = 5 * time.Second
+
+// Outcomes of a readiness check
+const (
+	CheckOK   = "ok"
+	CheckFail = "fail"
+)
+
+// CheckResult is the outcome of one readiness check
+type CheckResult struct {
+	Status  string `json:"status"`            // ok or fail
+	Message string `json:"message,omitempty"` // what was found, or why the check failed
+}
+
+// Readiness is the response of /readyz and /admin/readiness. Only /admin/readiness has the checks,
+// they name the tenants and their directories.
+type Readiness struct {
+	Status string                 `json:"status"` // ready or not_ready
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Ready reports whether every check passed
+func (r Readiness) Ready() bool {
+	return r.Status == "ready"
+}
+
+// ReadinessChecker checks what the service needs to process jobs
+type ReadinessChecker struct {
+	tenants      *auth.Tenants
+	drainer      *Drainer
+	tempDir      string // where the jobs keep their intermediate files
+	minFreeBytes uint64 // free space needed under tempDir
+	storage      *storage.Storage
+}
+
+func NewReadinessChecker(tenants *auth.Tenants, drainer *Drainer, tempDir string, minFreeBytes uint64, store *storage.Storage) *ReadinessChecker {
+	return &ReadinessChecker{tenants: tenants, drainer: drainer, tempDir: tempDir, minFreeBytes: minFreeBytes, storage: store}
+}
+
+// Check runs every check: ffmpeg and ffprobe work, the directories of every tenant exist and are
+// writable, the output bucket can be used, there is enough free disk space for the intermediate
+// files, the Whisper and Acapela credentials of every tenant are configured, and the service is
+// not draining
+func (c *ReadinessChecker) Check(ctx context.Context) Readiness {
+	checks := make(map[string]CheckResult)
+
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		checks[tool] = checkTool(ctx, tool)
+	}
+	checks["disk_space"] = c.checkDiskSpace()
+	checks["draining"] = c.checkDraining()
+	checks["storage"] = c.checkStorage(ctx)
+
+	tenants := c.tenants.List()
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	for _, tenant := range tenants {
+		checks["input_dir:"+tenant.ID] = checkWritableDir(tenant.InputRoot)
+		checks["output_dir:"+tenant.ID] = checkWritableDir(tenant.OutputRoot)
+		checks["credentials:"+tenant.ID] = checkCredentials(tenant)
+	}
+
+	readiness := Readiness{Status: "ready", Checks: checks}
+	for _, result := range checks {
+		if result.Status != CheckOK {
+			readiness.Status = "not_ready"
+		}
+	}
+	return readiness
+}
+
+func checkTool(ctx context.Context, tool string) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, toolCheckTimeout)
+	defer cancel()
+	version, err := video_processing.ToolVersion(ctx, tool)
+	if err != nil {
+		return CheckResult{Status: CheckFail, Message: err.Error()}
+	}
+	return CheckResult{Status: CheckOK, Message: version}
+}
+
+// checkWritableDir creates and removes a file in dir to make sure jobs can write there
+func checkWritableDir(dir string) CheckResult {
+	if dir == "" {
+		return CheckResult{Status: CheckFail, Message: "directory is not configured"}
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return CheckResult{Status: CheckFail, Message: err.Error()}
+	}
+	if !info.IsDir() {
+		return CheckResult{Status: CheckFail, Message: fmt.Sprintf("%s is not a directory", dir)}
+	}
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return CheckResult{Status: CheckFail, Message: fmt.Sprintf("%s is not writable: %v", dir, err)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return CheckResult{Status: CheckOK, Message: dir}
+}
+
+func (c *ReadinessChecker) checkDiskSpace() CheckResult {
+	free, err := freeDiskSpace(c.tempDir)
+	if err != nil {
+		return CheckResult{Status: CheckFail, Message: err.Error()}
+	}
+	message := fmt.Sprintf("%d MiB free under %s", free>>20, c.tempDir)
+	if free < c.minFreeBytes {
+		return CheckResult{Status: CheckFail, Message: fmt.Sprintf("%s, %d MiB needed", message, c.minFreeBytes>>20)}
+	}
+	return CheckResult{Status: CheckOK, Message: message}
+}
+
+func (c *ReadinessChecker) checkDraining() CheckResult {
+	if c.drainer.Draining() {
+		return CheckResult{Status: CheckFail, Message: "the service is draining and does not accept new jobs"}
+	}
+	return CheckResult{Status: CheckOK}
+}
+
+// checkStorage makes sure the outputs can be stored, with a HEAD request when they go to a bucket
+func (c *ReadinessChecker) checkStorage(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, storageCheckTimeout)
+	defer cancel()
+	if err := c.storage.Check(ctx); err != nil {
+		return CheckResult{Status: CheckFail, Message: fmt.Sprintf("%s: %v", c.storage.Description(), err)}
+	}
+	return CheckResult{Status: CheckOK, Message: c.storage.Description()}
+}
+
+// checkCredentials only checks that the credentials are set, not that they are accepted, so the
+// probe does not call Whisper and Acapela
+func checkCredentials(tenant auth.Tenant) CheckResult {
+	var missing []string
+	if tenant.WhisperAPIKey == "" {
+		missing = append(missing, "Whisper API key")
+	}
+	if tenant.AcapelaEmail == "" || tenant.AcapelaPassword == "" {
+		missing = append(missing, "Acapela email and password")
+	}
+	if len(missing) > 0 {
+		return CheckResult{Status: CheckFail, Message: "missing " + strings.Join(missing, ", ")}
+	}
+	return CheckResult{Status: CheckOK}
+}
+
+// @Summary Liveness
+// @Description Reports that the process is up and serving requests. It does not need an API key.
+// @Tags health
+// @Produce json
+// @Success 200 {object} map[string]string "Alive"
+// @Router /healthz [get]
+
+// HandleHealthz is the HTTP handler for GET /healthz
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// @Summary Readiness
+// @Description Reports whether the service can process jobs: ready or not_ready. It does not need an API key,
+// @Description the outcome of every check is only reported to admins by /admin/readiness.
+// @Tags health
+// @Produce json
+// @Success 200 {object} Readiness "Ready"
+// @Failure 503 {object} Readiness "Not ready"
+// @Router /readyz [get]
+
+// HandleReadyz is the HTTP handler for GET /readyz
+func HandleReadyz(w http.ResponseWriter, r *http.Request, checker *ReadinessChecker) {
+	writeReadiness(w, r, checker, false)
+}
+
+// @Summary Readiness checks
+// @Description Reports whether the service can process jobs, with the outcome of every check: ffmpeg and
+// @Description ffprobe, input and output directories, output bucket, free disk space, credentials, and draining.
+// @Description Only admin tenants may use it.
+// @Tags health
+// @Produce json
+// @Success 200 {object} Readiness "Ready"
+// @Failure 403 {object} string "Admin access required"
+// @Failure 503 {object} Readiness "Not ready"
+// @Router /admin/readiness [get]
+
+// HandleReadiness is the HTTP handler for GET /admin/readiness, it must run behind auth.RequireAdmin
+func HandleReadiness(w http.ResponseWriter, r *http.Request, checker *ReadinessChecker) {
+	writeReadiness(w, r, checker, true)
+}
+
+// writeReadiness runs the checks and responds with 503 if one of them failed. The outcome of every
+// check is only included when withChecks is set.
+func writeReadiness(w http.ResponseWriter, r *http.Request, checker *ReadinessChecker, withChecks bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	readiness := checker.Check(r.Context())
+	statusCode := http.StatusOK
+	if !readiness.Ready() {
+		statusCode = http.StatusServiceUnavailable
+	}
+	if !withChecks {
+		readiness.Checks = nil
+	}
+	writeJSON(w, statusCode, readiness)
+}
@@ -0,0 +1,59 @@
+package upload
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os/exec"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/retry"
+)
+
+// SegmentError reports which subtitle segment failed to be dubbed
+type SegmentError struct {
+	Index int
+	Err   error
+}
+
+func (e *SegmentError) Error() string { return e.Err.Error() }
+
+func (e *SegmentError) Unwrap() error { return e.Err }
+
+func segmentError(index int, err error) error {
+	return &SegmentError{Index: index, Err: err}
+}
+
+// classifyJobError attaches an error code and the failing segment to a pipeline error,
+// so the failure callback tells the client what went wrong without parsing the message
+func classifyJobError(err error) error {
+	jobErr := &jobs.Error{Code: jobs.ErrorCodeInternal, Err: err}
+
+	var codedErr *jobs.Error
+	var statusErr *retry.StatusError
+	var exitErr *exec.ExitError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &codedErr):
+		jobErr.Code = codedErr.Code
+	case errors.As(err, &statusErr):
+		if retry.IsTransient(statusErr) {
+			jobErr.Code = jobs.ErrorCodeUpstreamUnavailable
+		} else {
+			jobErr.Code = jobs.ErrorCodeUpstreamRejected
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		jobErr.Code = jobs.ErrorCodeInvalidInput
+	case errors.As(err, &exitErr):
+		jobErr.Code = jobs.ErrorCodeFFmpeg
+	case errors.As(err, &netErr):
+		// Network errors and timeouts that outlasted the retries
+		jobErr.Code = jobs.ErrorCodeUpstreamUnavailable
+	}
+
+	var segmentErr *SegmentError
+	if errors.As(err, &segmentErr) {
+		index := segmentErr.Index
+		jobErr.SegmentIndex = &index
+	}
+	return jobErr
+}
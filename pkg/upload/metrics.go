@@ -0,0 +1,50 @@
+package upload
+
+import (
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/metrics"
+)
+
+var (
+	activeWorkers = metrics.NewGauge("video_processing_active_workers",
+		"Workers processing a job.")
+	stageDuration = metrics.NewHistogram("video_processing_stage_duration_seconds",
+		"Time taken by each stage of the pipeline, stages reused from a checkpoint are not counted.",
+		metrics.StageBuckets, "stage")
+	jobDuration = metrics.NewHistogram("video_processing_job_duration_seconds",
+		"Time from submission to the end of finished jobs, by final state.",
+		metrics.StageBuckets, "state")
+	jobsFailed = metrics.NewCounter("video_processing_jobs_failed_total",
+		"Failed jobs by error code.",
+		"error_code")
+	segmentsProcessed = metrics.NewCounter("video_processing_segments_total",
+		"Voice segments of the jobs by result: dubbed, failed, skipped after the job stopped, or reused from a checkpoint.",
+		"result")
+)
+
+// RegisterQueueMetrics exposes the depth and capacity of the job queue and the size of the worker pool
+func RegisterQueueMetrics(admission *AdmissionController, queue chan Job, workers int) {
+	metrics.NewGaugeFunc("video_processing_queue_depth", "Jobs waiting in the queue or for a slot of their tenant.", func() float64 {
+		return float64(admission.QueueDepth())
+	})
+	metrics.NewGaugeFunc("video_processing_queue_capacity", "Jobs the queue can hold.", func() float64 {
+		return float64(cap(queue))
+	})
+	metrics.NewGaugeFunc("video_processing_workers", "Workers in the pool.", func() float64 {
+		return float64(workers)
+	})
+}
+
+// ObserveFinished records the duration and outcome of a finished job, it is meant for Registry.OnFinished
+func ObserveFinished(status jobs.Status) {
+	if status.FinishedAt != nil {
+		jobDuration.Observe(status.FinishedAt.Sub(status.CreatedAt).Seconds(), string(status.State))
+	}
+	if status.State == jobs.StateFailed {
+		code := string(jobs.ErrorCodeInternal)
+		if status.Failure != nil {
+			code = string(status.Failure.Code)
+		}
+		jobsFailed.Inc(code)
+	}
+}
@@ -0,0 +1,318 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/storage"
+	"videoUploadAndProcessing/pkg/video_processing"
+	"videoUploadAndProcessing/pkg/whisper_api"
+)
+
+var (
+	ErrJobsPerHourQuota   = errors.New("jobs per hour quota exceeded")
+	ErrVideoMinutesQuota  = errors.New("video minutes per day quota exceeded")
+	ErrTTSCharactersQuota = errors.New("TTS characters per month quota exceeded")
+)
+
+// How long the duration of a submitted video may take to probe
+const probeTimeout = 30 * time.Second
+
+// Quotas enforces the limits of every tenant. Usage is computed from the job registry so it
+// survives restarts; only the number of running jobs is kept in memory.
+//   - jobs per hour and video minutes per day are checked when jobs are submitted;
+//   - concurrent jobs are limited in the worker pool, the jobs of a tenant at its limit wait in
+//     the tenant's wait list, in order, instead of taking workers away from the other tenants;
+//   - TTS characters are checked at submission and reserved when a job starts dubbing, then
+//     charged segment by segment once each dubbed segment is checkpointed.
+//
+// The checks and charges of a tenant are serialized so concurrent requests cannot both take the
+// last of a quota.
+type Quotas struct {
+	registry *jobs.Registry
+
+	mu          sync.Mutex
+	running     map[string]int         // running jobs per tenant
+	waiting     map[string][]Job       // jobs waiting for a slot per tenant, oldest first
+	reservedTTS map[string]int         // TTS characters reserved by the jobs dubbing, not charged yet, per tenant
+	locks       map[string]*sync.Mutex // serializes the checks and charges of every tenant
+}
+
+func NewQuotas(registry *jobs.Registry) *Quotas {
+	return &Quotas{
+		registry:    registry,
+		running:     make(map[string]int),
+		waiting:     make(map[string][]Job),
+		reservedTTS: make(map[string]int),
+		locks:       make(map[string]*sync.Mutex),
+	}
+}
+
+// Admit checks whether the tenant may submit n jobs totalling videoSeconds of video right now.
+// It returns an *AdmissionError with status 429 and the time until the quota frees up.
+// Admit only checks; Reserve also creates the jobs before another submission of the tenant is checked.
+func (q *Quotas) Admit(tenant auth.Tenant, n int, videoSeconds float64) error {
+	if q == nil {
+		return nil
+	}
+	unlock := q.lockTenant(tenant.ID)
+	defer unlock()
+	return q.admit(tenant, n, videoSeconds)
+}
+
+// Reserve checks whether the tenant may submit n jobs totalling videoSeconds of video and, if so,
+// runs create, which must register the jobs. Both happen under the tenant's lock, so the jobs count
+// against the quotas before the next submission of the tenant is checked.
+func (q *Quotas) Reserve(tenant auth.Tenant, n int, videoSeconds float64, create func() error) error {
+	if q == nil {
+		return create()
+	}
+	unlock := q.lockTenant(tenant.ID)
+	defer unlock()
+	if err := q.admit(tenant, n, videoSeconds); err != nil {
+		return err
+	}
+	return create()
+}
+
+// admit checks the quotas of the tenant. The caller must hold the tenant's lock.
+func (q *Quotas) admit(tenant auth.Tenant, n int, videoSeconds float64) error {
+	limits := tenant.Limits
+	now := time.Now().UTC()
+
+	if limits.JobsPerHour > 0 {
+		usage := q.registry.Usage(tenant.Owns, now.Add(-time.Hour))
+		if usage.Jobs+n > limits.JobsPerHour {
+			return quotaError(fmt.Errorf("%w: %d of %d jobs submitted in the last hour", ErrJobsPerHourQuota, usage.Jobs, limits.JobsPerHour),
+				usage.OldestJob.Add(time.Hour).Sub(now))
+		}
+	}
+
+	if limits.VideoMinutesPerDay > 0 {
+		day := now.Truncate(24 * time.Hour)
+		usage := q.registry.Usage(tenant.Owns, day)
+		if (usage.VideoSeconds+videoSeconds)/60 > limits.VideoMinutesPerDay {
+			return quotaError(fmt.Errorf("%w: %.1f of %.1f minutes used today, this submission is %.1f minutes",
+				ErrVideoMinutesQuota, usage.VideoSeconds/60, limits.VideoMinutesPerDay, videoSeconds/60),
+				day.Add(24*time.Hour).Sub(now))
+		}
+	}
+
+	if limits.TTSCharactersPerMonth > 0 {
+		month := startOfMonth(now)
+		usage := q.registry.Usage(tenant.Owns, month)
+		if usage.TTSCharacters >= limits.TTSCharactersPerMonth {
+			return quotaError(fmt.Errorf("%w: %d of %d characters used this month", ErrTTSCharactersQuota, usage.TTSCharacters, limits.TTSCharactersPerMonth),
+				month.AddDate(0, 1, 0).Sub(now))
+		}
+	}
+	return nil
+}
+
+// ReserveTTS reserves the characters the job is about to send to Acapela, failing the job with
+// ErrorCodeQuotaExceeded if they do not fit in the tenant's monthly quota along with what the other
+// jobs of the tenant reserved. The characters are charged to the job as its segments are dubbed,
+// see TTSReservation.
+func (q *Quotas) ReserveTTS(tenant auth.Tenant, jobID string, characters int) (*TTSReservation, error) {
+	if q == nil {
+		return nil, nil
+	}
+
+	// Serialized so two jobs of the tenant cannot both take the last characters
+	unlock := q.lockTenant(tenant.ID)
+	defer unlock()
+
+	if limit := tenant.Limits.TTSCharactersPerMonth; limit > 0 && characters > 0 {
+		used := q.registry.Usage(tenant.Owns, startOfMonth(time.Now().UTC())).TTSCharacters
+		q.mu.Lock()
+		reserved := q.reservedTTS[tenant.ID]
+		q.mu.Unlock()
+		if used+reserved+characters > limit {
+			// Retrying would not help before the month is over
+			return nil, retry.Permanent(&jobs.Error{
+				Code: jobs.ErrorCodeQuotaExceeded,
+				Err: fmt.Errorf("%w: %d of %d characters used this month and %d reserved by running jobs, this job needs %d",
+					ErrTTSCharactersQuota, used, limit, reserved, characters),
+			})
+		}
+	}
+
+	q.mu.Lock()
+	q.reservedTTS[tenant.ID] += characters
+	q.mu.Unlock()
+	return &TTSReservation{quotas: q, tenantID: tenant.ID, jobID: jobID, left: characters}, nil
+}
+
+// TTSReservation is the TTS characters a job reserved before dubbing. A nil TTSReservation
+// charges nothing.
+type TTSReservation struct {
+	quotas   *Quotas
+	tenantID string
+	jobID    string
+	left     int // reserved characters not charged yet, guarded by quotas.mu
+}
+
+// Charge records that the characters of a dubbed segment were sent to Acapela. It is called once the
+// segment is checkpointed, so a retried job is not charged again for the segments it reuses.
+func (r *TTSReservation) Charge(characters int) {
+	if r == nil || characters == 0 {
+		return
+	}
+	r.quotas.registry.AddTTSCharacters(r.jobID, characters)
+
+	r.quotas.mu.Lock()
+	defer r.quotas.mu.Unlock()
+	r.take(min(characters, r.left))
+}
+
+// Release gives back the characters that were not charged, e.g. those of the segments left when
+// the job failed. It may be called more than once.
+func (r *TTSReservation) Release() {
+	if r == nil {
+		return
+	}
+	r.quotas.mu.Lock()
+	defer r.quotas.mu.Unlock()
+	r.take(r.left)
+}
+
+// take removes n characters from the reservation. The caller must hold quotas.mu.
+func (r *TTSReservation) take(n int) {
+	r.left -= n
+	if r.quotas.reservedTTS[r.tenantID] -= n; r.quotas.reservedTTS[r.tenantID] <= 0 {
+		delete(r.quotas.reservedTTS, r.tenantID)
+	}
+}
+
+// lockTenant takes the lock serializing the checks and charges of the tenant, and returns the
+// function releasing it
+func (q *Quotas) lockTenant(tenantID string) func() {
+	q.mu.Lock()
+	lock, ok := q.locks[tenantID]
+	if !ok {
+		lock = &sync.Mutex{}
+		q.locks[tenantID] = lock
+	}
+	q.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// acquire takes one of the concurrent job slots of the job's tenant. When they are all taken the
+// job is added to the tenant's wait list and acquire reports false; release hands it a slot later.
+func (q *Quotas) acquire(job Job) bool {
+	if q == nil {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tenantID := job.Tenant.ID
+	if limit := job.Tenant.Limits.ConcurrentJobs; limit > 0 && q.running[tenantID] >= limit {
+		q.waiting[tenantID] = append(q.waiting[tenantID], job)
+		return false
+	}
+	q.running[tenantID]++
+	return true
+}
+
+// release gives back a slot taken by acquire. If a job of the tenant is waiting for a slot, the
+// slot goes to the oldest one, which release returns for the caller to run.
+func (q *Quotas) release(tenant auth.Tenant) (Job, bool) {
+	if q == nil {
+		return Job{}, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if waiting := q.waiting[tenant.ID]; len(waiting) > 0 {
+		next := waiting[0]
+		if len(waiting) == 1 {
+			delete(q.waiting, tenant.ID)
+		} else {
+			q.waiting[tenant.ID] = waiting[1:]
+		}
+		return next, true
+	}
+	if q.running[tenant.ID]--; q.running[tenant.ID] <= 0 {
+		delete(q.running, tenant.ID)
+	}
+	return Job{}, false
+}
+
+// Waiting returns how many jobs wait for a slot of their tenant, they count as queued
+func (q *Quotas) Waiting() int {
+	if q == nil {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := 0
+	for _, list := range q.waiting {
+		waiting += len(list)
+	}
+	return waiting
+}
+
+// Running returns how many jobs of the tenant are being processed
+func (q *Quotas) Running(tenant auth.Tenant) int {
+	if q == nil {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running[tenant.ID]
+}
+
+// probeVideoSeconds returns the duration of the video when the tenant has a video minutes quota.
+// A video that cannot be probed counts as 0, the job fails on it later with a proper error.
+// Objects of the store are probed through a presigned URL, without downloading them.
+func probeVideoSeconds(tenant auth.Tenant, store *storage.Storage, videoPath string) float64 {
+	if tenant.Limits.VideoMinutesPerDay <= 0 {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	seconds, err := video_processing.GetVideoDuration(ctx, store.ProbeURL(videoPath, tenant.S3InputPrefixes))
+	if err != nil {
+		slog.Warn("Failed to get the video duration for the quota", "tenant_id", tenant.ID, "path", videoPath, "error", err)
+		return 0
+	}
+	return seconds
+}
+
+func quotaError(err error, retryAfter time.Duration) *AdmissionError {
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return &AdmissionError{Err: err, StatusCode: http.StatusTooManyRequests, RetryAfter: retryAfter.Round(time.Second)}
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// pendingTTSCharacters counts the characters of the voice segments the checkpoint has not dubbed yet
+func pendingTTSCharacters(cp *checkpoint, srtSegments []whisper_api.SRTSegment) int {
+	characters := 0
+	for i := range cp.VoiceSegmentPaths {
+		if _, ok := cp.dubbedSegment(i); !ok && i < len(srtSegments) {
+			characters += utf8.RuneCountInString(srtSegments[i].Text)
+		}
+	}
+	return characters
+}
@@ -0,0 +1,232 @@
+package upload
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+func testTenant(id string, limits auth.Limits) auth.Tenant {
+	return auth.Tenant{ID: id, Limits: limits}
+}
+
+// registryWith restores a registry from a job log holding the given finished jobs, so their
+// creation times can be in the past
+func registryWith(t *testing.T, finished ...jobs.Status) *jobs.Registry {
+	t.Helper()
+	store, err := jobs.OpenStore(filepath.Join(t.TempDir(), "jobs.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	for i, status := range finished {
+		status.ID = string(rune('a' + i))
+		status.State = jobs.StateDone
+		if err := store.Append(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := jobs.NewPersistentRegistry(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestQuotasReserve(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name         string
+		limits       auth.Limits
+		existing     []jobs.Status
+		n            int
+		videoSeconds float64
+		wantErr      error
+	}{
+		{"unlimited", auth.Limits{}, []jobs.Status{{TenantID: "acme", CreatedAt: now}}, 100, 1e6, nil},
+		{"jobs per hour left", auth.Limits{JobsPerHour: 3}, []jobs.Status{{TenantID: "acme", CreatedAt: now}}, 2, 0, nil},
+		{"jobs per hour used up", auth.Limits{JobsPerHour: 3}, []jobs.Status{{TenantID: "acme", CreatedAt: now}}, 3, 0, ErrJobsPerHourQuota},
+		{"jobs of another tenant", auth.Limits{JobsPerHour: 1}, []jobs.Status{{TenantID: "globex", CreatedAt: now}}, 1, 0, nil},
+		{"video minutes left", auth.Limits{VideoMinutesPerDay: 10}, []jobs.Status{{TenantID: "acme", CreatedAt: now, VideoSeconds: 300}}, 1, 300, nil},
+		{"video minutes used up", auth.Limits{VideoMinutesPerDay: 10}, []jobs.Status{{TenantID: "acme", CreatedAt: now, VideoSeconds: 300}}, 1, 301, ErrVideoMinutesQuota},
+		{"tts characters used up", auth.Limits{TTSCharactersPerMonth: 100}, []jobs.Status{{TenantID: "acme", CreatedAt: now, TTSCharacters: 100}}, 1, 0, ErrTTSCharactersQuota},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quotas := NewQuotas(registryWith(t, tt.existing...))
+			created := false
+			err := quotas.Reserve(testTenant("acme", tt.limits), tt.n, tt.videoSeconds, func() error {
+				created = true
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("Reserve = %v, want %v", err, tt.wantErr)
+			}
+			if created != (tt.wantErr == nil) {
+				t.Errorf("create called = %v, want %v", created, tt.wantErr == nil)
+			}
+
+			var admissionErr *AdmissionError
+			if err != nil && (!errors.As(err, &admissionErr) || admissionErr.StatusCode != http.StatusTooManyRequests || admissionErr.RetryAfter < time.Second) {
+				t.Errorf("Reserve = %#v, want a 429 with a Retry-After", err)
+			}
+		})
+	}
+}
+
+func TestQuotasReserveIsAtomic(t *testing.T) {
+	registry := jobs.NewRegistry()
+	quotas := NewQuotas(registry)
+	tenant := testTenant("acme", auth.Limits{JobsPerHour: 5})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			quotas.Reserve(tenant, 1, 0, func() error {
+				_, err := registry.Create(jobs.Status{TenantID: tenant.ID})
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+
+	if created := len(registry.List()); created != 5 {
+		t.Errorf("%d jobs created by concurrent submissions, want the 5 of the quota", created)
+	}
+}
+
+func TestQuotasRollover(t *testing.T) {
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	month := startOfMonth(now)
+	tests := []struct {
+		name         string
+		limits       auth.Limits
+		existing     jobs.Status
+		videoSeconds float64
+		wantErr      error
+	}{
+		{"jobs submitted over an hour ago", auth.Limits{JobsPerHour: 1}, jobs.Status{CreatedAt: now.Add(-61 * time.Minute)}, 0, nil},
+		{"jobs submitted within the hour", auth.Limits{JobsPerHour: 1}, jobs.Status{CreatedAt: now.Add(-59 * time.Minute)}, 0, ErrJobsPerHourQuota},
+		{"minutes of yesterday", auth.Limits{VideoMinutesPerDay: 10}, jobs.Status{CreatedAt: today.Add(-time.Minute), VideoSeconds: 600}, 60, nil},
+		{"minutes of today", auth.Limits{VideoMinutesPerDay: 10}, jobs.Status{CreatedAt: today, VideoSeconds: 600}, 60, ErrVideoMinutesQuota},
+		{"characters of last month", auth.Limits{TTSCharactersPerMonth: 100}, jobs.Status{CreatedAt: month.Add(-time.Minute), TTSCharacters: 100}, 0, nil},
+		{"characters of this month", auth.Limits{TTSCharactersPerMonth: 100}, jobs.Status{CreatedAt: month, TTSCharacters: 100}, 0, ErrTTSCharactersQuota},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.existing.TenantID = "acme"
+			quotas := NewQuotas(registryWith(t, tt.existing))
+			err := quotas.Admit(testTenant("acme", tt.limits), 1, tt.videoSeconds)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("Admit = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuotasWaitList(t *testing.T) {
+	quotas := NewQuotas(jobs.NewRegistry())
+	acme := testTenant("acme", auth.Limits{ConcurrentJobs: 2})
+	globex := testTenant("globex", auth.Limits{ConcurrentJobs: 1})
+
+	steps := []struct {
+		name        string
+		acquire     string // id of the job of acme to acquire a slot for
+		release     bool   // release a slot of acme instead
+		wantRun     bool   // acquire: the job may run now; release: a waiting job was handed the slot
+		wantNext    string // release: the job handed the slot
+		wantRunning int
+		wantWaiting int
+	}{
+		{name: "first slot", acquire: "1", wantRun: true, wantRunning: 1},
+		{name: "second slot", acquire: "2", wantRun: true, wantRunning: 2},
+		{name: "at the limit", acquire: "3", wantRunning: 2, wantWaiting: 1},
+		{name: "still at the limit", acquire: "4", wantRunning: 2, wantWaiting: 2},
+		{name: "slot handed to the oldest", release: true, wantRun: true, wantNext: "3", wantRunning: 2, wantWaiting: 1},
+		{name: "slot handed to the next", release: true, wantRun: true, wantNext: "4", wantRunning: 2},
+		{name: "slot freed", release: true, wantRunning: 1},
+		{name: "last slot freed", release: true},
+	}
+	for _, step := range steps {
+		if step.release {
+			next, ok := quotas.release(acme)
+			if ok != step.wantRun || next.ID != step.wantNext {
+				t.Errorf("%s: release = %q, %v, want %q, %v", step.name, next.ID, ok, step.wantNext, step.wantRun)
+			}
+		} else if ok := quotas.acquire(Job{ID: step.acquire, Tenant: acme}); ok != step.wantRun {
+			t.Errorf("%s: acquire = %v, want %v", step.name, ok, step.wantRun)
+		}
+		if running := quotas.Running(acme); running != step.wantRunning {
+			t.Errorf("%s: running = %d, want %d", step.name, running, step.wantRunning)
+		}
+		if waiting := quotas.Waiting(); waiting != step.wantWaiting {
+			t.Errorf("%s: waiting = %d, want %d", step.name, waiting, step.wantWaiting)
+		}
+
+		// The limit of a tenant does not hold back the others
+		if step.name == "still at the limit" {
+			if !quotas.acquire(Job{ID: "g", Tenant: globex}) {
+				t.Error("job of another tenant waits for the slots of acme")
+			}
+			quotas.release(globex)
+		}
+	}
+}
+
+func TestTTSReservation(t *testing.T) {
+	registry := jobs.NewRegistry()
+	quotas := NewQuotas(registry)
+	tenant := testTenant("acme", auth.Limits{TTSCharactersPerMonth: 100})
+	first, _ := registry.Create(jobs.Status{TenantID: tenant.ID})
+	second, _ := registry.Create(jobs.Status{TenantID: tenant.ID})
+
+	reservation, err := quotas.ReserveTTS(tenant, first.ID, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The characters reserved by the first job are not available to the second
+	_, err = quotas.ReserveTTS(tenant, second.ID, 50)
+	var jobErr *jobs.Error
+	if !errors.Is(err, ErrTTSCharactersQuota) || !errors.As(err, &jobErr) || jobErr.Code != jobs.ErrorCodeQuotaExceeded {
+		t.Fatalf("ReserveTTS over the quota = %v, want a quota_exceeded error", err)
+	}
+
+	// Two segments dubbed, then the job fails: the rest of the reservation is given back
+	reservation.Charge(15)
+	reservation.Charge(5)
+	reservation.Release()
+	reservation.Release()
+	if status, _ := registry.Get(first.ID); status.TTSCharacters != 20 {
+		t.Errorf("job charged %d characters, want the 20 of its dubbed segments", status.TTSCharacters)
+	}
+
+	// The retry only reserves the segments left, and the second job fits now
+	retried, err := quotas.ReserveTTS(tenant, first.ID, 40)
+	if err != nil {
+		t.Fatalf("ReserveTTS of the retry = %v", err)
+	}
+	retried.Release()
+	if _, err := quotas.ReserveTTS(tenant, second.ID, 80); err != nil {
+		t.Errorf("ReserveTTS = %v, want the 80 characters left", err)
+	}
+	if _, err := quotas.ReserveTTS(tenant, second.ID, 1); !errors.Is(err, ErrTTSCharactersQuota) {
+		t.Errorf("ReserveTTS past the quota = %v, want ErrTTSCharactersQuota", err)
+	}
+
+	// Without quotas nothing is reserved or charged
+	var none *Quotas
+	if reservation, err := none.ReserveTTS(tenant, first.ID, 1000); reservation != nil || err != nil {
+		t.Errorf("ReserveTTS without quotas = %v, %v", reservation, err)
+	}
+}
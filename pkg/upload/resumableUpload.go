@@ -0,0 +1,570 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+// TusVersion is the version of the tus protocol the resumable upload endpoints follow
+const TusVersion = "1.0.0"
+
+const DefaultResumableUploadExpiry = 24 * time.Hour // 未完成上傳的預設保留時間
+
+const resumableCleanupInterval = time.Minute
+
+// The state of an upload is kept next to its partial file, with this suffix
+const uploadStateSuffix = ".json"
+
+// resumableUpload is the server side state of a single resumable upload. It is saved next to the
+// partial file so uploads can be resumed after a restart.
+type resumableUpload struct {
+	mu          sync.Mutex // held while a chunk is being written
+	ID          string
+	FileName    string
+	CallbackURL string
+	ClientID    string
+	TenantID    string
+	Length      int64
+	Offset      int64 `json:"-"` // size of the partial file, which is the source of truth
+	PartialPath string
+	ExpiresAt   time.Time
+	JobID       string // set once the upload is complete and queued
+}
+
+// statePath returns where the state of the upload is saved
+func (upload *resumableUpload) statePath() string {
+	return upload.PartialPath + uploadStateSuffix
+}
+
+// save writes the state of the upload through a temporary file, so a crash never leaves it half written
+func (upload *resumableUpload) save() error {
+	tmp := upload.statePath() + ".tmp"
+	if err := saveJSON(tmp, upload); err != nil {
+		return err
+	}
+	return os.Rename(tmp, upload.statePath())
+}
+
+// remove deletes the partial file and the saved state of the upload
+func (upload *resumableUpload) remove() {
+	os.Remove(upload.PartialPath)
+	os.Remove(upload.statePath())
+}
+
+// ResumableUploads keeps track of uploads that are sent in several chunks.
+// Chunks are appended to a partial file in the tenant's upload directory; once all bytes have
+// arrived the file is moved next to the other uploaded videos and queued as a regular job.
+type ResumableUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*resumableUpload
+	tenants *auth.Tenants
+	expiry  time.Duration
+}
+
+// NewResumableUploads restores the uploads saved in the partial directories of the tenants, so
+// clients can resume the uploads that were in progress when the service stopped
+func NewResumableUploads(tenants *auth.Tenants, expiry time.Duration) *ResumableUploads {
+	if expiry <= 0 {
+		expiry = DefaultResumableUploadExpiry
+	}
+	u := &ResumableUploads{
+		uploads: make(map[string]*resumableUpload),
+		tenants: tenants,
+		expiry:  expiry,
+	}
+	u.restore()
+	return u
+}
+
+// restore loads the saved state of the uploads of every tenant. The offset of an unfinished
+// upload is the size of its partial file, which holds every byte that was written.
+func (u *ResumableUploads) restore() {
+	for _, tenant := range u.tenants.List() {
+		paths, err := filepath.Glob(filepath.Join(partialDir(tenant), "*"+uploadStateSuffix))
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			upload := &resumableUpload{}
+			if err := loadJSON(path, upload); err != nil || upload.TenantID != tenant.ID || upload.statePath() != path {
+				slog.Warn("Skipping unreadable resumable upload state", "path", path, "error", err)
+				continue
+			}
+			if upload.JobID != "" {
+				upload.Offset = upload.Length
+			} else if info, err := os.Stat(upload.PartialPath); err == nil {
+				upload.Offset = info.Size()
+			} else {
+				// The partial file is gone, there is nothing to resume
+				os.Remove(path)
+				continue
+			}
+			u.uploads[upload.ID] = upload
+		}
+	}
+	if len(u.uploads) > 0 {
+		slog.Info("Restored resumable uploads", "uploads", len(u.uploads))
+	}
+}
+
+// partialDir returns where the chunks of the tenant's unfinished uploads are written
+func partialDir(tenant auth.Tenant) string {
+	return filepath.Join(tenant.UploadDir(), ".partial")
+}
+
+// StartCleanup periodically removes uploads that have not been completed before they expired
+func (u *ResumableUploads) StartCleanup() {
+	go func() {
+		ticker := time.NewTicker(resumableCleanupInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			u.removeExpired(time.Now())
+		}
+	}()
+}
+
+func (u *ResumableUploads) removeExpired(now time.Time) {
+	u.mu.Lock()
+	var expired []*resumableUpload
+	for id, upload := range u.uploads {
+		if now.After(upload.ExpiresAt) {
+			expired = append(expired, upload)
+			delete(u.uploads, id)
+		}
+	}
+	u.mu.Unlock()
+
+	for _, upload := range expired {
+		if upload.JobID == "" {
+			slog.Info("Resumable upload expired, removing it", "upload_id", upload.ID, "offset", upload.Offset, "length", upload.Length)
+		}
+		upload.remove()
+	}
+
+	// Files no upload is restored for, such as partial files without a readable state, are
+	// removed once they are as old as an expired upload
+	for _, tenant := range u.tenants.List() {
+		dir := partialDir(tenant)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || now.Sub(info.ModTime()) < u.expiry {
+				continue
+			}
+			u.mu.Lock()
+			_, tracked := u.uploads[strings.TrimSuffix(entry.Name(), uploadStateSuffix)]
+			u.mu.Unlock()
+			if !tracked {
+				slog.Info("Removing stale partial upload", "upload_id", entry.Name(), "tenant_id", tenant.ID)
+				os.Remove(filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+}
+
+// @Summary Create a resumable upload
+// @Description Starts a tus-style resumable upload. Upload-Length is the total size in bytes, Upload-Metadata may carry base64 encoded "filename" and "callback_url" values.
+// @Tags video
+// @Param Upload-Length header int true "Total size of the video in bytes"
+// @Param Upload-Metadata header string false "filename <base64>,callback_url <base64>"
+// @Success 201 {object} string "Created, Location holds the upload URL"
+// @Failure 400 {object} string "Bad Request, or no Whisper API key is configured for the tenant"
+// @Failure 413 {object} string "Video too large"
+// @Failure 429 {object} string "Too many unfinished jobs for this client"
+// @Failure 503 {object} string "Job queue is full"
+// @Router /uploads [post]
+
+// @Summary Query the offset of a resumable upload
+// @Description Reports how many bytes were received. Unfinished uploads survive a restart of the service until they expire.
+// @Tags video
+// @Param id path string true "Upload ID"
+// @Success 200 {object} string "Upload-Offset and Upload-Length headers"
+// @Failure 404 {object} string "Not Found"
+// @Router /uploads/{id} [head]
+
+// @Summary Append a chunk to a resumable upload
+// @Description Appends the request body at Upload-Offset. The chunk that completes the upload queues the video for processing.
+// @Tags video
+// @Accept application/offset+octet-stream
+// @Produce json
+// @Param id path string true "Upload ID"
+// @Param Upload-Offset header int true "Offset the chunk starts at"
+// @Success 204 {object} string "Chunk stored"
+// @Success 200 {object} UploadResponse "Upload complete and queued"
+// @Failure 400 {object} string "Bad Request"
+// @Failure 404 {object} string "Not Found"
+// @Failure 409 {object} string "Offset mismatch"
+// @Failure 413 {object} string "Chunk longer than what is left of Upload-Length"
+// @Failure 415 {object} string "Unsupported Media Type"
+// @Failure 429 {object} string "Too many unfinished jobs for this client"
+// @Failure 503 {object} string "Job queue is full, the upload can be finished later"
+// @Router /uploads/{id} [patch]
+
+// @Summary Abort a resumable upload
+// @Tags video
+// @Param id path string true "Upload ID"
+// @Success 204 {object} string "Upload removed"
+// @Failure 404 {object} string "Not Found"
+// @Router /uploads/{id} [delete]
+
+// HandleResumableUpload is the HTTP handler for /uploads and /uploads/{id}.
+// Uploads can only be seen and resumed by the tenant that created them.
+func HandleResumableUpload(w http.ResponseWriter, r *http.Request, worker Worker, uploads *ResumableUploads) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	uploadID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(worker.maxUploadSize(), 10))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && uploadID == "":
+		uploads.create(w, r, worker, tenant)
+	case r.Method == http.MethodHead && uploadID != "":
+		uploads.head(w, uploadID, tenant)
+	case r.Method == http.MethodPatch && uploadID != "":
+		uploads.patch(w, r, worker, uploadID, tenant)
+	case r.Method == http.MethodDelete && uploadID != "":
+		uploads.terminate(w, uploadID, tenant)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (u *ResumableUploads) create(w http.ResponseWriter, r *http.Request, worker Worker, tenant auth.Tenant) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Upload-Length header must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	if length > worker.maxUploadSize() {
+		http.Error(w, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", worker.maxUploadSize()), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Don't let the client send a video that could not be processed or queued anyway
+	if tenant.WhisperAPIKey == "" {
+		http.Error(w, errNoWhisperAPIKey.Error(), http.StatusBadRequest)
+		return
+	}
+	client := clientID(r)
+	var admissionErr *AdmissionError
+	if err := worker.Quotas.Admit(tenant, 1, 0); errors.As(err, &admissionErr) {
+		writeAdmissionError(w, admissionErr)
+		return
+	}
+	if err := worker.Admission.Admit(client); errors.As(err, &admissionErr) {
+		writeAdmissionError(w, admissionErr)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fileName := filepath.Base(metadata["filename"])
+	if fileName == "." || fileName == string(filepath.Separator) {
+		http.Error(w, "Upload-Metadata must contain a filename", http.StatusBadRequest)
+		return
+	}
+	if err := validateCallbackURL(worker, metadata["callback_url"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.MkdirAll(partialDir(tenant), 0755); err != nil {
+		slog.Error("Failed to create partial upload directory", "error", err)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	partialPath := filepath.Join(partialDir(tenant), id)
+	file, err := os.Create(partialPath)
+	if err != nil {
+		slog.Error("Failed to create partial upload file", "error", err)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	upload := &resumableUpload{
+		ID:          id,
+		FileName:    fileName,
+		CallbackURL: metadata["callback_url"],
+		ClientID:    client,
+		TenantID:    tenant.ID,
+		Length:      length,
+		PartialPath: partialPath,
+		ExpiresAt:   time.Now().Add(u.expiry),
+	}
+	if err := upload.save(); err != nil {
+		os.Remove(partialPath)
+		slog.Error("Failed to save resumable upload", "error", err)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	u.mu.Lock()
+	u.uploads[id] = upload
+	u.mu.Unlock()
+
+	slog.Info("Created resumable upload", "upload_id", id, "file_name", fileName, "length", length)
+
+	w.Header().Set("Location", "/uploads/"+id)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (u *ResumableUploads) head(w http.ResponseWriter, uploadID string, tenant auth.Tenant) {
+	upload, ok := u.get(uploadID, tenant)
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.JobID != "" {
+		w.Header().Set("Upload-Job-Id", upload.JobID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *ResumableUploads) patch(w http.ResponseWriter, r *http.Request, worker Worker, uploadID string, tenant auth.Tenant) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset header must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	upload, ok := u.get(uploadID, tenant)
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	// Only one chunk may be written to an upload at a time
+	if !upload.mu.TryLock() {
+		http.Error(w, "Another chunk is being written to this upload", http.StatusConflict)
+		return
+	}
+	defer upload.mu.Unlock()
+
+	if upload.JobID != "" {
+		http.Error(w, "Upload is already complete", http.StatusConflict)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, fmt.Sprintf("Upload-Offset %d does not match the current offset %d", offset, upload.Offset), http.StatusConflict)
+		return
+	}
+
+	// Checked again for every chunk, the key may have been removed since the upload was created
+	if tenant.WhisperAPIKey == "" {
+		http.Error(w, errNoWhisperAPIKey.Error(), http.StatusBadRequest)
+		return
+	}
+	if left := upload.Length - upload.Offset; r.ContentLength > left {
+		http.Error(w, fmt.Sprintf("Chunk of %d bytes is longer than the %d bytes left of Upload-Length", r.ContentLength, left), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	file, err := os.OpenFile(upload.PartialPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Failed to open partial upload", "upload_id", upload.ID, "error", err)
+		http.Error(w, "failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+
+	// Whatever arrived before a dropped connection is kept, the client resumes from the new offset
+	written, copyErr := io.Copy(file, io.LimitReader(r.Body, upload.Length-upload.Offset))
+	closeErr := file.Close()
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(u.expiry)
+	if err := upload.save(); err != nil {
+		// The upload can still be resumed until the service restarts
+		slog.Warn("Failed to save resumable upload", "upload_id", upload.ID, "error", err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	if copyErr != nil || closeErr != nil {
+		slog.Warn("Resumable upload interrupted", "upload_id", upload.ID, "offset", upload.Offset, "error", errors.Join(copyErr, closeErr))
+		http.Error(w, "failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if upload.Offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	u.finish(w, worker, upload, tenant)
+}
+
+// finish moves the completed upload into managed storage and queues it as a job.
+// The caller must hold upload.mu.
+func (u *ResumableUploads) finish(w http.ResponseWriter, worker Worker, upload *resumableUpload, tenant auth.Tenant) {
+	if err := os.MkdirAll(tenant.UploadDir(), 0755); err != nil {
+		slog.Error("Failed to create upload directory", "error", err)
+		http.Error(w, "failed to store uploaded video", http.StatusInternalServerError)
+		return
+	}
+	dir, err := os.MkdirTemp(tenant.UploadDir(), "upload-")
+	if err != nil {
+		slog.Error("Failed to create upload directory", "error", err)
+		http.Error(w, "failed to store uploaded video", http.StatusInternalServerError)
+		return
+	}
+
+	videoPath := filepath.Join(dir, upload.FileName)
+	if err := os.Rename(upload.PartialPath, videoPath); err != nil {
+		os.RemoveAll(dir)
+		slog.Error("Failed to move completed upload", "upload_id", upload.ID, "error", err)
+		http.Error(w, "failed to store uploaded video", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Resumable upload complete", "upload_id", upload.ID, "path", videoPath)
+
+	status, created, err := registerJob(worker, tenant, jobs.Status{
+		FileName:            upload.FileName,
+		UnprocessedFilePath: videoPath,
+		CallbackURL:         upload.CallbackURL,
+		ClientID:            upload.ClientID,
+		TenantID:            tenant.ID,
+	})
+	if err == nil && !created {
+		// The same video is already processed by another job
+		os.RemoveAll(dir)
+	}
+	if err != nil {
+		// registerJob leaves no job behind when it fails, so nothing points at videoPath: the
+		// partial file is put back and the client finishes the upload later by sending an empty
+		// chunk at the final offset
+		if renameErr := os.Rename(videoPath, upload.PartialPath); renameErr != nil {
+			slog.Error("Failed to put back completed upload", "upload_id", upload.ID, "path", videoPath, "error", renameErr)
+		} else {
+			os.RemoveAll(dir)
+		}
+		writeSubmitError(w, upload.ClientID, err)
+		return
+	}
+
+	// Completed uploads are kept until they expire so HEAD can still report the job id
+	upload.JobID = status.ID
+	if err := upload.save(); err != nil {
+		slog.Warn("Failed to save resumable upload", "upload_id", upload.ID, "error", err)
+	}
+
+	w.Header().Set("Upload-Job-Id", status.ID)
+	writeJSON(w, http.StatusOK, newUploadResponse(status, created, "Video uploaded and queued for processing, please wait for callback."))
+}
+
+func (u *ResumableUploads) terminate(w http.ResponseWriter, uploadID string, tenant auth.Tenant) {
+	u.mu.Lock()
+	upload, ok := u.uploads[uploadID]
+	ok = ok && upload.TenantID == tenant.ID
+	if ok {
+		delete(u.uploads, uploadID)
+	}
+	u.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	upload.mu.Lock()
+	upload.remove()
+	upload.mu.Unlock()
+
+	slog.Info("Resumable upload terminated by request", "upload_id", uploadID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// get returns the upload if it was created by the tenant
+func (u *ResumableUploads) get(uploadID string, tenant auth.Tenant) (*resumableUpload, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	upload, ok := u.uploads[uploadID]
+	if !ok || upload.TenantID != tenant.ID {
+		return nil, false
+	}
+	return upload, true
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header ("key base64value,key2 base64value2")
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.New("malformed Upload-Metadata header")
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed Upload-Metadata value for %q: %v", fields[0], err)
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,192 @@
+package upload
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+func testUploadTenants(t *testing.T) *auth.Tenants {
+	t.Helper()
+	root := t.TempDir()
+	tenants, err := auth.NewTenants([]auth.Tenant{{
+		ID:            "acme",
+		APIKeys:       []string{"acme-api-key-0123456789"},
+		InputRoot:     root,
+		OutputRoot:    root,
+		WhisperAPIKey: "whisper-key",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tenants
+}
+
+// tusRequest sends a request of the tenant acme to the resumable upload handler
+func tusRequest(worker Worker, uploads *ResumableUploads, tenants *auth.Tenants, method, path string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	tenant, _ := tenants.Get("acme")
+	req = req.WithContext(auth.WithTenant(req.Context(), tenant))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	HandleResumableUpload(rec, req, worker, uploads)
+	return rec
+}
+
+func createUpload(t *testing.T, worker Worker, uploads *ResumableUploads, tenants *auth.Tenants, length int) string {
+	t.Helper()
+	rec := tusRequest(worker, uploads, tenants, http.MethodPost, "/uploads", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("lecture.mp4")),
+	}, "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /uploads = %d %s", rec.Code, rec.Body.String())
+	}
+	return rec.Header().Get("Location")
+}
+
+func patchChunk(worker Worker, uploads *ResumableUploads, tenants *auth.Tenants, location string, offset int, chunk string) *httptest.ResponseRecorder {
+	return tusRequest(worker, uploads, tenants, http.MethodPatch, location, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, chunk)
+}
+
+func TestResumableUploadRejectsMismatches(t *testing.T) {
+	tenants := testUploadTenants(t)
+	uploads := NewResumableUploads(tenants, time.Hour)
+	worker := Worker{JobQueue: make(chan Job, 1), Registry: jobs.NewRegistry()}
+	location := createUpload(t, worker, uploads, tenants, 10)
+
+	steps := []struct {
+		name        string
+		contentType string
+		offset      string
+		chunk       string
+		wantCode    int
+		wantOffset  string
+	}{
+		{"offset ahead of the upload", "", "5", "hello", http.StatusConflict, "0"},
+		{"first chunk", "", "0", "hello", http.StatusNoContent, "5"},
+		{"chunk sent again", "", "0", "hello", http.StatusConflict, "5"},
+		{"offset behind the upload", "", "3", "lo", http.StatusConflict, "5"},
+		{"chunk past the length", "", "5", "world!", http.StatusRequestEntityTooLarge, ""},
+		{"negative offset", "", "-1", "world", http.StatusBadRequest, ""},
+		{"offset not a number", "", "five", "world", http.StatusBadRequest, ""},
+		{"wrong content type", "application/octet-stream", "5", "world", http.StatusUnsupportedMediaType, ""},
+	}
+	for _, step := range steps {
+		contentType := step.contentType
+		if contentType == "" {
+			contentType = "application/offset+octet-stream"
+		}
+		rec := tusRequest(worker, uploads, tenants, http.MethodPatch, location, map[string]string{
+			"Content-Type":  contentType,
+			"Upload-Offset": step.offset,
+		}, step.chunk)
+		if rec.Code != step.wantCode {
+			t.Errorf("%s: PATCH = %d %s, want %d", step.name, rec.Code, rec.Body.String(), step.wantCode)
+		}
+		if step.wantOffset != "" && rec.Header().Get("Upload-Offset") != step.wantOffset {
+			t.Errorf("%s: Upload-Offset = %q, want %q", step.name, rec.Header().Get("Upload-Offset"), step.wantOffset)
+		}
+	}
+
+	// None of the rejected chunks was written
+	rec := tusRequest(worker, uploads, tenants, http.MethodHead, location, nil, "")
+	if rec.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("HEAD Upload-Offset = %q, want 5", rec.Header().Get("Upload-Offset"))
+	}
+	if len(worker.JobQueue) != 0 {
+		t.Error("incomplete upload queued")
+	}
+}
+
+func TestResumableUploadResumesAfterRestart(t *testing.T) {
+	tenants := testUploadTenants(t)
+	worker := Worker{JobQueue: make(chan Job, 1), Registry: jobs.NewRegistry()}
+	uploads := NewResumableUploads(tenants, time.Hour)
+	location := createUpload(t, worker, uploads, tenants, 11)
+	if rec := patchChunk(worker, uploads, tenants, location, 0, "hello "); rec.Code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d %s", rec.Code, rec.Body.String())
+	}
+
+	// The service restarts, the client asks where to resume from
+	restarted := NewResumableUploads(tenants, time.Hour)
+	rec := tusRequest(worker, restarted, tenants, http.MethodHead, location, nil, "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "6" || rec.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("HEAD after restart = %d, offset %q, length %q", rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+
+	rec = patchChunk(worker, restarted, tenants, location, 6, "world")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("last PATCH = %d %s", rec.Code, rec.Body.String())
+	}
+	var response UploadResponse
+	json.NewDecoder(rec.Body).Decode(&response)
+	status, ok := worker.Registry.Get(response.JobID)
+	if !ok || len(worker.JobQueue) != 1 {
+		t.Fatalf("job %q registered %v, %d queued", response.JobID, ok, len(worker.JobQueue))
+	}
+	if video, _ := os.ReadFile(status.UnprocessedFilePath); string(video) != "hello world" {
+		t.Errorf("queued video holds %q, want both chunks", video)
+	}
+
+	// Once complete, the upload reports its job after another restart
+	rec = tusRequest(worker, NewResumableUploads(tenants, time.Hour), tenants, http.MethodHead, location, nil, "")
+	if rec.Header().Get("Upload-Job-Id") != status.ID || rec.Header().Get("Upload-Offset") != "11" {
+		t.Errorf("HEAD of the complete upload = job %q, offset %q", rec.Header().Get("Upload-Job-Id"), rec.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestResumableUploadFinishedLaterWhenQueueIsFull(t *testing.T) {
+	tenants := testUploadTenants(t)
+	uploads := NewResumableUploads(tenants, time.Hour)
+	// Without an admission controller, the queue without room is only found full when the job is sent
+	worker := Worker{JobQueue: make(chan Job), Registry: jobs.NewRegistry()}
+	location := createUpload(t, worker, uploads, tenants, 5)
+
+	rec := patchChunk(worker, uploads, tenants, location, 0, "hello")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("last PATCH with the queue full = %d %s, want a 503 with Retry-After", rec.Code, rec.Body.String())
+	}
+	if registered := worker.Registry.List(); len(registered) != 0 {
+		t.Errorf("%d jobs left behind by the upload that could not be queued: %+v", len(registered), registered)
+	}
+
+	worker.JobQueue = make(chan Job, 1)
+	rec = patchChunk(worker, uploads, tenants, location, 5, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("empty PATCH at the final offset = %d %s", rec.Code, rec.Body.String())
+	}
+	job := <-worker.JobQueue
+	if video, err := os.ReadFile(job.UnprocessedFilePath); err != nil || string(video) != "hello" {
+		t.Errorf("queued video = %q, %v", video, err)
+	}
+}
+
+func TestResumableUploadRequiresWhisperKey(t *testing.T) {
+	root := t.TempDir()
+	tenants, err := auth.NewTenants([]auth.Tenant{{ID: "acme", APIKeys: []string{"acme-api-key-0123456789"}, InputRoot: root, OutputRoot: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads := NewResumableUploads(tenants, time.Hour)
+	rec := tusRequest(Worker{}, uploads, tenants, http.MethodPost, "/uploads", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("lecture.mp4")),
+	}, "")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /uploads without a Whisper key = %d, want 400 before any chunk is sent", rec.Code)
+	}
+}
@@ -0,0 +1,70 @@
+package upload
+
+import (
+	"time"
+	"videoUploadAndProcessing/pkg/retry"
+)
+
+// Stages that have their own retry policy
+const (
+	RetryStageExtract      = "extract"       // ffmpeg audio extraction
+	RetryStageTranscribe   = "transcribe"    // Whisper API call
+	RetryStageSplit        = "split"         // ffmpeg split into segments
+	RetryStageTTS          = "tts"           // Acapela call of a single segment
+	RetryStageSegmentMerge = "segment_merge" // ffmpeg merge of a single segment with its voice-over
+	RetryStageConcat       = "concat"        // ffmpeg concat of all segments
+	RetryStageTransfer     = "transfer"      // download of an s3:// input, upload of the outputs
+	RetryStageJob          = "job"           // the whole job, resumed from its checkpoint
+)
+
+// RetryStages lists every stage with a retry policy
+var RetryStages = []string{
+	RetryStageExtract,
+	RetryStageTranscribe,
+	RetryStageSplit,
+	RetryStageTTS,
+	RetryStageSegmentMerge,
+	RetryStageConcat,
+	RetryStageTransfer,
+	RetryStageJob,
+}
+
+// DefaultRetryPolicies returns the retry policy of every stage
+func DefaultRetryPolicies() retry.Policies {
+	base := retry.Policy{
+		MaxAttempts:    2,
+		InitialBackoff: InitialBackoffDuration,
+		MaxBackoff:     MaxBackoffDuration,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+
+	// The remote APIs are the flakiest part of the pipeline, give them more attempts
+	transcribe := base
+	transcribe.MaxAttempts = 4
+	transcribe.InitialBackoff = 2 * time.Second
+	transcribe.MaxBackoff = 30 * time.Second
+
+	tts := base
+	tts.MaxAttempts = 5
+	tts.InitialBackoff = time.Second
+
+	segmentMerge := base
+	segmentMerge.MaxAttempts = 3
+
+	// Object stores answer 503 SlowDown under load, back off longer before trying again
+	transfer := base
+	transfer.MaxAttempts = 4
+	transfer.InitialBackoff = time.Second
+
+	return retry.Policies{
+		RetryStageExtract:      base,
+		RetryStageTranscribe:   transcribe,
+		RetryStageSplit:        base,
+		RetryStageTTS:          tts,
+		RetryStageSegmentMerge: segmentMerge,
+		RetryStageConcat:       base,
+		RetryStageTransfer:     transfer,
+		RetryStageJob:          base,
+	}
+}
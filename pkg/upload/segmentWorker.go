@@ -1,11 +1,18 @@
 package upload
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 	"videoUploadAndProcessing/pkg/acapela_api"
+	"videoUploadAndProcessing/pkg/events"
+	"videoUploadAndProcessing/pkg/logging"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/tracing"
 	"videoUploadAndProcessing/pkg/video_processing"
 	"videoUploadAndProcessing/pkg/whisper_api"
 )
@@ -14,31 +21,54 @@ type SegmentJob struct {
 	SRTSegment    whisper_api.SRTSegment
 	VideoPath     string
 	Suffix        string
+	Credentials   acapela_api.Credentials // 合成語音使用的 Acapela 帳號
 	SegmentIdx    int
 	TempDirPrefix string
+	Subtitles     bool // 是否將字幕燒進片段
 }
 
 type SegmentWorker struct {
-	ID          int
-	JobQueue    chan SegmentJob
-	SegmentPath *string
-	SegmentIdx  int
+	ID            int
+	JobQueue      chan SegmentJob
+	SegmentPath   *string
+	SegmentIdx    int
+	Checkpoint    *checkpoint     // 記錄已完成的片段，可為 nil
+	RetryPolicies retry.Policies  // 單一片段失敗時的重試策略
+	OnDubbed      func(int)       // 片段完成時呼叫，可為 nil
+	TTS           *TTSReservation // 片段寫入檢查點後向租戶計費的 TTS 字元，可為 nil
 }
 
 const MaxSegmentWorkers = 100 // Limit of concurrent workers
 
-func (w SegmentWorker) Start(wg *sync.WaitGroup, errors chan<- error) {
+func (w SegmentWorker) Start(ctx context.Context, wg *sync.WaitGroup, errors chan<- error) {
 	go func() {
 		for job := range w.JobQueue {
-			log.Printf("SegmentWorker %d: Starting processing for segment %d", w.ID, job.SegmentIdx)
-			// Convert text to speech
-			audioSegment, err := acapela_api.ConvertTextToSpeechUsingAcapela(job.SRTSegment.Text, job.Suffix, job.SegmentIdx, job.TempDirPrefix)
+			// Skip pending segments once the job has been cancelled or timed out
+			if err := ctx.Err(); err != nil {
+				segmentsProcessed.Inc("skipped")
+				errors <- segmentError(job.SegmentIdx, fmt.Errorf("SegmentWorker %d: segment %d not processed: %w", w.ID, job.SegmentIdx, err))
+				continue
+			}
+
+			segmentCtx, span := tracing.Start(ctx, "segment", tracing.Int("segment.index", job.SegmentIdx), tracing.Int("segment_worker.id", w.ID))
+			segmentCtx = logging.With(segmentCtx, "segment_index", job.SegmentIdx)
+			slog.DebugContext(segmentCtx, "Starting processing of segment")
+			// Convert text to speech, retrying this segment alone if Acapela has a hiccup
+			var audioSegment string
+			err := retry.Do(segmentCtx, w.RetryPolicies.For(RetryStageTTS), fmt.Sprintf("TTS of segment %d", job.SegmentIdx), func() error {
+				var err error
+				audioSegment, err = acapela_api.ConvertTextToSpeechUsingAcapela(segmentCtx, job.Credentials, job.SRTSegment.Text, job.Suffix, job.SegmentIdx, job.TempDirPrefix)
+				return err
+			})
 			if err != nil {
-				errors <- fmt.Errorf("SegmentWorker %d: failed to convert text to speech for segment %d: %v", w.ID, job.SegmentIdx, err)
+				segmentsProcessed.Inc("failed")
+				span.RecordError(err)
+				span.End()
+				errors <- segmentError(job.SegmentIdx, fmt.Errorf("SegmentWorker %d: failed to convert text to speech for segment %d: %w", w.ID, job.SegmentIdx, err))
 				continue
 			}
 
-			log.Printf("SegmentWorker %d: Converted text to speech for segment %d", w.ID, job.SegmentIdx)
+			slog.DebugContext(segmentCtx, "Converted text to speech")
 			// Merge the voice-over with the video segment and overwrite the original segment
 			var mergedSegment string
 			if strings.HasSuffix(job.VideoPath, ".mp4") {
@@ -47,15 +77,27 @@ func (w SegmentWorker) Start(wg *sync.WaitGroup, errors chan<- error) {
 				mergedSegment = job.VideoPath + "_merged.mp4"
 			}
 
-			err = video_processing.MergeVideoAndAudioBySegments(job.VideoPath, audioSegment, mergedSegment, job.SegmentIdx, job.TempDirPrefix)
-			if err != nil {
-				errors <- fmt.Errorf("SegmentWorker %d: failed to merge video and audio for segment %d: %v", w.ID, job.SegmentIdx, err)
-				continue
-			}
-
-			err = video_processing.AddSubtitlesToSegment(mergedSegment, job.SRTSegment, mergedSegment, job.SegmentIdx, job.TempDirPrefix)
+			// Both steps are retried together since adding subtitles rewrites the merged segment
+			err = retry.Do(segmentCtx, w.RetryPolicies.For(RetryStageSegmentMerge), fmt.Sprintf("Merge of segment %d", job.SegmentIdx), func() error {
+				err := video_processing.MergeVideoAndAudioBySegments(segmentCtx, job.VideoPath, audioSegment, mergedSegment, job.SegmentIdx, job.TempDirPrefix)
+				if err != nil {
+					return fmt.Errorf("failed to merge video and audio: %w", err)
+				}
+				if !job.Subtitles {
+					return nil
+				}
+
+				err = video_processing.AddSubtitlesToSegment(segmentCtx, mergedSegment, job.SRTSegment, mergedSegment, job.SegmentIdx, job.TempDirPrefix)
+				if err != nil {
+					return fmt.Errorf("failed to add subtitles: %w", err)
+				}
+				return nil
+			})
 			if err != nil {
-				errors <- fmt.Errorf("SegmentWorker %d: failed to add subtitles to segment %d: %v", w.ID, job.SegmentIdx, err)
+				segmentsProcessed.Inc("failed")
+				span.RecordError(err)
+				span.End()
+				errors <- segmentError(job.SegmentIdx, fmt.Errorf("SegmentWorker %d: failed to merge segment %d: %w", w.ID, job.SegmentIdx, err))
 				continue
 			}
 
@@ -64,7 +106,25 @@ func (w SegmentWorker) Start(wg *sync.WaitGroup, errors chan<- error) {
 			// Store the merged segment path at the location pointed to by SegmentPath
 			*w.SegmentPath = mergedSegment
 			// Add a log here to trace the stored path
-			log.Printf("SegmentWorker %d: Stored merged segment path for segment %d: %s", w.ID, job.SegmentIdx, *w.SegmentPath)
+			slog.DebugContext(segmentCtx, "Stored merged segment path", "path", *w.SegmentPath)
+
+			// Record the finished segment so a resumed job does not pay for its TTS again, and only
+			// charge it once it is recorded: a segment that is not will be dubbed, and charged, again
+			checkpointed := true
+			if w.Checkpoint != nil {
+				if err := w.Checkpoint.markSegmentDubbed(job.SegmentIdx, mergedSegment); err != nil {
+					slog.WarnContext(segmentCtx, "Failed to checkpoint segment", "error", err)
+					checkpointed = false
+				}
+			}
+			if checkpointed {
+				w.TTS.Charge(utf8.RuneCountInString(job.SRTSegment.Text))
+			}
+			segmentsProcessed.Inc("dubbed")
+			span.End()
+			if w.OnDubbed != nil {
+				w.OnDubbed(job.SegmentIdx)
+			}
 		}
 
 		// Add a log here to check the final value of *w.SegmentPath
@@ -76,39 +136,73 @@ func (w SegmentWorker) Start(wg *sync.WaitGroup, errors chan<- error) {
 }
 
 // Handles the logic for segment workers.
-func ProcessSegmentJobs(voiceSegmentPaths []string, allSegmentPaths []string, srtSegments []whisper_api.SRTSegment, tempDirPrefix string) ([]string, error) {
+// Cancelling ctx aborts the segments in flight and skips the ones that have not started yet.
+// Segments already recorded in cp (which may be nil) are reused instead of being dubbed again.
+// Every dubbed segment is reported to progress, which may be nil, and dubbed with the Acapela voice
+// and subtitles of options, synthesized with the Acapela account creds. The characters of every
+// dubbed segment are charged to tts, which may be nil.
+func ProcessSegmentJobs(ctx context.Context, cp *checkpoint, policies retry.Policies, progress *events.Reporter, options ProcessingOptions, creds acapela_api.Credentials, tts *TTSReservation, voiceSegmentPaths []string, allSegmentPaths []string, srtSegments []whisper_api.SRTSegment, tempDirPrefix string) ([]string, error) {
 	var wg sync.WaitGroup
 	errors := make(chan error, len(voiceSegmentPaths))
 
 	mergedSegments := make([]string, len(allSegmentPaths))
 	copy(mergedSegments, allSegmentPaths)
 
-	segmentWorkers := make([]SegmentWorker, len(voiceSegmentPaths))
+	var pending []int // voice segments that still have to be dubbed
 	for i, voiceSegment := range voiceSegmentPaths {
 		idx := indexOf(voiceSegment, allSegmentPaths)
-		segmentWorkers[i] = SegmentWorker{
-			ID:          i,
-			JobQueue:    make(chan SegmentJob, 1),
-			SegmentPath: &mergedSegments[idx],
-			SegmentIdx:  idx,
+		if cp != nil {
+			if dubbedSegment, ok := cp.dubbedSegment(i); ok {
+				mergedSegments[idx] = dubbedSegment
+				continue
+			}
+		}
+		pending = append(pending, i)
+	}
+	if skipped := len(voiceSegmentPaths) - len(pending); skipped > 0 {
+		segmentsProcessed.Add(float64(skipped), "reused")
+		slog.InfoContext(ctx, "Reusing dubbed segments from checkpoint", "reused", skipped, "left", len(pending))
+	}
+
+	// Segments reused from the checkpoint count as done
+	total := len(voiceSegmentPaths)
+	done := int64(total - len(pending))
+	onDubbed := func(segmentIdx int) {
+		progress.SegmentDubbed(segmentIdx, int(atomic.AddInt64(&done, 1)), total)
+	}
+
+	segmentWorkers := make([]SegmentWorker, len(pending))
+	for n, i := range pending {
+		idx := indexOf(voiceSegmentPaths[i], allSegmentPaths)
+		segmentWorkers[n] = SegmentWorker{
+			ID:            i,
+			JobQueue:      make(chan SegmentJob, 1),
+			SegmentPath:   &mergedSegments[idx],
+			SegmentIdx:    idx,
+			Checkpoint:    cp,
+			RetryPolicies: policies,
+			OnDubbed:      onDubbed,
+			TTS:           tts,
 		}
 	}
 
-	wg.Add(len(voiceSegmentPaths))
+	wg.Add(len(segmentWorkers))
 
-	for i := 0; i < len(segmentWorkers); i++ {
-		segmentWorkers[i].Start(&wg, errors)
+	for n := 0; n < len(segmentWorkers); n++ {
+		segmentWorkers[n].Start(ctx, &wg, errors)
 	}
 
-	for i := 0; i < len(voiceSegmentPaths); i++ {
+	for n, i := range pending {
 		segmentJob := SegmentJob{
 			SRTSegment:    srtSegments[i],
 			VideoPath:     voiceSegmentPaths[i],
-			Suffix:        "Ryan22k_NT",
+			Suffix:        options.Voice,
+			Credentials:   creds,
 			SegmentIdx:    i,
 			TempDirPrefix: tempDirPrefix, // 新增這行
+			Subtitles:     options.burnSubtitles(),
 		}
-		segmentWorkers[i].JobQueue <- segmentJob
+		segmentWorkers[n].JobQueue <- segmentJob
 	}
 
 	for i := 0; i < len(segmentWorkers); i++ {
@@ -120,7 +214,7 @@ func ProcessSegmentJobs(voiceSegmentPaths []string, allSegmentPaths []string, sr
 	close(errors)
 	for err := range errors {
 		if err != nil {
-			log.Printf("Error processing segment: %v", err)
+			slog.ErrorContext(ctx, "Error processing segment", "error", err)
 			return nil, err
 		}
 	}
@@ -0,0 +1,68 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/storage"
+)
+
+var errNoWhisperAPIKey = errors.New("no Whisper API key is configured for this tenant")
+
+var errInvalidPathPrefix = errors.New("invalid video path prefix")
+
+// requestTenant returns the tenant the request was authenticated as by auth.Middleware,
+// and responds with 401 if there is none
+func requestTenant(w http.ResponseWriter, r *http.Request) (auth.Tenant, bool) {
+	tenant, ok := auth.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Missing or invalid API key", http.StatusUnauthorized)
+	}
+	return tenant, ok
+}
+
+// getJob returns the job if it belongs to the tenant. Jobs of other tenants are reported as not found.
+func getJob(worker Worker, tenant auth.Tenant, jobID string) (jobs.Status, bool) {
+	status, ok := worker.Registry.Get(jobID)
+	if !ok || !tenant.Owns(status.TenantID) {
+		return jobs.Status{}, false
+	}
+	return status, true
+}
+
+// tenantJobs keeps the jobs that belong to the tenant
+func tenantJobs(tenant auth.Tenant, list []jobs.Status) []jobs.Status {
+	owned := make([]jobs.Status, 0, len(list))
+	for _, status := range list {
+		if tenant.Owns(status.TenantID) {
+			owned = append(owned, status)
+		}
+	}
+	return owned
+}
+
+// checkInputPath makes sure the tenant may submit the video: a file under its input root, or an
+// s3://bucket/key object of one of the input buckets of the storage, under its S3 input prefixes
+func checkInputPath(store *storage.Storage, tenant auth.Tenant, path string) error {
+	if storage.IsS3URI(path) {
+		return store.CheckInput(path, tenant.S3InputPrefixes)
+	}
+	if !underRoot(tenant.InputRoot, path) {
+		return fmt.Errorf("%w: %s", errInvalidPathPrefix, path)
+	}
+	return nil
+}
+
+// underRoot reports whether path is inside root once both are cleaned
+func underRoot(root string, path string) bool {
+	if root == "" {
+		return false
+	}
+	root = filepath.Clean(root)
+	path = filepath.Clean(path)
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
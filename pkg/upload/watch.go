@@ -0,0 +1,469 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+// Folders, directly under the watched directory, the videos are moved to while and after they are processed
+const (
+	WatchProcessingDir = "processing"
+	WatchDoneDir       = "done"
+	WatchFailedDir     = "failed"
+)
+
+const DefaultWatchPollInterval = 5 * time.Second // 監看資料夾的預設輪詢間隔
+const DefaultWatchStableFor = 10 * time.Second   // 檔案需維持不變多久才視為寫入完成
+const DefaultWatchPattern = "*.mp4"              // 監看資料夾預設處理的檔名
+
+// Client the jobs of the watched folder are admitted as
+const watchClientID = "watch-folder"
+
+// Extension of the sidecar file of a video, and suffix of the file describing why a video failed
+const (
+	sidecarExt      = ".json"
+	errorFileSuffix = ".error.json"
+)
+
+// WatchOptions are the per-file options of a video, read from the optional sidecar JSON file next to
+// it with the same name, e.g. lecture.json for lecture.mp4
+type WatchOptions struct {
+	CallbackURL string `json:"callback_url"`
+	Voice       string `json:"voice"`
+	Language    string `json:"language"`  // ISO 639-1 code of the language spoken in the video
+	Subtitles   string `json:"subtitles"` // burn, srt, both or none
+}
+
+// watchFailure is written next to a video moved to failed/, in <video>.error.json
+type watchFailure struct {
+	JobID   string        `json:"job_id,omitempty"`
+	State   jobs.State    `json:"state,omitempty"`
+	Failure *jobs.Failure `json:"failure,omitempty"`
+	Error   string        `json:"error,omitempty"` // why the video could not be submitted
+}
+
+// FolderWatcher submits the videos dropped into the input root of a tenant. A video is submitted once
+// it and its sidecar file have not changed for a while, and is moved to processing/ while its job
+// runs, then to done/ or failed/, keeping its path relative to the input root.
+type FolderWatcher struct {
+	worker    Worker
+	tenant    auth.Tenant
+	root      string
+	pattern   string
+	interval  time.Duration
+	stableFor time.Duration
+
+	seen map[string]watchedFile // files waiting to be stable, only used by the polling goroutine
+
+	mu         sync.Mutex
+	duplicates map[string][]string // videos in processing/ waiting for the job they duplicate to finish, by job ID
+}
+
+// watchedFile is what was last seen of a video and its sidecar file
+type watchedFile struct {
+	size           int64
+	modTime        time.Time
+	sidecarSize    int64
+	sidecarModTime time.Time
+	since          time.Time // when the file was first seen like this
+}
+
+func NewFolderWatcher(worker Worker, tenant auth.Tenant, pattern string, interval time.Duration, stableFor time.Duration) *FolderWatcher {
+	if pattern == "" {
+		pattern = DefaultWatchPattern
+	}
+	if interval <= 0 {
+		interval = DefaultWatchPollInterval
+	}
+	if stableFor < 0 {
+		stableFor = DefaultWatchStableFor
+	}
+	return &FolderWatcher{
+		worker:     worker,
+		tenant:     tenant,
+		root:       filepath.Clean(tenant.InputRoot),
+		pattern:    pattern,
+		interval:   interval,
+		stableFor:  stableFor,
+		seen:       make(map[string]watchedFile),
+		duplicates: make(map[string][]string),
+	}
+}
+
+// Start settles the videos left in processing/ by the last run, then polls the input root until the
+// service starts draining. It must be called after the workers have been started.
+func (fw *FolderWatcher) Start() {
+	fw.worker.Registry.OnFinished(fw.jobFinished)
+	fw.recover()
+
+	slog.Info("Watching folder for new videos", "path", fw.root, "pattern", fw.pattern, "tenant_id", fw.tenant.ID)
+	go func() {
+		ticker := time.NewTicker(fw.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fw.worker.Drainer.Quit():
+				return
+			case now := <-ticker.C:
+				fw.poll(now)
+			}
+		}
+	}()
+}
+
+// poll submits the videos that stayed unchanged for stableFor
+func (fw *FolderWatcher) poll(now time.Time) {
+	paths, err := fw.listVideos()
+	if err != nil {
+		slog.Error("Failed to list watched folder", "path", fw.root, "error", err)
+		return
+	}
+
+	current := make(map[string]watchedFile, len(paths))
+	for _, path := range paths {
+		file, err := statWatchedFile(path)
+		if err != nil {
+			// Removed or renamed since it was listed
+			continue
+		}
+		if previous, ok := fw.seen[path]; ok && previous.sameAs(file) {
+			file.since = previous.since
+		} else {
+			file.since = now
+		}
+
+		// Only submitted once seen unchanged by two polls at least stableFor apart, and not written to for as long
+		if now.Sub(file.since) > 0 && now.Sub(file.since) >= fw.stableFor && now.Sub(file.modTime) >= fw.stableFor && now.Sub(file.sidecarModTime) >= fw.stableFor {
+			if fw.submit(path) {
+				continue
+			}
+		}
+		current[path] = file
+	}
+	fw.seen = current
+}
+
+// listVideos lists the videos of the input root and its subfolders, leaving out the processing/,
+// done/ and failed/ folders, the uploads of the API and hidden files
+func (fw *FolderWatcher) listVideos() ([]string, error) {
+	skipped := map[string]bool{
+		filepath.Join(fw.root, WatchProcessingDir): true,
+		filepath.Join(fw.root, WatchDoneDir):       true,
+		filepath.Join(fw.root, WatchFailedDir):     true,
+		filepath.Clean(fw.tenant.UploadDir()):      true,
+		filepath.Clean(fw.tenant.OutputRoot):       true,
+	}
+
+	var paths []string
+	err := filepath.WalkDir(fw.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != fw.root && (skipped[path] || strings.HasPrefix(entry.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fw.isVideo(entry) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+func (fw *FolderWatcher) isVideo(entry fs.DirEntry) bool {
+	name := entry.Name()
+	if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, sidecarExt) {
+		return false
+	}
+	matched, _ := filepath.Match(fw.pattern, name)
+	return matched
+}
+
+// submit moves the video to processing/ and registers its job. It reports false when the video was
+// left in place to be submitted again later, because the job could not be admitted right now.
+func (fw *FolderWatcher) submit(path string) bool {
+	rel, err := filepath.Rel(fw.root, path)
+	if err != nil {
+		return false
+	}
+
+	options, err := readSidecar(sidecarPath(path))
+	if err != nil {
+		slog.Warn("Invalid sidecar file, moving video to failed", "path", path, "error", err)
+		fw.moveToFailed(path, rel, watchFailure{Error: err.Error()})
+		return true
+	}
+
+	processingPath := uniqueVideoPath(filepath.Join(fw.root, WatchProcessingDir, rel))
+	if err := moveVideo(path, processingPath); err != nil {
+		slog.Error("Failed to move watched video to processing", "path", path, "error", err)
+		return false
+	}
+
+	status, created, err := registerJob(fw.worker, fw.tenant, jobs.Status{
+		FileName:            filepath.Base(path),
+		UnprocessedFilePath: processingPath,
+		CallbackURL:         options.CallbackURL,
+		ClientID:            watchClientID,
+		TenantID:            fw.tenant.ID,
+		Voice:               options.Voice,
+		Language:            options.Language,
+		Subtitles:           options.Subtitles,
+	})
+	var admissionErr *AdmissionError
+	switch {
+	case errors.As(err, &admissionErr):
+		// Put it back so it is submitted again on a later poll
+		slog.Debug("Watched video not admitted yet, retrying later", "path", path, "error", err)
+		if err := moveVideo(processingPath, path); err != nil {
+			slog.Error("Failed to move watched video back", "path", processingPath, "error", err)
+		}
+		return false
+	case err != nil:
+		slog.Warn("Failed to submit watched video, moving it to failed", "path", path, "error", err)
+		fw.moveToFailed(processingPath, rel, watchFailure{Error: err.Error()})
+	case !created:
+		slog.Info("Watched video duplicates an existing job, waiting for it to finish", "path", path, "job_id", status.ID)
+		fw.waitFor(status.ID, processingPath)
+	default:
+		slog.Info("Watched video queued", "path", path, "job_id", status.ID)
+	}
+	return true
+}
+
+// jobFinished moves the video of a job submitted by the watcher, and the duplicates waiting for it, to
+// done/ or failed/, and records where the video of the job went so that it can be retried. The video
+// of a failed job that was retried is moved from failed/ to done/ once it succeeds.
+func (fw *FolderWatcher) jobFinished(status jobs.Status) {
+	fw.settleDuplicates(status)
+
+	path := status.UnprocessedFilePath
+	if status.TenantID != fw.tenant.ID {
+		return
+	}
+	folder := filepath.Join(fw.root, WatchProcessingDir)
+	if !underRoot(folder, path) {
+		folder = filepath.Join(fw.root, WatchFailedDir)
+		if !underRoot(folder, path) {
+			return
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		// Already moved, e.g. by an earlier run
+		return
+	}
+	rel, err := filepath.Rel(folder, path)
+	if err != nil {
+		return
+	}
+
+	if folder == filepath.Join(fw.root, WatchFailedDir) {
+		if status.State != jobs.StateDone {
+			// Failed again, only its failure changes
+			fw.writeFailure(path, watchFailure{JobID: status.ID, State: status.State, Failure: status.Failure})
+			return
+		}
+		if err := os.Remove(path + errorFileSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to remove the failure of a watched video", "path", path, "error", err)
+		}
+	}
+	if dest := fw.settle(path, rel, status); dest != "" {
+		fw.worker.Registry.MoveInput(status.ID, dest)
+	}
+}
+
+// waitFor keeps a video duplicating the job in processing/ until the job finishes, then moves it like
+// the video of the job
+func (fw *FolderWatcher) waitFor(jobID string, path string) {
+	fw.mu.Lock()
+	fw.duplicates[jobID] = append(fw.duplicates[jobID], path)
+	fw.mu.Unlock()
+
+	// The job may have finished before the video was added, its listeners will not run again
+	if status, ok := fw.worker.Registry.Get(jobID); ok && status.State.Terminal() {
+		fw.settleDuplicates(status)
+	}
+}
+
+// settleDuplicates moves the videos waiting for the finished job to done/ or failed/
+func (fw *FolderWatcher) settleDuplicates(status jobs.Status) {
+	fw.mu.Lock()
+	paths := fw.duplicates[status.ID]
+	delete(fw.duplicates, status.ID)
+	fw.mu.Unlock()
+
+	processingDir := filepath.Join(fw.root, WatchProcessingDir)
+	for _, path := range paths {
+		rel, err := filepath.Rel(processingDir, path)
+		if err != nil {
+			continue
+		}
+		fw.settle(path, rel, status)
+	}
+}
+
+// settle moves a video of the finished job to rel under done/ or failed/ and returns where it went,
+// or "" when it could not be moved
+func (fw *FolderWatcher) settle(path string, rel string, status jobs.Status) string {
+	if status.State == jobs.StateDone {
+		return fw.moveFinished(path, WatchDoneDir, rel)
+	}
+	return fw.moveToFailed(path, rel, watchFailure{JobID: status.ID, State: status.State, Failure: status.Failure})
+}
+
+// recover moves the videos left in processing/ by the last run: those of finished jobs to done/ or
+// failed/, and those that never got a job back to the input root. Videos of unfinished jobs stay
+// there, the jobs are requeued.
+func (fw *FolderWatcher) recover() {
+	processingDir := filepath.Join(fw.root, WatchProcessingDir)
+	statuses := make(map[string]jobs.Status)
+	for _, status := range fw.worker.Registry.List() {
+		if underRoot(processingDir, status.UnprocessedFilePath) {
+			statuses[filepath.Clean(status.UnprocessedFilePath)] = status
+		}
+	}
+
+	err := filepath.WalkDir(processingDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() || !fw.isVideo(entry) {
+			return nil
+		}
+
+		status, ok := statuses[path]
+		switch {
+		case ok && status.State.Terminal():
+			fw.jobFinished(status)
+		case !ok:
+			rel, _ := filepath.Rel(processingDir, path)
+			slog.Info("Watched video has no job, moving it back to the watched folder", "path", path)
+			if err := moveVideo(path, uniqueVideoPath(filepath.Join(fw.root, rel))); err != nil {
+				slog.Error("Failed to move watched video back", "path", path, "error", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to recover videos left in processing", "path", processingDir, "error", err)
+	}
+}
+
+// moveFinished moves the video and its sidecar file to rel under the folder
+func (fw *FolderWatcher) moveFinished(path string, folder string, rel string) string {
+	dest := uniqueVideoPath(filepath.Join(fw.root, folder, rel))
+	if err := moveVideo(path, dest); err != nil {
+		slog.Error("Failed to move watched video", "path", path, "folder", folder, "error", err)
+		return ""
+	}
+	return dest
+}
+
+// moveToFailed moves the video to failed/, writes why it failed next to it and returns where it went
+func (fw *FolderWatcher) moveToFailed(path string, rel string, failure watchFailure) string {
+	dest := fw.moveFinished(path, WatchFailedDir, rel)
+	if dest != "" {
+		fw.writeFailure(dest, failure)
+	}
+	return dest
+}
+
+// writeFailure writes why the video failed next to it, in <video>.error.json
+func (fw *FolderWatcher) writeFailure(path string, failure watchFailure) {
+	if err := saveJSON(path+errorFileSuffix, failure); err != nil {
+		slog.Warn("Failed to write the failure of a watched video", "path", path, "error", err)
+	}
+}
+
+func statWatchedFile(path string) (watchedFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return watchedFile{}, err
+	}
+	file := watchedFile{size: info.Size(), modTime: info.ModTime()}
+	if sidecar, err := os.Stat(sidecarPath(path)); err == nil {
+		file.sidecarSize = sidecar.Size()
+		file.sidecarModTime = sidecar.ModTime()
+	}
+	return file, nil
+}
+
+func (f watchedFile) sameAs(other watchedFile) bool {
+	return f.size == other.size && f.modTime.Equal(other.modTime) &&
+		f.sidecarSize == other.sidecarSize && f.sidecarModTime.Equal(other.sidecarModTime)
+}
+
+// sidecarPath returns the sidecar file of a video: the same name with the .json extension
+func sidecarPath(videoPath string) string {
+	return strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + sidecarExt
+}
+
+// readSidecar reads the options of a sidecar file, which may not exist
+func readSidecar(path string) (WatchOptions, error) {
+	var options WatchOptions
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return options, nil
+	}
+	if err != nil {
+		return options, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&options); err != nil {
+		return options, fmt.Errorf("invalid sidecar file %s: %v", filepath.Base(path), err)
+	}
+	processingOptions := ProcessingOptions{Voice: options.Voice, Language: options.Language, Subtitles: options.Subtitles}
+	if err := processingOptions.Validate(); err != nil {
+		return options, fmt.Errorf("invalid sidecar file %s: %v", filepath.Base(path), err)
+	}
+	return options, nil
+}
+
+// moveVideo renames the video, and its sidecar file if it has one, creating the destination folder
+func moveVideo(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if err := os.Rename(sidecarPath(src), sidecarPath(dst)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// uniqueVideoPath returns path, or path with a _1, _2... suffix if a video or sidecar file already has that name
+func uniqueVideoPath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	candidate := path
+	for n := 1; exists(candidate) || exists(sidecarPath(candidate)); n++ {
+		candidate = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+	return candidate
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
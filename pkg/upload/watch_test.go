@@ -0,0 +1,141 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/jobs"
+)
+
+// writeVideo writes a file of the watched folder last modified at modTime
+func writeVideo(t *testing.T, path string, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventually waits for the finished listeners of the registry, which run in their own goroutines
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestWatcher(t *testing.T) (*FolderWatcher, string) {
+	t.Helper()
+	root := t.TempDir()
+	tenant := auth.Tenant{ID: "acme", InputRoot: root, OutputRoot: filepath.Join(root, "out"), WhisperAPIKey: "whisper-key"}
+	worker := Worker{JobQueue: make(chan Job, 4), Registry: jobs.NewRegistry()}
+	fw := NewFolderWatcher(worker, tenant, "", time.Second, 10*time.Second)
+	worker.Registry.OnFinished(fw.jobFinished)
+	return fw, root
+}
+
+func TestFolderWatcherSubmitsStableVideos(t *testing.T) {
+	fw, root := newTestWatcher(t)
+	start := time.Now()
+	video := filepath.Join(root, "course", "lecture.mp4")
+	writeVideo(t, video, "frames", start)
+	writeVideo(t, filepath.Join(root, "course", "lecture.json"), `{"language":"en"}`, start)
+
+	// Still being copied: it grows between the polls
+	fw.poll(start.Add(11 * time.Second))
+	writeVideo(t, video, "more frames", start.Add(15*time.Second))
+	fw.poll(start.Add(20 * time.Second))
+	fw.poll(start.Add(24 * time.Second))
+	if len(fw.worker.JobQueue) != 0 {
+		t.Fatal("video submitted before it stopped changing for stableFor")
+	}
+
+	fw.poll(start.Add(31 * time.Second))
+	if len(fw.worker.JobQueue) != 1 {
+		t.Fatalf("%d jobs queued once the video is stable, want 1", len(fw.worker.JobQueue))
+	}
+	job := <-fw.worker.JobQueue
+	processing := filepath.Join(root, WatchProcessingDir, "course", "lecture.mp4")
+	if job.UnprocessedFilePath != processing || !exists(processing) || !exists(filepath.Join(root, WatchProcessingDir, "course", "lecture.json")) {
+		t.Fatalf("job input %q, want the video and its sidecar moved to %s", job.UnprocessedFilePath, processing)
+	}
+	if exists(video) {
+		t.Error("video still in the watched folder")
+	}
+	status, _ := fw.worker.Registry.Get(job.ID)
+	if status.Language != "en" || status.ClientID != watchClientID {
+		t.Errorf("job = %+v, want the options of the sidecar", status)
+	}
+
+	// Once done, the video is moved to done/ and the job records where it went
+	fw.worker.Registry.Complete(job.ID, filepath.Join(root, "out", "lecture.mp4"), "")
+	done := filepath.Join(root, WatchDoneDir, "course", "lecture.mp4")
+	eventually(t, "the video to be moved to done/", func() bool {
+		status, _ := fw.worker.Registry.Get(job.ID)
+		return status.UnprocessedFilePath == done
+	})
+	if !exists(done) || !exists(filepath.Join(root, WatchDoneDir, "course", "lecture.json")) || exists(processing) {
+		t.Error("video and sidecar not moved from processing/ to done/")
+	}
+
+	// Videos in done/ are not submitted again
+	fw.poll(start.Add(time.Hour))
+	fw.poll(start.Add(2 * time.Hour))
+	if len(fw.worker.JobQueue) != 0 {
+		t.Error("video of done/ submitted again")
+	}
+}
+
+func TestFolderWatcherFailedVideos(t *testing.T) {
+	fw, root := newTestWatcher(t)
+	start := time.Now().Add(-time.Minute)
+	writeVideo(t, filepath.Join(root, "talk.mp4"), "frames", start)
+	writeVideo(t, filepath.Join(root, "broken.mp4"), "frames", start)
+	writeVideo(t, filepath.Join(root, "broken.json"), `{"subtitles":"sideways"}`, start)
+
+	fw.poll(start.Add(time.Minute))
+	fw.poll(start.Add(2 * time.Minute))
+
+	// An invalid sidecar fails the video without a job
+	failure, err := os.ReadFile(filepath.Join(root, WatchFailedDir, "broken.mp4"+errorFileSuffix))
+	if err != nil || !strings.Contains(string(failure), "sidecar") {
+		t.Errorf("failure of the video with an invalid sidecar = %q, %v", failure, err)
+	}
+
+	job := <-fw.worker.JobQueue
+	fw.worker.Registry.Fail(job.ID, &jobs.Error{Code: jobs.ErrorCodeInvalidInput, Err: os.ErrInvalid})
+	failed := filepath.Join(root, WatchFailedDir, "talk.mp4")
+	eventually(t, "the video to be moved to failed/", func() bool {
+		status, _ := fw.worker.Registry.Get(job.ID)
+		return status.UnprocessedFilePath == failed
+	})
+	if failure, err := os.ReadFile(failed + errorFileSuffix); err != nil || !strings.Contains(string(failure), job.ID) {
+		t.Errorf("failure of the job = %q, %v, want its job id", failure, err)
+	}
+
+	// The retried job finds its video in failed/, and moves it to done/ once it succeeds
+	if _, err := fw.worker.Registry.Retry(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	fw.worker.Registry.Complete(job.ID, filepath.Join(root, "out", "talk.mp4"), "")
+	done := filepath.Join(root, WatchDoneDir, "talk.mp4")
+	eventually(t, "the retried video to be moved to done/", func() bool {
+		status, _ := fw.worker.Registry.Get(job.ID)
+		return status.UnprocessedFilePath == done
+	})
+	if exists(failed) || exists(failed+errorFileSuffix) {
+		t.Error("video or its failure left in failed/ after the retry succeeded")
+	}
+}
@@ -1,194 +1,615 @@
 package upload
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
 	"time"
+	"videoUploadAndProcessing/pkg/acapela_api"
+	"videoUploadAndProcessing/pkg/auth"
+	"videoUploadAndProcessing/pkg/events"
+	"videoUploadAndProcessing/pkg/jobs"
+	"videoUploadAndProcessing/pkg/logging"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/storage"
+	"videoUploadAndProcessing/pkg/tracing"
 	"videoUploadAndProcessing/pkg/video_processing"
+	"videoUploadAndProcessing/pkg/webhook"
 	"videoUploadAndProcessing/pkg/whisper_api"
 )
 
-const NumWorkers = 50 // 設定工作人員的數量
+const DefaultNumWorkers = 50 // 工作人員的預設數量
 
 const InitialBackoffDuration = 500 * time.Millisecond // 初始回退時間
 const MaxBackoffDuration = 16 * time.Second           // 最大回退時間
 
+const DefaultJobTimeout = 2 * time.Hour // 單一工作的預設期限
+
+const DefaultTempDir = "tmp" // 工作中間檔案的預設目錄
+
 type Job struct {
-	File                  io.ReadCloser
-	FileName              string
-	UnprocessedFilePath   string
-	ProcessedFilePathChan chan string // 用來傳送處理後的文件路徑
-	APIKey                string
-	Retries               int
-	Done                  chan bool // 用來通知工作完成
+	ID                  string
+	File                io.ReadCloser
+	FileName            string
+	UnprocessedFilePath string
+	Tenant              auth.Tenant       // 提供 API 憑證與輸出目錄
+	Options             ProcessingOptions // 覆寫 Worker 的處理選項，空欄位使用 Worker 的設定
+	Retries             int
 }
 
 type Worker struct {
-	ID       int
-	JobQueue chan Job
+	ID            int
+	JobQueue      chan Job
+	Registry      *jobs.Registry       // 記錄每個工作的狀態
+	JobTimeout    time.Duration        // 每個工作的期限，0 代表使用 DefaultJobTimeout
+	RetryPolicies retry.Policies       // 各階段的重試策略
+	Admission     *AdmissionController // 決定新工作能否進入佇列
+	Drainer       *Drainer             // 關機時停止接新工作，可為 nil
+	Webhooks      *webhook.Dispatcher  // 傳送並記錄回呼
+	Events        *events.Hub          // 發布工作進度，可為 nil
+	Deduplicate   bool                 // 以影片內容與處理選項的雜湊值去除重複的工作
+	Tenants       *auth.Tenants        // 重新排入佇列的工作依其租戶取得憑證
+	Quotas        *Quotas              // 各租戶的配額，可為 nil
+	Storage       *storage.Storage     // 讀取 s3:// 輸入並保存輸出，nil 代表只使用租戶的本機目錄
+	Voice         string               // Acapela 配音的聲音，空字串代表使用 DefaultVoice
+	MaxUploadSize int64                // 上傳影片的大小上限，0 代表使用 DefaultMaxUploadSize
+	TempDir       string               // 工作的中間檔案與檢查點存放的目錄，空字串代表使用 DefaultTempDir
 }
 
 func (w Worker) Start() {
+	w.Drainer.workerStarted()
 	go func() {
-		for job := range w.JobQueue {
-			log.Printf("Worker %d processing job", w.ID)
-			err := ProcessJob(job, w.ID)
-
-			if err != nil {
-				/*if job.Retries < 2 { // 如果尚未達到最大重試次數
-					job.Retries++
-					backoffDuration := getBackoffDuration(job.Retries)
-					log.Printf("Job failed, retrying after %v", backoffDuration)
-					time.Sleep(backoffDuration)
-					w.JobQueue <- job // 將工作重新放入佇列
-				} else {
-
-				}*/
-				log.Printf("Job failed after %d retries", job.Retries)
-			} else {
-				log.Printf("worker%d job done", w.ID)
+		defer w.Drainer.workerStopped()
+		for {
+			select {
+			case <-w.Drainer.Quit():
+				return
+			case job, ok := <-w.JobQueue:
+				if !ok {
+					return
+				}
+				// Once draining, queued jobs stay queued in the job store and are picked up after the restart
+				if w.Drainer.Draining() {
+					slog.Info("Leaving job queued, the service is draining", "worker_id", w.ID, "job_id", job.ID)
+					return
+				}
+				// A tenant at its concurrent jobs limit must not take the workers of the others,
+				// its job waits for one of the tenant's jobs to finish
+				if !w.Quotas.acquire(job) {
+					continue
+				}
+				w.runJobs(job)
 			}
+		}
+	}()
+}
+
+// runJobs runs the job, then the jobs of its tenant that were waiting for the slot it frees
+func (w Worker) runJobs(job Job) {
+	for {
+		w.runJob(job)
+		next, ok := w.Quotas.release(job.Tenant)
+		for ok && w.Drainer.Draining() {
+			// The job is still queued in the job store and is picked up after the restart
+			slog.Info("Leaving job queued, the service is draining", "worker_id", w.ID, "job_id", next.ID)
+			next, ok = w.Quotas.release(next.Tenant)
+		}
+		if !ok {
+			return
+		}
+		job = next
+	}
+}
+
+// runJob processes a single job under its deadline and records the outcome in the registry
+func (w Worker) runJob(job Job) {
+	timeout := w.JobTimeout
+	if timeout <= 0 {
+		timeout = DefaultJobTimeout
+	}
+	jobCtx, cancelJob := context.WithCancelCause(context.Background())
+	defer cancelJob(nil)
+	ctx, cancel := context.WithTimeout(jobCtx, timeout)
+	defer cancel()
+	ctx = logging.With(ctx, "job_id", job.ID, "worker_id", w.ID)
+
+	// The job may have been cancelled while it was waiting in the queue
+	if !w.Registry.AttachCancel(job.ID, cancelJob) {
+		slog.InfoContext(ctx, "Skipping job, it is no longer pending")
+		return
+	}
+	defer w.Registry.DetachCancel(job.ID)
 
+	slog.InfoContext(ctx, "Processing job", "tenant_id", job.Tenant.ID)
+	w.Registry.SetWorker(job.ID, w.ID)
+	activeWorkers.Inc()
+	defer activeWorkers.Dec()
+
+	// A run continues the trace of the previous run of the job, so retries and resumes share one trace
+	if status, ok := w.Registry.Get(job.ID); ok {
+		ctx = tracing.ContextWithTraceParent(ctx, status.TraceParent)
+	}
+	ctx, span := tracing.Start(ctx, "job", tracing.String("job.id", job.ID), tracing.String("tenant.id", job.Tenant.ID), tracing.Int("worker.id", w.ID))
+	defer span.End()
+	if span != nil {
+		w.Registry.SetTraceParent(job.ID, span.TraceParent())
+	}
+	startedAt := time.Now()
+	defer func() { w.Admission.ObserveDuration(time.Since(startedAt)) }()
+
+	// Transient failures are retried on this worker, every attempt resumes from the job's checkpoint
+	policy := w.RetryPolicies.For(RetryStageJob)
+	var err error
+	for {
+		err = w.processJob(ctx, job)
+		if err == nil || ctx.Err() != nil || !retry.IsTransient(err) || job.Retries+1 >= policy.MaxAttempts {
+			break
+		}
+
+		job.Retries++
+		w.Registry.SetRetries(job.ID, job.Retries)
+		backoffDuration := policy.Backoff(job.Retries)
+		slog.WarnContext(ctx, "Job failed, retrying", "backoff", backoffDuration.String(), "retry", job.Retries, "max_retries", policy.MaxAttempts-1, "error", err)
+
+		timer := time.NewTimer(backoffDuration)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	span.SetAttributes(tracing.Int("job.retries", job.Retries))
+	span.RecordError(err)
+
+	switch {
+	case errors.Is(context.Cause(ctx), jobs.ErrInterrupted):
+		// Leave the job in its current state, it is requeued on startup and resumes from its checkpoint
+		slog.InfoContext(ctx, "Job was interrupted by shutdown, it will resume after the restart")
+	case errors.Is(ctx.Err(), context.Canceled):
+		slog.InfoContext(ctx, "Job was cancelled")
+		// A cancelled job will not be resumed, drop its checkpoint
+		if err := os.RemoveAll(JobTempDir(w.tempDir(), job.ID)); err != nil {
+			slog.WarnContext(ctx, "Failed to remove temp directory", "error", err)
+		}
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		slog.ErrorContext(ctx, "Job exceeded its deadline", "timeout", timeout.String(), "error", err)
+		w.Registry.Fail(job.ID, &jobs.Error{
+			Code: jobs.ErrorCodeDeadlineExceeded,
+			Err:  fmt.Errorf("job exceeded its deadline of %v: %w", timeout, err),
+		})
+	case err != nil:
+		slog.ErrorContext(ctx, "Job failed", "retries", job.Retries, "error", err)
+		w.Registry.Fail(job.ID, classifyJobError(err))
+	default:
+		slog.InfoContext(ctx, "Job done", "retries", job.Retries)
+	}
+}
+
+// processJob runs ProcessJob on the job. A panic fails the job for good instead of the whole service,
+// which would otherwise crash again on every start when the job is requeued.
+func (w Worker) processJob(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.ErrorContext(ctx, "Job panicked", "panic", p, "stack", string(debug.Stack()))
+			err = retry.Permanent(&jobs.Error{
+				Code: jobs.ErrorCodeInternal,
+				Err:  fmt.Errorf("panic while processing the job: %v", p),
+			})
 		}
 	}()
+	return ProcessJob(ctx, job, w.ID, w.tempDir(), w.Registry, w.Quotas, w.Storage, w.RetryPolicies, w.processingOptions(job.Options), w.Events.Reporter(job.ID))
 }
 
-/*
-// Compute the backoff duration based on retry count.
-func getBackoffDuration(retryCount int) time.Duration {
-	backoff := InitialBackoffDuration * time.Duration(1<<retryCount)
-	if backoff > MaxBackoffDuration {
-		return MaxBackoffDuration
+// RequeuePending hands every job that was still unfinished when the service stopped back to the workers.
+// It must be called after the workers have been started.
+func RequeuePending(worker Worker) {
+	pending := worker.Registry.Pending()
+	if len(pending) == 0 {
+		return
 	}
-	return backoff
-}*/
 
-func createUniqueTempDir(workerID int) (string, error) {
-	uniqueDir := fmt.Sprintf("tmp/worker%d", workerID)
+	slog.Info("Requeueing unfinished jobs from the job store", "jobs", len(pending))
+	for _, status := range pending {
+		tenant, ok := worker.Tenants.Get(status.TenantID)
+		if !ok {
+			slog.Error("Job belongs to an unknown tenant, failing it", "job_id", status.ID, "tenant_id", status.TenantID)
+			worker.Registry.Fail(status.ID, &jobs.Error{
+				Code: jobs.ErrorCodeInvalidInput,
+				Err:  fmt.Errorf("tenant %q no longer exists", status.TenantID),
+			})
+			continue
+		}
+		enqueueJob(worker, status, tenant)
+	}
+}
+
+// tempDir returns where the jobs keep their intermediate files and checkpoints
+func (w Worker) tempDir() string {
+	if w.TempDir != "" {
+		return w.TempDir
+	}
+	return DefaultTempDir
+}
+
+// JobTempDir returns the directory under tempDir holding the intermediate files and checkpoint of a job
+func JobTempDir(tempDir string, jobID string) string {
+	return filepath.Join(tempDir, "jobs", jobID)
+}
+
+func createJobTempDir(tempDir string, jobID string) (string, error) {
+	uniqueDir := JobTempDir(tempDir, jobID)
 	err := os.MkdirAll(uniqueDir, 0755)
 	if err != nil {
-		return "", fmt.Errorf("failed to create unique temp directory for worker %d: %v", workerID, err)
+		return "", fmt.Errorf("failed to create temp directory for job %s: %v", jobID, err)
 	}
 	return uniqueDir, nil
 }
 
-func ProcessJob(job Job, workerID int) error {
+// ProcessJob runs the whole dubbing pipeline for a job.
+// The outputs of every stage are checkpointed in the job's directory under tempDir, which is only removed
+// once the job succeeds, so running a failed or interrupted job again resumes where it stopped.
+// Segment and ffmpeg progress is published to progress, which may be nil.
+// The text sent to Acapela is charged to the tenant's TTS quota before dubbing starts.
+// The speech is transcribed in the language of options, the segments are dubbed with its voice and
+// its subtitles are burned into the segments and/or written next to the output video.
+// s3:// inputs are downloaded from store, and the outputs are kept where store says; a nil store
+// keeps them in the tenant's output root.
+func ProcessJob(ctx context.Context, job Job, workerID int, tempDir string, registry *jobs.Registry, quotas *Quotas, store *storage.Storage, policies retry.Policies, options ProcessingOptions, progress *events.Reporter) (err error) {
 	if job.File != nil {
 		defer job.File.Close()
 	}
+	ctx = logging.With(ctx, "job_id", job.ID, "worker_id", workerID)
 
-	// Create a unique temporary directory for this worker
-	tempDirPrefix, err := createUniqueTempDir(workerID)
+	// Create (or reuse) the temporary directory of this job
+	tempDirPrefix, err := createJobTempDir(tempDir, job.ID)
 	if err != nil {
-		log.Fatalf("Failed to create a unique temporary directory for worker %d: %v", workerID, err)
+		slog.ErrorContext(ctx, "Failed to create temp directory", "error", err)
+		return err
 	}
-	defer os.RemoveAll(tempDirPrefix) // Schedule the cleanup of this directory when the function exits
 
-	log.Printf("Temporary directory created at: %s", tempDirPrefix)
+	slog.DebugContext(ctx, "Temporary directory created", "path", tempDirPrefix)
 
-	// 獲取影片的metadata
-	metadata, err := video_processing.GetVideoMetadata(job.UnprocessedFilePath)
+	cp, err := loadCheckpoint(tempDirPrefix)
 	if err != nil {
-		log.Printf("Failed to get video metadata: %v", err)
-		return fmt.Errorf("failed to get video metadata: %v", err)
+		slog.ErrorContext(ctx, "Failed to load checkpoint", "error", err)
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	if len(cp.CompletedStages) > 0 {
+		slog.InfoContext(ctx, "Resuming job", "completed_stages", cp.CompletedStages)
 	}
-	log.Printf("Video's Metadata: %+v\n", metadata)
+	// Every stage runs in a span, the one in progress when the job fails records the error
+	defer func() { cp.abortStage(err) }()
 
-	log.Println("Extracting aduio from video streamly")
+	registry.SetState(job.ID, jobs.StateExtracting)
 
-	// 使用新打開的file讀取器提取音訊(流式)
-	audioReader, err := video_processing.StreamedExtractAudioFromVideo(job.UnprocessedFilePath)
-	if err != nil {
-		log.Printf("Error extracting audio: %v", err)
+	// s3:// inputs are downloaded to the temp directory, ffmpeg reads local inputs in place
+	inputPath := job.UnprocessedFilePath
+	if storage.IsS3URI(job.UnprocessedFilePath) {
+		if !cp.completed(stageInputFetched) {
+			ctx := cp.startStage(ctx, stageInputFetched)
+
+			if err := store.CheckInput(job.UnprocessedFilePath, job.Tenant.S3InputPrefixes); err != nil {
+				return retry.Permanent(&jobs.Error{Code: jobs.ErrorCodeInvalidInput, Err: err})
+			}
 
-		return fmt.Errorf("error extracting audio: %v", err)
+			slog.InfoContext(ctx, "Downloading input video", "input", job.UnprocessedFilePath)
+			path := filepath.Join(tempDirPrefix, "input", filepath.Base(job.FileName))
+			err := retry.Do(ctx, policies.For(RetryStageTransfer), "Input download", func() error {
+				return store.Fetch(ctx, job.UnprocessedFilePath, job.Tenant.S3InputPrefixes, path)
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to download input video", "error", err)
+				return fmt.Errorf("failed to download input video: %w", err)
+			}
+
+			if err := cp.complete(stageInputFetched, func() { cp.InputPath = path }); err != nil {
+				return err
+			}
+		}
+		inputPath = cp.InputPath
 	}
 
-	log.Println("Calling Whisper API and wating for response")
-	//呼叫STT API(whisper)
-	whisperAndWordTimestamps, err := whisper_api.CallWhisperAPI(job.APIKey, audioReader)
-	if err != nil {
-		log.Printf("Error calling Whisper API: %v", err)
-		return fmt.Errorf("error calling Whisper API: %v", err)
+	if !cp.completed(stageAudioExtracted) {
+		ctx := cp.startStage(ctx, stageAudioExtracted)
+
+		// 獲取影片的metadata
+		metadata, err := video_processing.GetVideoMetadata(ctx, inputPath)
+		if err != nil {
+			// ffprobe failing on the input means the video itself is unusable, retrying won't help
+			slog.ErrorContext(ctx, "Failed to get video metadata", "error", err)
+			return retry.Permanent(&jobs.Error{
+				Code: jobs.ErrorCodeInvalidInput,
+				Err:  fmt.Errorf("failed to get video metadata: %w", err),
+			})
+		}
+		slog.DebugContext(ctx, "Video metadata", "metadata", metadata)
+
+		slog.InfoContext(ctx, "Extracting audio from video")
+
+		// The duration is only needed to report the extraction progress
+		var inputDuration float64
+		if progress != nil {
+			inputDuration, _ = video_processing.GetVideoDuration(ctx, inputPath)
+		}
+		extractCtx := withFFmpegProgress(ctx, progress, "extract", inputDuration)
+
+		// 將音訊提取到檔案，讓之後的重試不需要再次提取
+		audioPath := filepath.Join(tempDirPrefix, "audio", "extracted_audio.mp3")
+		err = retry.Do(ctx, policies.For(RetryStageExtract), "Audio extraction", func() error {
+			return video_processing.ExtractAudioToFile(extractCtx, inputPath, audioPath)
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error extracting audio", "error", err)
+			return fmt.Errorf("error extracting audio: %w", err)
+		}
+
+		if err := cp.complete(stageAudioExtracted, func() { cp.AudioPath = audioPath }); err != nil {
+			return err
+		}
 	}
 
-	log.Println("Generating SRT file streamly")
+	registry.SetState(job.ID, jobs.StateTranscribing)
 
-	//根據STT結果創建SRT file(流式)
-	srtFilePath, err := whisper_api.StreamedCreateSRTFile(whisperAndWordTimestamps, tempDirPrefix)
-	if err != nil {
-		log.Printf("Error creating SRT file: %v", err)
-		return fmt.Errorf("error creating SRT file: %v", err)
+	if !cp.completed(stageTranscribed) {
+		ctx := cp.startStage(ctx, stageTranscribed)
+
+		slog.InfoContext(ctx, "Calling Whisper API and waiting for response")
+		//呼叫STT API(whisper)，每次重試都重新開啟音訊檔
+		var whisperAndWordTimestamps *whisper_api.WhisperAndWordTimestamps
+		err := retry.Do(ctx, policies.For(RetryStageTranscribe), "Whisper API call", func() error {
+			audioFile, err := os.Open(cp.AudioPath)
+			if err != nil {
+				return fmt.Errorf("error opening extracted audio: %w", err)
+			}
+			defer audioFile.Close()
+
+			whisperAndWordTimestamps, err = whisper_api.CallWhisperAPI(ctx, job.Tenant.WhisperAPIKey, options.Language, audioFile)
+			return err
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error calling Whisper API", "error", err)
+			return fmt.Errorf("error calling Whisper API: %w", err)
+		}
+
+		// 保存Whisper的回應，避免重試時再次付費呼叫
+		whisperPath := filepath.Join(tempDirPrefix, "whisper_response.json")
+		if err := saveJSON(whisperPath, whisperAndWordTimestamps); err != nil {
+			return fmt.Errorf("error saving Whisper response: %w", err)
+		}
+
+		if err := cp.complete(stageTranscribed, func() { cp.WhisperPath = whisperPath }); err != nil {
+			return err
+		}
 	}
 
-	//創建所有單詞的時間戳
-	outputPath, err := whisper_api.CreateWholeWordTimestampsFile(whisperAndWordTimestamps, tempDirPrefix)
-	if err != nil {
-		log.Printf("Error creating wholeWordTimestamps file: %v\n", err)
-	} else {
-		log.Printf("Created wholeWordTimestamps file at: %s\n", outputPath)
+	if !cp.completed(stageSubtitled) {
+		ctx := cp.startStage(ctx, stageSubtitled)
+
+		var whisperAndWordTimestamps whisper_api.WhisperAndWordTimestamps
+		if err := loadJSON(cp.WhisperPath, &whisperAndWordTimestamps); err != nil {
+			return fmt.Errorf("error loading Whisper response: %w", err)
+		}
+
+		slog.InfoContext(ctx, "Generating SRT file")
+
+		//根據STT結果創建SRT file(流式)
+		srtFilePath, err := whisper_api.StreamedCreateSRTFile(&whisperAndWordTimestamps, tempDirPrefix)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error creating SRT file", "error", err)
+			return fmt.Errorf("error creating SRT file: %w", err)
+		}
+
+		//創建所有單詞的時間戳
+		outputPath, err := whisper_api.CreateWholeWordTimestampsFile(&whisperAndWordTimestamps, tempDirPrefix)
+		if err != nil {
+			slog.WarnContext(ctx, "Error creating wholeWordTimestamps file", "error", err)
+		} else {
+			slog.DebugContext(ctx, "Created wholeWordTimestamps file", "path", outputPath)
+		}
+
+		if err := cp.complete(stageSubtitled, func() { cp.SRTPath = srtFilePath }); err != nil {
+			return err
+		}
 	}
 
 	// 讀取SRT文件
-	srtSegments, err := whisper_api.ReadSRTFileFromPath(srtFilePath)
+	srtSegments, err := whisper_api.ReadSRTFileFromPath(cp.SRTPath)
 	if err != nil {
-		log.Printf("Error reading SRT file: %v", err)
-		return fmt.Errorf("error reading SRT file: %v", err)
+		slog.ErrorContext(ctx, "Error reading SRT file", "error", err)
+		return fmt.Errorf("error reading SRT file: %w", err)
 	}
 
-	//獲取影片時長
-	videoDuration, err := video_processing.GetVideoDuration(job.UnprocessedFilePath)
-	if err != nil {
-		log.Printf("Failed to get video duration: %v", err)
-		return fmt.Errorf("failed to get video duration: %v", err)
-	}
+	registry.SetState(job.ID, jobs.StateSplitting)
 
-	// Splitting video into segments and preparing for parallel processing
-	allSegmentPaths, voiceSegmentPaths, err := video_processing.SplitVideoIntoSegmentsBySRT(job.UnprocessedFilePath, srtSegments, videoDuration, tempDirPrefix)
-	if err != nil {
-		log.Printf("Failed to split video into segments: %v", err)
-		return fmt.Errorf("failed to split video into segments: %v", err)
+	if !cp.completed(stageSplit) {
+		ctx := cp.startStage(ctx, stageSplit)
+
+		//獲取影片時長
+		videoDuration, err := video_processing.GetVideoDuration(ctx, inputPath)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get video duration", "error", err)
+			return fmt.Errorf("failed to get video duration: %w", err)
+		}
+
+		// Splitting video into segments and preparing for parallel processing
+		var allSegmentPaths, voiceSegmentPaths []string
+		err = retry.Do(ctx, policies.For(RetryStageSplit), "Video split", func() error {
+			var err error
+			allSegmentPaths, voiceSegmentPaths, err = video_processing.SplitVideoIntoSegmentsBySRT(ctx, inputPath, srtSegments, videoDuration, tempDirPrefix)
+			return err
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to split video into segments", "error", err)
+			return fmt.Errorf("failed to split video into segments: %w", err)
+		}
+
+		err = cp.complete(stageSplit, func() {
+			cp.VideoDuration = videoDuration
+			cp.AllSegmentPaths = allSegmentPaths
+			cp.VoiceSegmentPaths = voiceSegmentPaths
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	log.Println("Converting audio to standard pronunciation using the Acapela TTS API and substituting the human voice with a synthesized voice...")
+	registry.SetState(job.ID, jobs.StateDubbing)
 
-	// After spliting video into many segments,create a go worker pool to handle it.
-	mergedSegments, err := ProcessSegmentJobs(voiceSegmentPaths, allSegmentPaths, srtSegments, tempDirPrefix)
+	if !cp.completed(stageDubbed) {
+		ctx := cp.startStage(ctx, stageDubbed)
 
-	if err != nil {
-		log.Printf("Error while processing segment workers: %v", err)
-		return fmt.Errorf("error while processing segment workers: %v", err)
+		slog.InfoContext(ctx, "Converting audio to standard pronunciation using the Acapela TTS API and substituting the human voice with a synthesized voice")
+
+		reservation, err := quotas.ReserveTTS(job.Tenant, job.ID, pendingTTSCharacters(cp, srtSegments))
+		if err != nil {
+			return err
+		}
+		defer reservation.Release()
+
+		// Speech is synthesized with the Acapela account of the job's tenant
+		creds := acapela_api.Credentials{Email: job.Tenant.AcapelaEmail, Password: job.Tenant.AcapelaPassword}
+
+		// After spliting video into many segments,create a go worker pool to handle it.
+		mergedSegments, err := ProcessSegmentJobs(ctx, cp, policies, progress, options, creds, reservation, cp.VoiceSegmentPaths, cp.AllSegmentPaths, srtSegments, tempDirPrefix)
+		// The characters of the segments that were not dubbed are not charged
+		reservation.Release()
+
+		if err != nil {
+			slog.ErrorContext(ctx, "Error while processing segment workers", "error", err)
+			return fmt.Errorf("error while processing segment workers: %w", err)
+		}
+
+		if err := cp.complete(stageDubbed, func() { cp.MergedSegments = mergedSegments }); err != nil {
+			return err
+		}
 	}
 
-	// 更新 allSegmentPaths
-	allSegmentPaths = mergedSegments
+	registry.SetState(job.ID, jobs.StateMerging)
 
-	log.Println("Starting to merge all the video segments..")
-	outputVideo, err := video_processing.MergeAllVideoSegmentsTogether(job.FileName, allSegmentPaths, tempDirPrefix)
-	if err != nil {
-		log.Printf("Failed to merge video segments into final_video: %v", err)
-		return fmt.Errorf("failed to merge video segments into final_video: %v", err)
-	} else {
-		log.Printf("Successfully merged all video segments into %s", outputVideo)
+	// Outputs kept in a bucket are merged in the temp directory and uploaded from there
+	outputs := store.Outputs(job.Tenant.ID, job.Tenant.OutputRoot)
+	outputDir := job.Tenant.OutputRoot
+	if _, local := outputs.(storage.Local); !local {
+		outputDir = filepath.Join(tempDirPrefix, "output")
 	}
 
-	// 當工作完成後
+	if !cp.completed(stageMerged) {
+		ctx := cp.startStage(ctx, stageMerged)
+
+		slog.InfoContext(ctx, "Starting to merge all the video segments")
+		var outputVideo string
+		concatCtx := withFFmpegProgress(ctx, progress, "concat", cp.VideoDuration)
+		err := retry.Do(ctx, policies.For(RetryStageConcat), "Segment concat", func() error {
+			var err error
+			outputVideo, err = video_processing.MergeAllVideoSegmentsTogether(concatCtx, outputDir, job.ID, job.FileName, cp.MergedSegments, tempDirPrefix)
+			return err
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to merge video segments into final_video", "error", err)
+			return fmt.Errorf("failed to merge video segments into final_video: %w", err)
+		} else {
+			slog.InfoContext(ctx, "Successfully merged all video segments", "path", outputVideo)
+		}
+
+		if options.writeSubtitleFile() {
+			if err := copyFile(cp.SRTPath, SubtitleFilePath(outputVideo)); err != nil {
+				slog.ErrorContext(ctx, "Failed to write SRT file", "error", err)
+				return fmt.Errorf("failed to write SRT file: %w", err)
+			}
+		}
 
-	select {
-	case job.Done <- true:
-		log.Println("Successfully sent true to Done channel")
-	case <-time.After(time.Second * 5): // 等待5秒
-		log.Println("Timeout while trying to send true to Done channel")
+		if err := cp.complete(stageMerged, func() { cp.OutputVideo = outputVideo }); err != nil {
+			return err
+		}
 	}
 
-	select {
-	case job.ProcessedFilePathChan <- outputVideo:
-		log.Println("Successfully sent outputVideo to ProcessedFilePathChannel")
-	case <-time.After(time.Second * 5): // 等待5秒
-		log.Println("Timeout while trying to send outputVideo to ProcessedFilePathChannel")
+	if !cp.completed(stageUploaded) {
+		ctx := cp.startStage(ctx, stageUploaded)
+
+		// The subtitles go first, so the video is only stored once everything else is
+		var video storage.Object
+		err := retry.Do(ctx, policies.For(RetryStageTransfer), "Output upload", func() error {
+			if options.writeSubtitleFile() {
+				srtPath := SubtitleFilePath(cp.OutputVideo)
+				if _, err := outputs.Put(ctx, srtPath, filepath.Base(srtPath)); err != nil {
+					return err
+				}
+			}
+			var err error
+			video, err = outputs.Put(ctx, cp.OutputVideo, filepath.Base(cp.OutputVideo))
+			return err
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to store output video", "error", err)
+			return fmt.Errorf("failed to store output video: %w", err)
+		}
+		slog.InfoContext(ctx, "Stored output video", "location", video.Location)
+
+		err = cp.complete(stageUploaded, func() {
+			cp.OutputLocation = video.Location
+			cp.OutputURL = video.URL
+		})
+		if err != nil {
+			return err
+		}
 	}
 
+	// The job is finished, its intermediate files are no longer needed
+	if err := os.RemoveAll(tempDirPrefix); err != nil {
+		slog.WarnContext(ctx, "Failed to remove temp directory", "path", tempDirPrefix, "error", err)
+	}
+
+	// 當工作完成後，registry 會觸發回呼
+	registry.Complete(job.ID, cp.OutputLocation, cp.OutputURL)
+
 	return nil
 }
+
+// SubtitleFilePath returns where the SRT file of the output video is written when its subtitles are
+// delivered as a file
+func SubtitleFilePath(videoPath string) string {
+	return strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + ".srt"
+}
+
+// copyFile copies src to dst through a temporary file, so dst is never left half written
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// withFFmpegProgress makes the ffmpeg commands run with the returned context report their progress
+// through the input of totalSeconds as a percentage of the stage
+func withFFmpegProgress(ctx context.Context, progress *events.Reporter, stage string, totalSeconds float64) context.Context {
+	if progress == nil || totalSeconds <= 0 {
+		return ctx
+	}
+	return video_processing.WithProgress(ctx, func(processed time.Duration) {
+		progress.FFmpegProgress(stage, 100*processed.Seconds()/totalSeconds)
+	})
+}
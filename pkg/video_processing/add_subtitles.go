@@ -1,8 +1,9 @@
 package video_processing
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"videoUploadAndProcessing/pkg/whisper_api"
@@ -48,7 +49,7 @@ func createTemporarySRTFile(srtSegment whisper_api.SRTSegment, segmentIdx int, t
 	return tempFilePath, nil
 }
 
-func AddSubtitlesToSegment(videoPath string, srtSegment whisper_api.SRTSegment, outputPath string, segmentIdx int, tempDirPrefix string) error {
+func AddSubtitlesToSegment(ctx context.Context, videoPath string, srtSegment whisper_api.SRTSegment, outputPath string, segmentIdx int, tempDirPrefix string) error {
 	// Reset StartTime and EndTime
 	srtSegment.StartTime = 0
 	srtSegment.EndTime -= srtSegment.StartTime
@@ -74,7 +75,7 @@ func AddSubtitlesToSegment(videoPath string, srtSegment whisper_api.SRTSegment,
 	// Create temporary output file
 	tempOutputPath := outputPath + "_temp.mp4"
 
-	err = execFFMPEG("-y", "-i", videoPath, "-ar", "44100", "-ac", "2", "-vf", subtitleStr, tempOutputPath)
+	err = execFFMPEG(ctx, "-y", "-i", videoPath, "-ar", "44100", "-ac", "2", "-vf", subtitleStr, tempOutputPath)
 	if err != nil {
 		return fmt.Errorf("error executing FFmpeg command for segment %d: %v", segmentIdx, err)
 	}
@@ -85,7 +86,7 @@ func AddSubtitlesToSegment(videoPath string, srtSegment whisper_api.SRTSegment,
 		return fmt.Errorf("error renaming file: %v", err)
 	}
 
-	log.Printf("Subtitle added for segement %d,store at :%s", segmentIdx, outputPath)
+	slog.DebugContext(ctx, "Subtitle added to segment", "path", outputPath)
 
 	return nil
 }
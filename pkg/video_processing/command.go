@@ -0,0 +1,59 @@
+package video_processing
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"time"
+	"videoUploadAndProcessing/pkg/metrics"
+	"videoUploadAndProcessing/pkg/tracing"
+)
+
+var (
+	commandInvocations = metrics.NewCounter("ffmpeg_invocations_total",
+		`ffmpeg and ffprobe processes run, by command and exit code ("error" when the process could not be started, "signal" when it was killed).`,
+		"command", "exit_code")
+	commandDuration = metrics.NewHistogram("ffmpeg_duration_seconds",
+		"Time taken by ffmpeg and ffprobe processes, by command.",
+		metrics.DefaultBuckets, "command")
+)
+
+// commandRun is an ffmpeg or ffprobe process being timed and traced
+type commandRun struct {
+	cmd     *exec.Cmd
+	started time.Time
+	span    *tracing.Span
+}
+
+// startCommand is called right before cmd is started, finish is called once it exits.
+// URL arguments, such as the presigned URLs ffprobe reads objects from, are recorded without their query string.
+func startCommand(ctx context.Context, cmd *exec.Cmd) commandRun {
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = tracing.RedactURL(arg)
+	}
+	_, span := tracing.Start(ctx, cmd.Args[0], tracing.Strings("process.command_args", args))
+	return commandRun{cmd: cmd, started: time.Now(), span: span}
+}
+
+// finish records the exit code of the process, err is what running it returned
+func (r commandRun) finish(err error) {
+	command := r.cmd.Args[0]
+	exitCode := "0"
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == -1:
+		exitCode = "signal"
+	case errors.As(err, &exitErr):
+		exitCode = strconv.Itoa(exitErr.ExitCode())
+	case err != nil:
+		exitCode = "error"
+	}
+	commandInvocations.Inc(command, exitCode)
+	commandDuration.Observe(time.Since(r.started).Seconds(), command)
+
+	r.span.SetAttributes(tracing.String("process.exit_code", exitCode))
+	r.span.RecordError(err)
+	r.span.End()
+}
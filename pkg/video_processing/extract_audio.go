@@ -2,17 +2,21 @@ package video_processing
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
 )
 
-func StreamedExtractAudioFromVideo(filePath string) (io.Reader, error) {
+func StreamedExtractAudioFromVideo(ctx context.Context, filePath string) (io.Reader, error) {
 	// 命令設置
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-f", "mp3", "-vn", "pipe:1")
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", filePath, "-f", "mp3", "-vn", "pipe:1")
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Printf("Failed to create stdout pipe: %v", err)
+		slog.ErrorContext(ctx, "Failed to create stdout pipe", "error", err)
 		return nil, err
 	}
 
@@ -31,15 +35,32 @@ func StreamedExtractAudioFromVideo(filePath string) (io.Reader, error) {
 		io.Copy(multiWriter, stdoutPipe)
 	}()
 
+	run := startCommand(ctx, cmd)
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start ffmpeg: %v", err)
+		run.finish(err)
+		slog.ErrorContext(ctx, "Failed to start ffmpeg", "error", err)
 		return nil, err
 	}
 
-	if err := cmd.Wait(); err != nil {
-		log.Printf("Failed to wait for ffmpeg: %v", err)
+	err = cmd.Wait()
+	run.finish(err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to wait for ffmpeg", "error", err)
 		return nil, err
 	}
 
 	return bytes.NewReader(buf.Bytes()), nil
 }
+
+// ExtractAudioToFile 將影片的音軌以mp3格式寫入outputPath，讓後續階段可以重複使用
+func ExtractAudioToFile(ctx context.Context, filePath string, outputPath string) error {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", outputPath, err)
+	}
+
+	err := execFFMPEG(ctx, "-y", "-i", filePath, "-f", "mp3", "-vn", outputPath)
+	if err != nil {
+		return fmt.Errorf("error extracting audio to %s: %v", outputPath, err)
+	}
+	return nil
+}
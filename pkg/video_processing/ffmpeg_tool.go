@@ -1,15 +1,20 @@
 package video_processing
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
+	"videoUploadAndProcessing/pkg/tracing"
 )
 
 type VideoMetadata struct {
@@ -20,17 +25,73 @@ type VideoMetadata struct {
 	// 添加其他所需的欄位
 }
 
-func execFFMPEG(args ...string) error {
-	cmd := exec.Command("ffmpeg", args...)
+// ProgressFunc receives how much of the input ffmpeg has processed so far
+type ProgressFunc func(processed time.Duration)
+
+type progressKey struct{}
+
+// WithProgress returns a context making the ffmpeg commands run with it report their progress to fn
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// execFFMPEG runs ffmpeg with the given arguments; the process is killed if ctx is cancelled
+func execFFMPEG(ctx context.Context, args ...string) error {
+	if progress, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && progress != nil {
+		return execFFMPEGWithProgress(ctx, progress, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	run := startCommand(ctx, cmd)
 	output, err := cmd.CombinedOutput()
+	run.finish(err)
+	if err != nil {
+		return fmt.Errorf("ffmpeg error: %w, output: %s", err, output)
+	}
+	return nil
+}
+
+// execFFMPEGWithProgress runs ffmpeg with -progress on stdout and reports the out_time it prints
+func execFFMPEGWithProgress(ctx context.Context, progress ProgressFunc, args ...string) error {
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("ffmpeg error: %w", err)
+	}
+	run := startCommand(ctx, cmd)
+	if err := cmd.Start(); err != nil {
+		run.finish(err)
+		return fmt.Errorf("ffmpeg error: %w", err)
+	}
+
+	// Blocks of key=value lines, out_time_us is the position reached in the output
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "out_time_us" {
+			continue
+		}
+		if microseconds, err := strconv.ParseInt(value, 10, 64); err == nil && microseconds >= 0 {
+			progress(time.Duration(microseconds) * time.Microsecond)
+		}
+	}
+	// Keep ffmpeg from blocking on a full pipe if scanning stopped early
+	io.Copy(io.Discard, stdout)
+
+	err = cmd.Wait()
+	run.finish(err)
 	if err != nil {
-		return fmt.Errorf("ffmpeg error: %v, output: %s", err, output)
+		return fmt.Errorf("ffmpeg error: %w, output: %s", err, stderr.Bytes())
 	}
 	return nil
 }
 
-func GetVideoMetadata(filePath string) (VideoMetadata, error) {
-	cmd := exec.Command("ffprobe",
+func GetVideoMetadata(ctx context.Context, filePath string) (VideoMetadata, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
 		"-v", "quiet",
 		"-print_format", "json",
 		"-show_format",
@@ -39,53 +100,75 @@ func GetVideoMetadata(filePath string) (VideoMetadata, error) {
 
 	cmd.Stderr = os.Stderr // Redirect stderr to the main process stderr
 
+	run := startCommand(ctx, cmd)
 	output, err := cmd.Output()
+	run.finish(err)
 	if err != nil {
-		log.Println("Error executing ffprobe command:", err)
+		slog.ErrorContext(ctx, "Error executing ffprobe command", "path", tracing.RedactURL(filePath), "error", err)
 		return VideoMetadata{}, err
 	}
 
-	var result map[string]interface{}
+	var result ffprobeOutput
 	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error unmarshaling ffprobe output:", err)
+		slog.ErrorContext(ctx, "Error unmarshaling ffprobe output", "error", err)
 		return VideoMetadata{}, err
 	}
 
-	streams, ok := result["streams"].([]interface{})
+	// The streams are found by type, their order depends on the container
+	videoStream, ok := result.stream("video")
 	if !ok {
-		log.Println("Error: 'streams' field missing or has wrong type")
-		return VideoMetadata{}, errors.New("missing or wrong type 'streams' field")
+		slog.ErrorContext(ctx, "Input has no video stream", "streams", len(result.Streams))
+		return VideoMetadata{}, errors.New("input has no video stream")
 	}
-
-	videoStream, ok := streams[0].(map[string]interface{})
+	audioStream, ok := result.stream("audio")
 	if !ok {
-		log.Println("Error: first stream entry missing or has wrong type")
-		return VideoMetadata{}, errors.New("missing or wrong type for first stream entry")
-	}
-
-	audioStream, ok := streams[1].(map[string]interface{})
-	if !ok {
-		log.Println("Error: second stream entry missing or has wrong type")
-		return VideoMetadata{}, errors.New("missing or wrong type for second stream entry")
+		slog.ErrorContext(ctx, "Input has no audio stream", "streams", len(result.Streams))
+		return VideoMetadata{}, errors.New("input has no audio stream")
 	}
 
 	metadata := VideoMetadata{
-		BitRate:         videoStream["bit_rate"].(string),
-		FrameRate:       videoStream["r_frame_rate"].(string),
-		AudioSampleRate: audioStream["sample_rate"].(string),
-		AudioChannels:   int(audioStream["channels"].(float64)),
+		BitRate:         videoStream.BitRate,
+		FrameRate:       videoStream.FrameRate,
+		AudioSampleRate: audioStream.SampleRate,
+		AudioChannels:   audioStream.Channels,
 	}
 
 	return metadata, nil
 }
 
+// ffprobeOutput is the part of "ffprobe -show_streams -print_format json" GetVideoMetadata reads
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+}
+
+type ffprobeStream struct {
+	CodecType  string `json:"codec_type"` // video, audio, subtitle or data
+	BitRate    string `json:"bit_rate"`
+	FrameRate  string `json:"r_frame_rate"`
+	SampleRate string `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+}
+
+// stream returns the first stream of the codec type
+func (o ffprobeOutput) stream(codecType string) (ffprobeStream, bool) {
+	for _, stream := range o.Streams {
+		if stream.CodecType == codecType {
+			return stream, true
+		}
+	}
+	return ffprobeStream{}, false
+}
+
 // GetVideoDuration 使用ffprobe來獲得影片的時長，並將時長回傳。
-func GetVideoDuration(videoPath string) (float64, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", videoPath)
+func GetVideoDuration(ctx context.Context, videoPath string) (float64, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", videoPath)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 
-	if err := cmd.Run(); err != nil {
+	run := startCommand(ctx, cmd)
+	err := cmd.Run()
+	run.finish(err)
+	if err != nil {
 		return 0, err
 	}
 
@@ -97,3 +180,18 @@ func GetVideoDuration(videoPath string) (float64, error) {
 
 	return duration, nil
 }
+
+// ToolVersion runs "<tool> -version", e.g. for ffmpeg or ffprobe, and returns the first line it prints.
+// It fails if the tool is not on PATH or does not work.
+func ToolVersion(ctx context.Context, tool string) (string, error) {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return "", err
+	}
+	output, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s -version failed: %w", tool, err)
+	}
+	firstLine, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimSpace(firstLine), nil
+}
@@ -1,20 +1,25 @@
 package video_processing
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
 )
 
-func GetCodecs(filePath string) (string, string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", filePath)
+func GetCodecs(ctx context.Context, filePath string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", filePath)
+	run := startCommand(ctx, cmd)
 	videoCodec, err := cmd.Output()
+	run.finish(err)
 	if err != nil {
 		return "", "", fmt.Errorf("error getting video codec: %v", err)
 	}
 
-	cmd = exec.Command("ffprobe", "-v", "error", "-select_streams", "a:0", "-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", filePath)
+	cmd = exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0", "-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", filePath)
+	run = startCommand(ctx, cmd)
 	audioCodec, err := cmd.Output()
+	run.finish(err)
 	if err != nil {
 		return "", "", fmt.Errorf("error getting audio codec: %v", err)
 	}
@@ -1,15 +1,16 @@
 package video_processing
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"strings"
 )
 
 // MergeVideoAndAudio merges a video and an audio file using ffmpeg and outputs to a specified file.
-func MergeVideoAndAudioBySegments(videoPath string, audioPath string, outputPath string, segmentIdx int, tempDirPrefix string) error {
+func MergeVideoAndAudioBySegments(ctx context.Context, videoPath string, audioPath string, outputPath string, segmentIdx int, tempDirPrefix string) error {
 	tempAudioDir := path.Join(tempDirPrefix, "tempAudio")
 	if err := os.MkdirAll(tempAudioDir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %v", tempAudioDir, err)
@@ -20,26 +21,26 @@ func MergeVideoAndAudioBySegments(videoPath string, audioPath string, outputPath
 
 	//defer os.Remove(tempAudioPath)
 
-	videoDuration, err := GetVideoDuration(videoPath)
+	videoDuration, err := GetVideoDuration(ctx, videoPath)
 	if err != nil {
 		return fmt.Errorf("error getting video duration: %v", err)
 	}
 
-	audioDuration, err := GetVideoDuration(audioPath) // GetVideoDuration works for audio too
+	audioDuration, err := GetVideoDuration(ctx, audioPath) // GetVideoDuration works for audio too
 	if err != nil {
 		return fmt.Errorf("error getting audio duration: %v", err)
 	}
 
 	// If audio is shorter than video, add silent frames
 	if audioDuration < videoDuration {
-		err = execFFMPEG("-y", "-i", audioPath, "-af", fmt.Sprintf("apad=whole_dur=%f", videoDuration), "-y", tempAudioPath)
+		err = execFFMPEG(ctx, "-y", "-i", audioPath, "-af", fmt.Sprintf("apad=whole_dur=%f", videoDuration), "-y", tempAudioPath)
 		if err != nil {
 			return fmt.Errorf("error padding audio with silence: %v", err)
 		}
 	} else if audioDuration > videoDuration {
 		// If audio is longer, speed up the audio slightly
 		atempoValue := audioDuration / videoDuration
-		err = execFFMPEG("-y", "-i", audioPath, "-filter:a", fmt.Sprintf("atempo=%f", atempoValue), "-y", tempAudioPath)
+		err = execFFMPEG(ctx, "-y", "-i", audioPath, "-filter:a", fmt.Sprintf("atempo=%f", atempoValue), "-y", tempAudioPath)
 		if err != nil {
 			return fmt.Errorf("error adjusting audio speed: %v", err)
 		}
@@ -49,7 +50,7 @@ func MergeVideoAndAudioBySegments(videoPath string, audioPath string, outputPath
 	}
 
 	// Merge adjusted audio with video
-	err = execFFMPEG("-y", "-i", videoPath, "-i", tempAudioPath, "-c:v", "copy", "-c:a", "aac", "-strict", "experimental", "-map", "0:v", "-map", "1:a", outputPath)
+	err = execFFMPEG(ctx, "-y", "-i", videoPath, "-i", tempAudioPath, "-c:v", "copy", "-c:a", "aac", "-strict", "experimental", "-map", "0:v", "-map", "1:a", outputPath)
 
 	if err != nil {
 		return fmt.Errorf("error merging video and audio: %v", err)
@@ -57,20 +58,23 @@ func MergeVideoAndAudioBySegments(videoPath string, audioPath string, outputPath
 	return nil
 }
 
-func MergeAllVideoSegmentsTogether(fileName string, segmentPaths []string, tempDirPrefix string) (string, error) {
+// MergeAllVideoSegmentsTogether concatenates the segments into <name>_<jobID>_processed.mp4 under
+// finalVideoDir. The job id keeps jobs processing videos with the same name from overwriting
+// each other's output.
+func MergeAllVideoSegmentsTogether(ctx context.Context, finalVideoDir string, jobID string, fileName string, segmentPaths []string, tempDirPrefix string) (string, error) {
 	// Write all filepath into filelist.txt
 	listFileName := "filelist.txt"
 	listFilePath := path.Join(tempDirPrefix, listFileName)
-	log.Printf("List file path: %s", listFilePath)
+	slog.DebugContext(ctx, "List file path", "path", listFilePath)
 
 	f, err := os.Create(listFilePath)
 	if err != nil {
-		log.Printf("Failed to create list file: %v", err)
+		slog.ErrorContext(ctx, "Failed to create list file", "error", err)
 		return "", fmt.Errorf("failed to create list file: %v", err)
 	}
 	defer f.Close()
 
-	log.Println("Writing all video segment paths to list file...")
+	slog.DebugContext(ctx, "Writing all video segment paths to list file", "segments", len(segmentPaths))
 
 	for _, segmentPath := range segmentPaths {
 		// Remove tempDirPrefix from segmentPath
@@ -78,13 +82,15 @@ func MergeAllVideoSegmentsTogether(fileName string, segmentPaths []string, tempD
 
 		_, err = f.WriteString(fmt.Sprintf("file '%s'\n", relativeSegmentPath))
 		if err != nil {
-			log.Printf("Failed to write segment path to list file: %v", err)
+			slog.ErrorContext(ctx, "Failed to write segment path to list file", "error", err)
 			return "", fmt.Errorf("failed to write segment path to list file: %v", err)
 		}
 	}
 
-	//Merge all segments into final output and store at /pkg/video_processing/final_output
-	finalVideoDir := os.Getenv("PROCESSED_VIDEO_PATH")
+	//Merge all segments into final output and store at finalVideoDir
+	if err := os.MkdirAll(finalVideoDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %v", finalVideoDir, err)
+	}
 
 	//currentTimestamp := time.Now().Unix()
 	//timestampStr := strconv.FormatInt(currentTimestamp, 10)
@@ -92,23 +98,32 @@ func MergeAllVideoSegmentsTogether(fileName string, segmentPaths []string, tempD
 	// 去掉 fileName 的 ".mp4" 後綴
 	fileNameWithoutExt := strings.TrimSuffix(fileName, ".mp4")
 
-	// 生成帶有 '_processed' 後綴的新名稱輸出檔名，並加入時間戳記確保檔案的唯一性
-	outputVideoNameWithTimestamp := fmt.Sprintf("%s_processed.mp4", fileNameWithoutExt)
+	// 生成帶有 '_processed' 後綴的新名稱輸出檔名，並加入工作 ID 確保檔案的唯一性
+	outputVideoNameWithTimestamp := fmt.Sprintf("%s_%s_processed.mp4", fileNameWithoutExt, jobID)
 
 	// 將新名稱用於最終輸出視頻的路徑
 	outputVideoPath := path.Join(finalVideoDir, outputVideoNameWithTimestamp)
 
-	log.Println("Running ffmpeg command to concat all segments from list file...")
+	slog.DebugContext(ctx, "Running ffmpeg command to concat all segments from list file")
+
+	// Write next to the final path and rename once ffmpeg is done, so an interrupted concat
+	// never leaves a half-written _processed.mp4 behind
+	partialVideoPath := path.Join(finalVideoDir, "."+outputVideoNameWithTimestamp+".partial")
 
 	//Run FFmpeg "concat" to merge all segments together
-	err = execFFMPEG("-y", "-f", "concat", "-safe", "0", "-i", listFilePath, "-c", "copy", outputVideoPath)
+	err = execFFMPEG(ctx, "-y", "-f", "concat", "-safe", "0", "-i", listFilePath, "-c", "copy", "-f", "mp4", partialVideoPath)
 	if err != nil {
-		log.Printf("Failed to merge video segments: %v", err)
-		return "", fmt.Errorf("failed to merge video segments: %v", err)
+		os.Remove(partialVideoPath)
+		slog.ErrorContext(ctx, "Failed to merge video segments", "error", err)
+		return "", fmt.Errorf("failed to merge video segments: %w", err)
 	}
 
-	log.Println("Successfully concat all segments from list file...")
+	if err := os.Rename(partialVideoPath, outputVideoPath); err != nil {
+		os.Remove(partialVideoPath)
+		slog.ErrorContext(ctx, "Failed to move merged video into place", "error", err)
+		return "", fmt.Errorf("failed to move merged video into place: %v", err)
+	}
 
-	log.Println("All tempfile has been removed")
+	slog.DebugContext(ctx, "Successfully concatenated all segments from list file", "path", outputVideoPath)
 	return outputVideoPath, nil
 }
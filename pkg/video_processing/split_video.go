@@ -1,8 +1,9 @@
 package video_processing
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"strings"
@@ -14,7 +15,7 @@ type VideoSegment struct {
 	Duration float64
 }
 
-func SplitVideoIntoSegmentsBySRT(videoPath string, srtSegments []whisper_api.SRTSegment, videoDuration float64, tempDirPrefix string) ([]string, []string, error) {
+func SplitVideoIntoSegmentsBySRT(ctx context.Context, videoPath string, srtSegments []whisper_api.SRTSegment, videoDuration float64, tempDirPrefix string) ([]string, []string, error) {
 	var allSegmentPaths []string
 	var voiceSegmentPaths []string
 	tempVideoDir := path.Join(tempDirPrefix, "video")
@@ -59,7 +60,7 @@ func SplitVideoIntoSegmentsBySRT(videoPath string, srtSegments []whisper_api.SRT
 		gapAndEndSegmentInfo = append(gapAndEndSegmentInfo, VideoSegment{Path: endOutputFile, Duration: endDuration})
 	}
 	// 打印 allSegmentPaths 中的總片段數
-	log.Printf("Total number of segments in allSegmentPaths: %d\n", len(allSegmentPaths))
+	slog.DebugContext(ctx, "Total number of segments in allSegmentPaths", "segments", len(allSegmentPaths))
 
 	segmentTimesStr := ""
 	for i, t := range segmentTimes {
@@ -69,11 +70,8 @@ func SplitVideoIntoSegmentsBySRT(videoPath string, srtSegments []whisper_api.SRT
 		segmentTimesStr += fmt.Sprintf("%f", t)
 	}
 
-	log.Println("Segment Times: ", segmentTimes)
-	log.Println("Segment TimesSTR: ", segmentTimesStr)
-
-	log.Println("Spliting video into segments...")
-	err := execFFMPEG("-i", videoPath,
+	slog.DebugContext(ctx, "Splitting video into segments", "segment_times", segmentTimesStr)
+	err := execFFMPEG(ctx, "-y", "-i", videoPath,
 		"-c:v", "libx264",
 		"-c:a", "copy",
 		"-map", "0",
@@ -99,7 +97,7 @@ func SplitVideoIntoSegmentsBySRT(videoPath string, srtSegments []whisper_api.SRT
 		}
 	}
 
-	log.Printf("Total number of segments splited by ffmpeg command: %d\n", segmentCount)
+	slog.DebugContext(ctx, "Total number of segments split by ffmpeg command", "segments", segmentCount)
 
 	for i, expectedPath := range allSegmentPaths {
 		actualPath := tempVideoDir + fmt.Sprintf("segment%d.mp4", i)
@@ -130,14 +128,14 @@ func SplitVideoIntoSegmentsBySRT(videoPath string, srtSegments []whisper_api.SRT
 		// 生成靜音音軌
 		tempAudioPath := tempVideoDir + "temp_audio.aac"
 		durationStr := fmt.Sprintf("%f", nonVoiceDurations[i])
-		err := execFFMPEG("-y", "-f", "lavfi", "-t", durationStr, "-i", "anullsrc=r=44100:cl=stereo", tempAudioPath)
+		err := execFFMPEG(ctx, "-y", "-f", "lavfi", "-t", durationStr, "-i", "anullsrc=r=44100:cl=stereo", tempAudioPath)
 		if err != nil {
 			return nil, nil, fmt.Errorf("error generating silent audio: %v", err)
 		}
 
 		// 合併靜音音軌與原片段視頻
 		tempVideoPath := tempVideoDir + "temp_video.mp4"
-		err = execFFMPEG("-i", path, "-i", tempAudioPath, "-c:v", "copy", "-c:a", "aac", "-strict", "experimental", "-map", "0:v", "-map", "1:a", tempVideoPath)
+		err = execFFMPEG(ctx, "-y", "-i", path, "-i", tempAudioPath, "-c:v", "copy", "-c:a", "aac", "-strict", "experimental", "-map", "0:v", "-map", "1:a", tempVideoPath)
 		if err != nil {
 			return nil, nil, fmt.Errorf("error merging video and audio: %v", err)
 		}
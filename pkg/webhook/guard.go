@@ -0,0 +1,217 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidCallbackURL = errors.New("invalid callback URL")
+	ErrBlockedAddress     = errors.New("callback address is not allowed")
+)
+
+// Ranges that are never reachable from the internet, on top of what net.IP already classifies
+// as loopback, private, link-local, multicast or unspecified
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved
+	"64:ff9b::/96",    // NAT64, may map to any IPv4 address
+	"2001:db8::/32",   // documentation
+)
+
+// URLGuard decides which callback URLs may be called, to keep callers from making the service
+// POST to localhost, cloud metadata endpoints or other internal services.
+// URLs are checked at submission, and the resolved IP is checked again when connecting so a
+// hostname that later resolves to an internal address (DNS rebinding) is still refused.
+type URLGuard struct {
+	schemes      map[string]bool
+	hosts        []string     // allowed host names, "*.example.com" matches subdomains; empty allows any
+	networks     []*net.IPNet // allowed networks, reachable even if they are private or not in hosts
+	allowPrivate bool         // development override, allows loopback and private addresses
+}
+
+// NewURLGuard builds a guard allowing the given schemes and hosts. Entries of allowedHosts are
+// host names, "*.domain" wildcards or CIDRs; an empty list allows any public host.
+func NewURLGuard(allowedSchemes []string, allowedHosts []string, allowPrivate bool) (*URLGuard, error) {
+	g := &URLGuard{schemes: make(map[string]bool), allowPrivate: allowPrivate}
+	for _, scheme := range allowedSchemes {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			g.schemes[scheme] = true
+		}
+	}
+	if len(g.schemes) == 0 {
+		return nil, fmt.Errorf("at least one callback URL scheme must be allowed")
+	}
+
+	for _, host := range allowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if strings.Contains(host, "/") {
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed callback network %q: %v", host, err)
+			}
+			g.networks = append(g.networks, network)
+			continue
+		}
+		g.hosts = append(g.hosts, host)
+	}
+	return g, nil
+}
+
+// Validate checks the scheme and host of a callback URL. IP literals are checked against the
+// blocked ranges right away; host names are checked once they are resolved, when connecting.
+func (g *URLGuard) Validate(rawURL string) error {
+	if g == nil {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCallbackURL, err)
+	}
+	if !g.schemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrInvalidCallbackURL, u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrInvalidCallbackURL)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in the URL are not allowed", ErrInvalidCallbackURL)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !g.hostAllowed(host) && !g.inAllowedNetwork(ip) {
+			return fmt.Errorf("%w: host %s is not in the allowlist", ErrInvalidCallbackURL, host)
+		}
+		if err := g.checkIP(ip); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidCallbackURL, err)
+		}
+		return nil
+	}
+
+	if !g.hostAllowed(host) {
+		return fmt.Errorf("%w: host %s is not in the allowlist", ErrInvalidCallbackURL, host)
+	}
+	if !g.allowPrivate && (host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return fmt.Errorf("%w: host %s is not allowed", ErrInvalidCallbackURL, host)
+	}
+	return nil
+}
+
+// Client returns an HTTP client that only connects to allowed addresses and validates redirects
+func (g *URLGuard) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   g.control,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect on our behalf, out of reach of the dial-time check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("stopped after 5 redirects")
+			}
+			return g.Validate(req.URL.String())
+		},
+	}
+}
+
+// control runs after DNS resolution and before connecting, with the IP actually being dialled
+func (g *URLGuard) control(network, address string, _ syscall.RawConn) error {
+	if g == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s is not an IP address", ErrBlockedAddress, host)
+	}
+	return g.checkIP(ip)
+}
+
+// checkIP refuses loopback, private, link-local and reserved addresses unless they are explicitly allowed
+func (g *URLGuard) checkIP(ip net.IP) error {
+	if g.allowPrivate || g.inAllowedNetwork(ip) {
+		return nil
+	}
+	if blockedIP(ip) {
+		return fmt.Errorf("%w: %s is a private or reserved address", ErrBlockedAddress, ip)
+	}
+	return nil
+}
+
+func (g *URLGuard) hostAllowed(host string) bool {
+	if len(g.hosts) == 0 {
+		return true
+	}
+	for _, allowed := range g.hosts {
+		if host == allowed {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *URLGuard) inAllowedNetwork(ip net.IP) bool {
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store is an append-only log of delivery snapshots on disk, one JSON line per attempt,
+// so the delivery history survives restarts and pending deliveries can be resumed.
+type Store struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+type storeRecord struct {
+	RecordedAt time.Time `json:"recorded_at"`
+	Delivery   Delivery  `json:"delivery"`
+}
+
+// OpenStore opens (or creates) the delivery log at the given path.
+func OpenStore(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create delivery log directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open delivery log %s: %v", path, err)
+	}
+
+	return &Store{path: path, file: file}, nil
+}
+
+// Append writes a snapshot of the delivery to the end of the log and flushes it to disk.
+func (s *Store) Append(delivery Delivery) error {
+	line, err := json.Marshal(storeRecord{RecordedAt: time.Now().UTC(), Delivery: delivery})
+	if err != nil {
+		return fmt.Errorf("failed to encode delivery %s: %v", delivery.ID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append delivery %s to log: %v", delivery.ID, err)
+	}
+	return s.file.Sync()
+}
+
+// Load replays the log and returns the latest snapshot of every delivery.
+func (s *Store) Load() (map[string]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open delivery log %s: %v", s.path, err)
+	}
+	defer file.Close()
+
+	latest := make(map[string]Delivery)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		var record storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash in the middle of a write leaves a truncated last line behind
+			slog.Warn("Skipping unreadable delivery log record", "line", lineNumber, "error", err)
+			continue
+		}
+		latest[record.Delivery.ID] = record.Delivery
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read delivery log %s: %v", s.path, err)
+	}
+
+	return latest, nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,341 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"videoUploadAndProcessing/pkg/logging"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/tracing"
+)
+
+// Headers sent with every delivery. The signature is the hex HMAC-SHA256 of "<timestamp>.<body>"
+// keyed with the shared secret, so receivers can verify the sender and reject replayed requests.
+const (
+	HeaderSignature = "X-Webhook-Signature"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderEvent     = "X-Webhook-Event"
+)
+
+// Receivers that do not answer within this time count as a failed attempt
+const requestTimeout = 30 * time.Second
+
+// DefaultPolicy retries a failing receiver for roughly twenty minutes
+var DefaultPolicy = retry.Policy{
+	MaxAttempts:    8,
+	InitialBackoff: 10 * time.Second,
+	MaxBackoff:     10 * time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// DeliveryState is where a delivery stands
+type DeliveryState string
+
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+// Attempt records a single POST to the receiver
+type Attempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Delivery is one webhook sent to a receiver, with every attempt made so far
+type Delivery struct {
+	ID          string          `json:"id"`
+	JobID       string          `json:"job_id"`
+	Event       string          `json:"event"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	TraceParent string          `json:"trace_parent,omitempty"` // trace the requests continue, sent in the traceparent header
+	State       DeliveryState   `json:"state"`
+	Attempts    []Attempt       `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// Dispatcher signs webhooks, delivers them in the background with retries and keeps a log of every delivery
+type Dispatcher struct {
+	secret []byte
+	policy retry.Policy
+	guard  *URLGuard // may be nil, any URL is then allowed
+	client *http.Client
+	store  *Store // may be nil, deliveries are then only kept in memory
+
+	mu         sync.RWMutex
+	deliveries map[string]*Delivery
+	onceMu     sync.Mutex // serializes DeliverOnce
+}
+
+// NewDispatcher creates a dispatcher signing with secret (unsigned when empty) that only calls the
+// URLs allowed by guard, and restores the delivery log from the store, if there is one.
+// Use ResumePending to retry the unfinished deliveries.
+func NewDispatcher(secret string, policy retry.Policy, guard *URLGuard, store *Store) (*Dispatcher, error) {
+	d := &Dispatcher{
+		secret:     []byte(secret),
+		policy:     policy,
+		guard:      guard,
+		client:     &http.Client{Timeout: requestTimeout},
+		store:      store,
+		deliveries: make(map[string]*Delivery),
+	}
+	if guard != nil {
+		d.client = guard.Client(requestTimeout)
+	}
+
+	if store != nil {
+		snapshots, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+		for id, snapshot := range snapshots {
+			delivery := snapshot.clone()
+			d.deliveries[id] = &delivery
+		}
+	}
+	return d, nil
+}
+
+// ValidateURL reports whether callbacks may be sent to rawURL, so bad URLs are refused at submission
+func (d *Dispatcher) ValidateURL(rawURL string) error {
+	if d == nil {
+		return nil
+	}
+	return d.guard.Validate(rawURL)
+}
+
+// Deliver records a new delivery of payload to url and sends it in the background.
+// It returns the pending delivery right away. The requests continue the trace of the span in ctx.
+func (d *Dispatcher) Deliver(ctx context.Context, jobID, event, url string, payload interface{}) (Delivery, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Delivery{}, fmt.Errorf("failed to encode webhook payload: %v", err)
+	}
+	id, err := newDeliveryID()
+	if err != nil {
+		return Delivery{}, fmt.Errorf("failed to generate delivery id: %v", err)
+	}
+
+	now := time.Now().UTC()
+	delivery := &Delivery{
+		ID:          id,
+		JobID:       jobID,
+		Event:       event,
+		URL:         url,
+		Payload:     body,
+		TraceParent: tracing.TraceParent(ctx),
+		State:       DeliveryPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	d.mu.Lock()
+	d.deliveries[id] = delivery
+	d.persist(*delivery)
+	snapshot := delivery.clone()
+	d.mu.Unlock()
+
+	go d.send(snapshot)
+	return snapshot, nil
+}
+
+// DeliverOnce is Deliver, unless an event of the same kind was already delivered, or is being
+// delivered, for jobID. sent reports whether a new delivery was made.
+func (d *Dispatcher) DeliverOnce(ctx context.Context, jobID, event, url string, payload interface{}) (delivery Delivery, sent bool, err error) {
+	d.onceMu.Lock()
+	defer d.onceMu.Unlock()
+
+	for _, existing := range d.List(jobID) {
+		if existing.Event == event && existing.State != DeliveryFailed {
+			return existing, false, nil
+		}
+	}
+	delivery, err = d.Deliver(ctx, jobID, event, url, payload)
+	return delivery, err == nil, err
+}
+
+// ResumePending sends the deliveries that were still pending when the service stopped
+func (d *Dispatcher) ResumePending() {
+	for _, delivery := range d.List("") {
+		if delivery.State != DeliveryPending {
+			continue
+		}
+		slog.Info("Resuming pending webhook delivery", "delivery_id", delivery.ID, "job_id", delivery.JobID)
+		go d.send(delivery)
+	}
+}
+
+// Get returns a snapshot of the delivery with the given id
+func (d *Dispatcher) Get(id string) (Delivery, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	delivery, ok := d.deliveries[id]
+	if !ok {
+		return Delivery{}, false
+	}
+	return delivery.clone(), true
+}
+
+// List returns the deliveries of the job, or of every job when jobID is empty, oldest first
+func (d *Dispatcher) List(jobID string) []Delivery {
+	d.mu.RLock()
+	list := make([]Delivery, 0)
+	for _, delivery := range d.deliveries {
+		if jobID == "" || delivery.JobID == jobID {
+			list = append(list, delivery.clone())
+		}
+	}
+	d.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// send posts the delivery until the receiver accepts it or the retry policy gives up
+func (d *Dispatcher) send(delivery Delivery) {
+	ctx := logging.With(context.Background(), "job_id", delivery.JobID, "delivery_id", delivery.ID)
+	err := retry.Do(ctx, d.policy, "Webhook delivery", func() error {
+		return d.attempt(delivery)
+	})
+
+	state := DeliveryDelivered
+	if err != nil {
+		state = DeliveryFailed
+		slog.ErrorContext(ctx, "Webhook delivery failed", "error", err)
+	} else {
+		slog.InfoContext(ctx, "Webhook delivered", "event", delivery.Event)
+	}
+	d.update(delivery.ID, func(delivery *Delivery) {
+		delivery.State = state
+	})
+}
+
+// attempt makes a single signed POST and records its outcome
+func (d *Dispatcher) attempt(delivery Delivery) error {
+	startedAt := time.Now()
+	statusCode, err := d.post(delivery)
+
+	d.update(delivery.ID, func(delivery *Delivery) {
+		attempt := Attempt{
+			At:         startedAt.UTC(),
+			StatusCode: statusCode,
+			DurationMS: time.Since(startedAt).Milliseconds(),
+		}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		delivery.Attempts = append(delivery.Attempts, attempt)
+	})
+	return err
+}
+
+func (d *Dispatcher) post(delivery Delivery) (int, error) {
+	// The allowlist may have changed since the job was submitted
+	if err := d.guard.Validate(delivery.URL); err != nil {
+		return 0, retry.Permanent(err)
+	}
+	ctx := tracing.ContextWithTraceParent(context.Background(), delivery.TraceParent)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, retry.Permanent(fmt.Errorf("invalid callback URL: %v", err))
+	}
+
+	// Signed again on every attempt so the timestamp tells the receiver how fresh the request is
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderEvent, delivery.Event)
+	if len(d.secret) > 0 {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(d.secret, timestamp, delivery.Payload))
+	}
+
+	span := tracing.StartRequest(req, "Webhook "+delivery.Event)
+	span.SetAttributes(tracing.String("webhook.delivery_id", delivery.ID), tracing.String("job.id", delivery.JobID))
+	resp, err := d.client.Do(req)
+	span.EndRequest(resp, err)
+	if errors.Is(err, ErrBlockedAddress) || errors.Is(err, ErrInvalidCallbackURL) {
+		return 0, retry.Permanent(err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, retry.NewStatusError("Callback receiver", resp)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign computes the hex HMAC-SHA256 of "<timestamp>.<body>", as sent in the X-Webhook-Signature header
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) update(id string, change func(delivery *Delivery)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery, ok := d.deliveries[id]
+	if !ok {
+		return
+	}
+	change(delivery)
+	delivery.UpdatedAt = time.Now().UTC()
+	d.persist(*delivery)
+}
+
+// persist appends the snapshot to the store, if there is one. The caller must hold d.mu.
+func (d *Dispatcher) persist(delivery Delivery) {
+	if d.store == nil {
+		return
+	}
+	if err := d.store.Append(delivery); err != nil {
+		slog.Error("Failed to persist webhook delivery", "delivery_id", delivery.ID, "error", err)
+	}
+}
+
+func (d *Delivery) clone() Delivery {
+	c := *d
+	c.Payload = append(json.RawMessage(nil), d.Payload...)
+	c.Attempts = make([]Attempt, len(d.Attempts))
+	copy(c.Attempts, d.Attempts)
+	return c
+}
+
+func newDeliveryID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
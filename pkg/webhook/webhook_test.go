@@ -0,0 +1,49 @@
+package webhook
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{
+			name:      "event",
+			secret:    "whsec_test",
+			timestamp: "1700000000",
+			body:      `{"job_id":"abc","state":"completed"}`,
+			want:      "87967a3e92e6a05100a13364e16fd891ac784ac3721d833673f603512d062c70",
+		},
+		{
+			name:      "empty body",
+			secret:    "secret",
+			timestamp: "0",
+			body:      "",
+			want:      "3445798a051818ef95def46c2eb62b43d377ce6e3c29b4d0aec3da0e59577f79",
+		},
+		{
+			name:      "empty secret",
+			secret:    "",
+			timestamp: "1700000000",
+			body:      "{}",
+			want:      "a9dc44c8eda3de70e9cbf3e488895f1abc26acb1461d3124a3cb886af35251cf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign([]byte(tt.secret), tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("Sign = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignCoversTimestamp(t *testing.T) {
+	body := []byte(`{"job_id":"abc"}`)
+	if Sign([]byte("secret"), "1700000000", body) == Sign([]byte("secret"), "1700000001", body) {
+		t.Error("signatures of different timestamps must differ, or old deliveries could be replayed")
+	}
+}
@@ -0,0 +1,20 @@
+package whisper_api
+
+import (
+	"net/http"
+	"time"
+	"videoUploadAndProcessing/pkg/metrics"
+)
+
+var requestDuration = metrics.NewHistogram("whisper_request_duration_seconds",
+	`Latency of Whisper API requests by response status ("error" when no response was received), the _count series give the error rate.`,
+	metrics.DefaultBuckets, "status")
+
+// observeRequest records a request sent at started, res is nil if it failed
+func observeRequest(started time.Time, res *http.Response, err error) {
+	statusCode := 0
+	if res != nil {
+		statusCode = res.StatusCode
+	}
+	requestDuration.Observe(time.Since(started).Seconds(), metrics.StatusLabel(statusCode, err))
+}
@@ -2,12 +2,15 @@ package whisper_api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
+	"time"
+	"videoUploadAndProcessing/pkg/retry"
+	"videoUploadAndProcessing/pkg/tracing"
 )
 
 // 定義Whisper API的響應結構
@@ -42,7 +45,15 @@ type WhisperAndWordTimestamps struct {
 	WordTimestamps []WordTimestamp
 }
 
-func CallWhisperAPI(apiKey string, audioReader io.Reader) (*WhisperAndWordTimestamps, error) {
+// DefaultLanguage is the language of the speech unless another one is given
+const DefaultLanguage = "en"
+
+// CallWhisperAPI uploads the audio for transcription; the request is aborted if ctx is cancelled.
+// The speech is transcribed as language, or DefaultLanguage when it is empty.
+func CallWhisperAPI(ctx context.Context, apiKey string, language string, audioReader io.Reader) (*WhisperAndWordTimestamps, error) {
+	if language == "" {
+		language = DefaultLanguage
+	}
 
 	url := "https://transcribe.whisperapi.com"
 	method := "POST"
@@ -62,7 +73,7 @@ func CallWhisperAPI(apiKey string, audioReader io.Reader) (*WhisperAndWordTimest
 	_ = writer.WriteField("fileType", "mp3")
 	_ = writer.WriteField("diarization", "false")
 	_ = writer.WriteField("numSpeakers", "2")
-	_ = writer.WriteField("language", "en")
+	_ = writer.WriteField("language", language)
 	_ = writer.WriteField("task", "transcribe")
 
 	err = writer.Close()
@@ -71,7 +82,7 @@ func CallWhisperAPI(apiKey string, audioReader io.Reader) (*WhisperAndWordTimest
 	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest(method, url, payload)
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
 
 	if err != nil {
 		return nil, err
@@ -79,16 +90,20 @@ func CallWhisperAPI(apiKey string, audioReader io.Reader) (*WhisperAndWordTimest
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	req.Header.Add("Authorization", "Bearer "+apiKey)
 
+	started := time.Now()
+	span := tracing.StartRequest(req, "Whisper API")
 	res, err := client.Do(req)
+	span.EndRequest(res, err)
+	observeRequest(started, res, err)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Whisper API responded with status Code: %d", res.StatusCode)
+	slog.DebugContext(ctx, "Whisper API responded", "status_code", res.StatusCode)
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		log.Printf("Whisper API responded with status code: %d", res.StatusCode)
-		return nil, errors.New("received non-200 status code")
+		slog.ErrorContext(ctx, "Unexpected status code from Whisper API", "status_code", res.StatusCode)
+		return nil, retry.NewStatusError("Whisper API", res)
 	}
 
 	body, err := io.ReadAll(res.Body)
@@ -99,11 +114,11 @@ func CallWhisperAPI(apiKey string, audioReader io.Reader) (*WhisperAndWordTimest
 	var whisperResp WhisperResponse
 	err = json.Unmarshal(body, &whisperResp)
 	if err != nil {
-		log.Printf("Error unmarshaling Whisper API response: %v", err)
+		slog.ErrorContext(ctx, "Error unmarshaling Whisper API response", "error", err)
 		return nil, err
 	}
 
-	log.Printf("Whisper API response unmarshaled successfully")
+	slog.DebugContext(ctx, "Whisper API response unmarshaled successfully")
 	/*
 		// 迭代whisperResp.Segments並打印每個段落的Text字段
 		for i, segment := range whisperResp.Segments {
@@ -111,7 +126,7 @@ func CallWhisperAPI(apiKey string, audioReader io.Reader) (*WhisperAndWordTimest
 		}
 	*/
 
-	log.Printf("Whisper API response text: %+v", whisperResp.Text)
+	slog.DebugContext(ctx, "Whisper API response text", "text", whisperResp.Text)
 
 	//Define the content of the sentenceTimestamps for video
 	/*sentenceTimestamps := []SentenceTimestamp{}